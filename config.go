@@ -0,0 +1,98 @@
+package sudp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config tunes connections of [DialConfig] and [ListenConfig],
+// zero fields take default values. Both sides may use different configs,
+// limits of the peer are sent in the handshake.
+// Streams (see [Stream]) keep their own fixed buffers.
+type Config struct {
+	// ConnBuffer is the number of received packets that the connection may not handle yet,
+	// further packets are dropped (default 256)
+	ConnBuffer int
+	// ReadBuffer is the number of packets that may wait for the reader,
+	// the peer doesn't send beyond it (default 4096)
+	ReadBuffer int
+	// AcceptBacklog is the number of connections that wait for Accept of the listener,
+	// further connections are refused (default 256)
+	AcceptBacklog int
+	// AckDelay is how long received packets wait for more packets before they are acknowledged
+	// (default 20ms), MaxAckDelay is how long they may wait at most (default 60ms),
+	// it should not be less than AckDelay. Longer delays send fewer acknowledgments,
+	// but the peer resends lost packets later.
+	AckDelay    time.Duration
+	MaxAckDelay time.Duration
+	// ResendTries is how many times packets are resent before the connection
+	// is closed without response (default 3)
+	ResendTries int
+	// MaxPacketSize is the largest size of packets that path MTU discovery probes
+	// and that the peer may send, from 1232 to 8972 bytes (default 8972)
+	MaxPacketSize int
+
+	// Messages enables message mode (see [DialMessages])
+	Messages bool
+	// PSK enables pre-shared key mode (see [DialPSK])
+	PSK []byte
+	// TLS enables TLS mode (see [DialTLS]), it can't be used with PSK
+	TLS *tls.Config
+}
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// options validates the config and fills default values, nil config has only default values
+func (c *Config) options() (options, error) {
+	opts := defaultOptions()
+	if c == nil {
+		return opts, nil
+	}
+
+	if c.PSK != nil && len(c.PSK) < minPSKSize {
+		return options{}, ErrShortPSK
+	}
+	if c.PSK != nil && c.TLS != nil {
+		return options{}, errPSKWithTLS
+	}
+	if c.ConnBuffer < 0 || c.ConnBuffer > receivedHistory/2 {
+		return options{}, fmt.Errorf("%w: ConnBuffer should be from 0 to %d", ErrInvalidConfig, receivedHistory/2)
+	}
+	if c.ReadBuffer < 0 || c.ReadBuffer > receivedHistory/2 {
+		return options{}, fmt.Errorf("%w: ReadBuffer should be from 0 to %d", ErrInvalidConfig, receivedHistory/2)
+	}
+	if c.AcceptBacklog < 0 {
+		return options{}, fmt.Errorf("%w: negative AcceptBacklog", ErrInvalidConfig)
+	}
+	if c.AckDelay < 0 || c.MaxAckDelay < 0 || c.MaxAckDelay > maxAckDelayField {
+		return options{}, fmt.Errorf("%w: AckDelay and MaxAckDelay should be from 0 to %s", ErrInvalidConfig, maxAckDelayField)
+	}
+	if c.ResendTries < 0 {
+		return options{}, fmt.Errorf("%w: negative ResendTries", ErrInvalidConfig)
+	}
+	if c.MaxPacketSize != 0 && (c.MaxPacketSize < minPacketSize || c.MaxPacketSize > maxPacketSize) {
+		return options{}, fmt.Errorf("%w: MaxPacketSize should be from %d to %d", ErrInvalidConfig, minPacketSize, maxPacketSize)
+	}
+
+	opts.messages, opts.psk, opts.tls = c.Messages, c.PSK, c.TLS
+	setIfNotZero(&opts.connBuffer, c.ConnBuffer)
+	setIfNotZero(&opts.readBuffer, c.ReadBuffer)
+	setIfNotZero(&opts.acceptBacklog, c.AcceptBacklog)
+	setIfNotZero(&opts.ackDelay, c.AckDelay)
+	setIfNotZero(&opts.maxAckDelay, c.MaxAckDelay)
+	setIfNotZero(&opts.resendTries, c.ResendTries)
+	setIfNotZero(&opts.maxPacketSize, c.MaxPacketSize)
+	if opts.maxAckDelay < opts.ackDelay {
+		return options{}, fmt.Errorf("%w: MaxAckDelay is less than AckDelay", ErrInvalidConfig)
+	}
+	return opts, nil
+}
+
+func setIfNotZero[T comparable](dst *T, v T) {
+	var zero T
+	if v != zero {
+		*dst = v
+	}
+}
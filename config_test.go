@@ -0,0 +1,84 @@
+package sudp
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+	t.Run("Zero fields should take default values", func(t *testing.T) {
+		assert := assert.New(t)
+
+		opts, err := (&Config{}).options()
+		assert.NoError(err)
+		assert.Equal(defaultOptions(), opts)
+		opts, err = (*Config)(nil).options()
+		assert.NoError(err)
+		assert.Equal(defaultOptions(), opts)
+		tp := opts.transportParameters()
+		assert.EqualValues(maxPacketSize, tp.maxPacketSize)
+		assert.EqualValues(connCap, tp.connBuffer)
+		assert.EqualValues(userCap, tp.readBuffer)
+		assert.EqualValues(rLongTime/time.Microsecond, tp.maxAckDelay)
+	})
+
+	t.Run("Should take set fields", func(t *testing.T) {
+		assert := assert.New(t)
+
+		opts, err := (&Config{
+			ConnBuffer:    16,
+			ReadBuffer:    64,
+			AcceptBacklog: 1,
+			AckDelay:      time.Millisecond,
+			MaxAckDelay:   2 * time.Millisecond,
+			ResendTries:   5,
+			MaxPacketSize: minPacketSize,
+			Messages:      true,
+		}).options()
+
+		assert.NoError(err)
+		assert.Equal(options{
+			messages:      true,
+			connBuffer:    16,
+			readBuffer:    64,
+			acceptBacklog: 1,
+			ackDelay:      time.Millisecond,
+			maxAckDelay:   2 * time.Millisecond,
+			resendTries:   5,
+			maxPacketSize: minPacketSize,
+		}, opts)
+		params := opts.transportParameters()
+		assert.EqualValues(minPacketSize, params.maxPacketSize)
+		assert.EqualValues(16, params.connBuffer)
+		assert.EqualValues(64, params.readBuffer)
+		assert.EqualValues(1000, params.ackDelay)
+		assert.EqualValues(2000, params.maxAckDelay)
+		assert.True(params.messages)
+	})
+
+	t.Run("Should validate fields", func(t *testing.T) {
+		assert := assert.New(t)
+
+		for _, c := range []Config{
+			{ConnBuffer: -1},
+			{ReadBuffer: receivedHistory},
+			{AcceptBacklog: -1},
+			{AckDelay: -time.Millisecond},
+			{MaxAckDelay: time.Hour},
+			{AckDelay: time.Second}, // longer than default MaxAckDelay
+			{ResendTries: -1},
+			{MaxPacketSize: minPacketSize - 1},
+			{MaxPacketSize: maxPacketSize + 1},
+		} {
+			_, err := c.options()
+			assert.ErrorIs(err, ErrInvalidConfig, "%+v", c)
+		}
+		_, err := (&Config{PSK: []byte{1}}).options()
+		assert.ErrorIs(err, ErrShortPSK)
+		_, err = (&Config{PSK: testPSK, TLS: &tls.Config{}}).options()
+		assert.ErrorIs(err, errPSKWithTLS)
+	})
+}
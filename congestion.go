@@ -0,0 +1,167 @@
+package sudp
+
+import (
+	"math"
+	"time"
+)
+
+// CongestionController decides how many bytes the connection may have in flight,
+// that is sent but not acknowledged yet.
+// Its methods are not called concurrently, so it needs no synchronization.
+type CongestionController interface {
+	// Window returns the congestion window in bytes
+	Window() int
+	// OnAck is called when sent packets of acked bytes are acknowledged,
+	// packets acknowledged in the recovery after the loss are not reported
+	OnAck(acked int, rtt time.Duration, now time.Time)
+	// OnLoss is called once for the packets lost together
+	OnLoss(now time.Time)
+	// PacingRate returns the rate in bytes per second at which packets should be sent,
+	// zero means that packets are sent without pacing
+	PacingRate(rtt time.Duration) int
+}
+
+const (
+	// windows are counted in packets of the ethernet size,
+	// so they don't depend on the discovered packet size
+	congestionMSS = ethernetPacketSize
+	// like in RFC 6928
+	initialWindow = 10 * congestionMSS
+	minWindow     = 2 * congestionMSS
+)
+
+func defaultCongestionController() CongestionController {
+	return NewCubic()
+}
+
+// pacingRate spreads the window over rtt,
+// in slow start it allows the window to double and after it to grow a bit (like in Linux)
+func pacingRate(window, ssthresh int, rtt time.Duration) int {
+	if rtt <= 0 {
+		return 0
+	}
+
+	gain := 1.25
+	if window < ssthresh {
+		gain = 2
+	}
+	return int(gain * float64(window) / rtt.Seconds())
+}
+
+// NewNewReno returns the congestion controller that halves the window on loss
+// and increases it by one packet per rtt after the slow start (RFC 5681, RFC 9002)
+func NewNewReno() CongestionController {
+	return &newReno{
+		window:   initialWindow,
+		ssthresh: math.MaxInt,
+	}
+}
+
+type newReno struct {
+	window   int
+	ssthresh int
+	acked    int // in congestion avoidance, to grow the window by one packet per window
+}
+
+func (r *newReno) Window() int {
+	return r.window
+}
+
+func (r *newReno) OnAck(acked int, _ time.Duration, _ time.Time) {
+	if r.window < r.ssthresh { // slow start
+		r.window += acked
+		return
+	}
+
+	r.acked += acked
+	if r.acked >= r.window {
+		r.acked -= r.window
+		r.window += congestionMSS
+	}
+}
+
+func (r *newReno) OnLoss(_ time.Time) {
+	r.ssthresh = max(r.window/2, minWindow)
+	r.window = r.ssthresh
+	r.acked = 0
+}
+
+func (r *newReno) PacingRate(rtt time.Duration) int {
+	return pacingRate(r.window, r.ssthresh, rtt)
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+	// increase of the reno-friendly window per rtt in packets
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// NewCubic returns the congestion controller that grows the window
+// by the cubic function of the time since the last loss (RFC 9438),
+// so it recovers fast on paths with the long rtt
+func NewCubic() CongestionController {
+	return &cubic{
+		window:   initialWindow,
+		ssthresh: math.MaxInt,
+	}
+}
+
+type cubic struct {
+	window     int
+	ssthresh   int
+	windowMax  int       // window before the last loss
+	epochStart time.Time // start of the congestion avoidance, zero in slow start
+	origin     int       // window at the plateau of the cubic function
+	k          float64   // seconds to reach the origin
+	renoWindow float64   // window that reno would have, cubic is not slower than it
+}
+
+func (c *cubic) Window() int {
+	return c.window
+}
+
+func (c *cubic) OnAck(acked int, rtt time.Duration, now time.Time) {
+	if c.window < c.ssthresh { // slow start
+		c.window += acked
+		return
+	}
+
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.renoWindow = float64(c.window)
+		if c.window < c.windowMax {
+			c.k = math.Cbrt(float64(c.windowMax-c.window) / congestionMSS / cubicC)
+			c.origin = c.windowMax
+		} else {
+			c.k = 0
+			c.origin = c.window
+		}
+	}
+
+	t := now.Add(rtt).Sub(c.epochStart).Seconds() - c.k
+	target := float64(c.origin) + cubicC*t*t*t*congestionMSS
+	target = min(max(target, float64(c.window)), 1.5*float64(c.window))
+	c.renoWindow += cubicAlpha * congestionMSS * float64(acked) / float64(c.window)
+
+	if c.renoWindow > target { // reno-friendly region
+		c.window = int(c.renoWindow)
+		return
+	}
+	c.window += int((target - float64(c.window)) * float64(acked) / float64(c.window))
+}
+
+func (c *cubic) OnLoss(_ time.Time) {
+	if c.window < c.windowMax { // fast convergence, give the bandwidth to new flows
+		c.windowMax = int(float64(c.window) * (1 + cubicBeta) / 2)
+	} else {
+		c.windowMax = c.window
+	}
+	c.ssthresh = max(int(float64(c.window)*cubicBeta), minWindow)
+	c.window = c.ssthresh
+	c.epochStart = time.Time{}
+}
+
+func (c *cubic) PacingRate(rtt time.Duration) int {
+	return pacingRate(c.window, c.ssthresh, rtt)
+}
@@ -0,0 +1,134 @@
+package sudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReno(t *testing.T) {
+	t.Run("Slow start should double window every rtt", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewNewReno()
+
+		cc.OnAck(cc.Window(), 100*time.Millisecond, time.Now())
+
+		assert.Equal(2*initialWindow, cc.Window())
+	})
+
+	t.Run("Loss should halve window", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewNewReno()
+
+		cc.OnLoss(time.Now())
+
+		assert.Equal(initialWindow/2, cc.Window())
+	})
+
+	t.Run("Congestion avoidance should grow window by one packet every rtt", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewNewReno()
+		cc.OnLoss(time.Now())
+		window := cc.Window()
+
+		for range 2 {
+			cc.OnAck(window/2, 100*time.Millisecond, time.Now())
+		}
+		assert.Equal(window+congestionMSS, cc.Window())
+	})
+
+	t.Run("Window should not be less than minimum", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewNewReno()
+
+		for range 10 {
+			cc.OnLoss(time.Now())
+		}
+
+		assert.Equal(minWindow, cc.Window())
+	})
+
+	t.Run("Pacing rate should spread window over rtt", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewNewReno()
+
+		assert.InDelta(2*initialWindow*10, cc.PacingRate(100*time.Millisecond), 1, "slow start")
+		cc.OnLoss(time.Now())
+		assert.InDelta(1.25*float64(initialWindow/2)*10, cc.PacingRate(100*time.Millisecond), 1)
+		assert.Zero(cc.PacingRate(0))
+	})
+}
+
+func TestCubic(t *testing.T) {
+	t.Run("Slow start should double window every rtt", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewCubic()
+
+		cc.OnAck(cc.Window(), 100*time.Millisecond, time.Now())
+
+		assert.Equal(2*initialWindow, cc.Window())
+	})
+
+	t.Run("Loss should reduce window by beta", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewCubic()
+
+		cc.OnLoss(time.Now())
+
+		assert.Equal(int(initialWindow*cubicBeta), cc.Window())
+	})
+
+	t.Run("Window should return to the size before loss and then grow", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewCubic()
+		rtt := 100 * time.Millisecond
+		now := time.Now()
+		for range 6 { // slow start to 640 packets
+			cc.OnAck(cc.Window(), rtt, now)
+		}
+		before := cc.Window()
+		cc.OnLoss(now)
+		assert.Less(cc.Window(), before)
+
+		k := cc.(*cubic)
+		for range 1000 {
+			now = now.Add(rtt)
+			cc.OnAck(cc.Window(), rtt, now)
+			if now.Sub(k.epochStart).Seconds() > k.k {
+				break
+			}
+		}
+		assert.InDelta(before, cc.Window(), float64(before)/10, "should be near the plateau after k")
+
+		for range 10 {
+			now = now.Add(rtt)
+			cc.OnAck(cc.Window(), rtt, now)
+		}
+		assert.Greater(cc.Window(), before)
+	})
+
+	t.Run("Should not be slower than reno", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewCubic()
+		now := time.Now()
+		cc.OnLoss(now)
+		window := cc.Window()
+
+		// without the previous maximum cubic function grows slowly in the first rtt
+		cc.OnAck(window, time.Millisecond, now)
+
+		assert.InDelta(float64(window)+cubicAlpha*congestionMSS, cc.Window(), 1)
+	})
+
+	t.Run("Window should not be less than minimum", func(t *testing.T) {
+		assert := assert.New(t)
+		cc := NewCubic()
+
+		for range 20 {
+			cc.OnLoss(time.Now())
+		}
+
+		assert.Equal(minWindow, cc.Window())
+	})
+}
@@ -1,10 +1,15 @@
 package sudp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,24 +32,172 @@ connCap - shuld be small
 userCap - shuld be big
 */
 const (
+	// defaults of buffers and delays, see [Config]
+
 	// number of packets that conn may not read before blocking
-	// (time for package to process)
+	// (time for package to process), also the number of datagrams
+	// that client may not read before they are dropped
 	connCap = 256
 	// number of packets that client may not read before blocking
 	// (time for client to process)
 	userCap = 4096
 
-	rShortTime = 300 * time.Millisecond
-	rLongTime  = 3 * time.Second
+	// received packets are acknowledged after short time without new packets,
+	// but not later than long time after the first of them,
+	// so the sender can take the delay into account in its timeouts (see [rttStats.setPeerAckDelays])
+	rShortTime = 20 * time.Millisecond
+	rLongTime  = 60 * time.Millisecond
+
+	// how far behind the cumulative point packets are acknowledged by received packets,
+	// it must be less than half of the number space, so that ranges are comparable
+	receivedHistory = packetNumberSpace / 4
+
+	// how long the connection may receive nothing before the keepalive probe is sent
+	// (same as in [net.Dialer])
+	defaultKeepAlivePeriod = 15 * time.Second
+	// how long the connection may receive nothing before it is closed,
+	// with enabled keepalive the peer that doesn't answer probes is detected earlier
+	// (when probes are not acknowledged after all resends), the error is the same
+	defaultIdleTimeout = 30 * time.Second
+
+	// how long small writes wait for more data to fill the packet (see [Conn.SetNoDelay])
+	coalesceDelay = 5 * time.Millisecond
+
+	// how many retransmission timeouts the connection answers retransmitted fin after it was acknowledged
+	// (enough for the first two retransmissions if fin ack is lost)
+	timeWaitRTOs = 4
 )
 
 var (
-	ErrPacketCorrupted = errors.New("packet corrupted while writing")
-	errCloseFuncCalled = fmt.Errorf("%w: close function called", net.ErrClosed)
-	errRemotelyClosed  = fmt.Errorf("%w: remotely closed", net.ErrClosed)
-	errNoResponse      = fmt.Errorf("%w: no response", net.ErrClosed)
+	ErrPacketCorrupted   = errors.New("packet corrupted while writing")
+	errCloseFuncCalled   = fmt.Errorf("%w: close function called", net.ErrClosed)
+	errRemotelyClosed    = fmt.Errorf("%w: remotely closed", net.ErrClosed)
+	errNoResponse        = fmt.Errorf("%w: no response", net.ErrClosed)
+	ErrIdleTimeout       = fmt.Errorf("%w: idle timeout", net.ErrClosed)
+	ErrNotMessageMode    = errors.New("connection is not in message mode")
+	ErrMessageExpired    = errors.New("message lifetime is over before it was sent")
+	ErrUnorderedMessages = errors.New("messages can't be delivered unordered")
+
+	ErrDatagramTooLarge = errors.New("datagram doesn't fit into packet")
+	ErrDatagramDropped  = errors.New("datagram dropped: congestion window is full")
 )
 
+// ApplicationError is the reason of the abortive close by [Conn.CloseWithError],
+// Read and Write of both sides return it, so it can be inspected with [errors.As].
+// It wraps [net.ErrClosed] like other errors of closed connections.
+type ApplicationError struct {
+	Code   uint64
+	Reason string
+	Remote bool // the connection is closed by the peer
+}
+
+func (e *ApplicationError) Error() string {
+	side := "locally"
+	if e.Remote {
+		side = "remotely"
+	}
+	return fmt.Sprintf("%s: %s reset with application error %d: %s", net.ErrClosed, side, e.Code, e.Reason)
+}
+
+func (e *ApplicationError) Unwrap() error {
+	return net.ErrClosed
+}
+
+// closeErr holds errors of one type, so the application error is wrapped
+func applicationCloseErr(e *ApplicationError) error {
+	return fmt.Errorf("%w", e)
+}
+
+// Conn is a connection returned by [Dial] and by Accept of the [Listen] listener,
+// it can be obtained with type assertion on the returned [net.Conn]
+type Conn interface {
+	net.Conn
+
+	// SetKeepAlive enables or disables keepalive probes,
+	// which are sent when the connection receives nothing for the keepalive period,
+	// if the peer doesn't answer them, the connection is closed with [ErrIdleTimeout]
+	SetKeepAlive(keepalive bool) error
+	// SetKeepAlivePeriod sets the keepalive period,
+	// non-positive d resets it to the default value
+	SetKeepAlivePeriod(d time.Duration) error
+	// SetIdleTimeout sets how long the connection may receive nothing
+	// before it is closed with [ErrIdleTimeout], non-positive d disables the timeout
+	SetIdleTimeout(d time.Duration) error
+	// CloseWithError closes the connection at once without delivering the data that is not
+	// acknowledged yet, the peer is notified with the reset, which carries the application error code
+	// and the reason (truncated to 256 bytes). After it Read and Write of both sides
+	// return [*ApplicationError].
+	CloseWithError(code uint64, reason string) error
+	// SetLinger sets the behavior of Close on a connection
+	// which still has data waiting to be sent or to be acknowledged (like [net.TCPConn.SetLinger]).
+	//
+	// If sec < 0 (the default), Close returns immediately
+	// and the data is delivered in the background.
+	//
+	// If sec == 0, the data is discarded and the peer is notified at once.
+	//
+	// If sec > 0, Close blocks until the data is delivered or sec seconds pass,
+	// after that the rest of data is discarded.
+	SetLinger(sec int) error
+	// SetCongestionController replaces the congestion controller of the connection,
+	// nil resets it to the default one ([NewCubic]).
+	// The controller must not be shared between connections.
+	SetCongestionController(cc CongestionController) error
+	// SetNoDelay controls whether small writes are delayed to be sent in fewer packets.
+	// The default is false, so writes smaller than a packet wait for more data for a short time,
+	// latency-sensitive users may disable it or call Flush after the last write.
+	SetNoDelay(noDelay bool) error
+	// Flush sends data of previous writes which waits for more data
+	Flush() error
+	// SetMaxPacingRate limits the rate in bytes per second at which packets are sent,
+	// by default it is set by the congestion controller, non-positive rate removes the limit
+	SetMaxPacingRate(rate int) error
+	// SetUnordered controls whether received data is passed to the reader in the order it was written.
+	// With unordered delivery every packet is passed as soon as it arrives and every Read returns
+	// data of a single packet, so data is still read entirely and only once, but in any order.
+	// Writes that don't fit into one packet are read in parts, so the peer should write chunks
+	// that carry their own offsets and disable coalescing (see SetNoDelay).
+	// It returns [ErrUnorderedMessages] in message mode.
+	SetUnordered(unordered bool) error
+	// SetFEC enables forward error correction for lossy links: after every blockSize packets
+	// a repair packet is sent, so the peer rebuilds one lost packet of the block without
+	// waiting for its retransmission. The overhead is one packet per block,
+	// blockSize must be a power of two from 2 to 64, zero disables it (default).
+	SetFEC(blockSize int) error
+
+	// SendDatagram sends b in a single packet which is not resent and not ordered
+	// with the rest of data, it is paced and sent only if the congestion window has room,
+	// otherwise [ErrDatagramDropped] is returned
+	SendDatagram(b []byte) error
+	// ReceiveDatagram reads the next datagram into b, it blocks until the read deadline,
+	// if b is too small, the rest of datagram is discarded and [io.ErrShortBuffer] is returned
+	ReceiveDatagram(b []byte) (int, error)
+
+	// OpenStream opens a new [Stream] of the connection, the peer accepts it with AcceptStream
+	OpenStream() (Stream, error)
+	// AcceptStream blocks until the peer opens a stream or the connection is closed
+	AcceptStream() (Stream, error)
+}
+
+// MessageConn is a connection in message mode returned by [DialMessages]
+// and by Accept of the [ListenMessages] listener, every message written by the peer
+// is read entirely by a single read. Read and Write work like ReadMessage and WriteMessage,
+// writes are never coalesced.
+type MessageConn interface {
+	Conn
+
+	// ReadMessage reads the next message into b,
+	// if b is too small, the rest of the message is discarded and [io.ErrShortBuffer] is returned
+	ReadMessage(b []byte) (int, error)
+	// WriteMessage writes b as a single message, it may be larger than a packet
+	WriteMessage(b []byte) (int, error)
+	// WriteMessageWithLifetime works like WriteMessage, but the message is abandoned
+	// if it is not delivered within lifetime, so the peer skips it and reads the next ones.
+	// If the lifetime is over before the whole message is sent, [ErrMessageExpired] is returned.
+	// Non-positive lifetime means that the message is delivered reliably.
+	WriteMessageWithLifetime(b []byte, lifetime time.Duration) (int, error)
+}
+
 // Errors:
 // An error in reading and writing may occur for two reasons related to the connection:
 // 1. It is closed (both directions must be notified at once)
@@ -68,14 +221,52 @@ type conn struct {
 		close func() error
 	}
 
+	opts      options      // buffers and delays (see [Config])
+	messages  bool         // message mode, it is set before the connection is used (see [MessageConn])
+	unordered atomic.Bool  // see [Conn.SetUnordered]
+	addrs     addrs        // addresses of streams, it is set before the connection is used
+	opener    packetOpener // opens protected packets (see psk.go and tls.go), nil if packets are not protected
+	// messages of the TLS handshake (see tls.go), nil if it is not done,
+	// it is set before the connection is used like the state after the handshake
+	crypto   chan cryptoData
+	tlsState tls.ConnectionState
+
+	// streams (see stream.go), unordered packets of them are passed by the reading goroutine
+	streamsMu        sync.Mutex
+	streams          map[uint32]*stream
+	nextStreamID     uint32 // the next identifier of streams opened by us
+	nextPeerStreamID uint32 // the next identifier of streams opened by the peer
+	accept           chan *stream
+
 	internalErr atomic.Bool
-	closeErr    atomic.Value // should be specified before closing other components
+	closeErr    atomic.Value  // should be specified before closing other components
+	closing     chan struct{} // closed when closeErr is set, so blocked writes return
+	closingOnce sync.Once
+
+	// close
+	linger       atomic.Int64 // in seconds, see [Conn.SetLinger]
+	finSent      atomic.Bool
+	finReceived  atomic.Bool
+	teardownOnce sync.Once
 
 	// write
+	writeDeadline *deadline
+	noDelay       atomic.Bool
+	coalesceMu    sync.Mutex  // held while sending, so writes are sent in order
+	coalesced     []byte      // small writes that wait for more data
+	coalesce      *time.Timer // sends coalesced writes when the delay passes
+	flight        *flight
+	pacer         *pacer     // writer of groups
+	fec           *fecWriter // writer of the pacer, see [Conn.SetFEC]
+	pmtud         *pmtud
 	stopGroups    chan struct{}
 	sendedMu      *sync.RWMutex
 	sendedVersion uint32 // in case we receive a packet with an old version becous of missorder
 	sended        *[]rng[uint32]
+	// the cumulative point of the peer and packets that are not resent (see [conn.abandonPackets]),
+	// both are protected by sendedMu
+	peerCumulative uint32
+	abandoned      []rng[uint32]
 	// comunication with other groups should be through
 	// stop channel and pointer to sended packets
 	lastGroupMu sync.Mutex
@@ -83,69 +274,378 @@ type conn struct {
 
 	// read
 	toRead     *bufQueue
+	datagrams  *bufQueue // received datagrams, they bypass the order of packets
 	short      *time.Timer
 	long       *time.Timer
 	receivedMu sync.RWMutex
 	nextRecivP uint32
-	received   []rng[uint32]
+	cumulative uint32        // all packets before it are received
+	received   []rng[uint32] // packets after cumulative, bounded by the limit
+	readPoint  atomic.Uint32 // the next packet number that will be passed to the reader
+	advertised atomic.Uint32 // the limit sent in the last received packets
+	newestAt   time.Time     // when the newest received packet was received
 	unreaded   incompleteOrder
+	repairs    fecDecoder // rebuilds lost packets of the peer
+
+	// liveness, timers are reset on every received packet
+	aliveMu         sync.Mutex
+	idle            *time.Timer
+	idleTimeout     time.Duration // zero if disabled
+	keepAlive       *time.Timer
+	keepAliveOn     bool
+	keepAlivePeriod time.Duration
+	probing         bool // the probe is sent and nothing is received since
 }
 
 // - if the problem is with the external connection,
 // then inerr should be specified the connection error value, and the channel should be closed
 // - if the connection is closed for an internal reason,
-// then nil should be sent through the channel, and rerr is not expected to be specified
-func newConn(in <-chan reusable[[]byte], inerr *error, out io.Writer, onClose func() error) *conn {
+// then nil should be sent through the channel or it should be closed after onClose call,
+// and rerr is not expected to be specified
+func newConn(opts options, in <-chan reusable[[]byte], inerr *error, out io.Writer, onClose func() error) *conn {
 	if onClose == nil {
 		onClose = func() error { return nil }
 	}
 	c := &conn{
-		toRead: newBufQueue(userCap),
+		opts:      opts,
+		messages:  opts.messages,
+		toRead:    newBufQueue(opts.readBuffer),
+		datagrams: newBufQueue(opts.connBuffer),
 		out: struct {
 			r     <-chan reusable[[]byte]
 			rerr  *error
 			w     io.Writer
 			close func() error
 		}{in, inerr, out, onClose},
-		stopGroups: make(chan struct{}),
-		sendedMu:   &sync.RWMutex{},
-		sended:     new([]rng[uint32]),
+		closing:       make(chan struct{}),
+		writeDeadline: newDeadline(),
+		flight:        newFlight(),
+		stopGroups:    make(chan struct{}), // closed on teardown
+		sendedMu:      &sync.RWMutex{},
+		sendedVersion: maxPacketNumber, // so that the first version (0) is newer
+		sended:        new([]rng[uint32]),
+
+		streams:          make(map[uint32]*stream),
+		nextPeerStreamID: 1, // the listener side sets its identifiers (see [listener.lockedNewConn])
+		accept:           make(chan *stream, streamBacklog),
+
+		idleTimeout:     defaultIdleTimeout,
+		keepAliveOn:     true,
+		keepAlivePeriod: defaultKeepAlivePeriod,
 	}
+	c.fec = newFECWriter(out, c.flight.repairSize)
+	c.pacer = newPacer(c.fec, c.flight.pacingRate, c.stopGroups)
+	c.pmtud = newPMTUD(c.sendProbe, c.flight.rtt.rto, c.flight.setPacketSize)
+	c.coalesce = time.AfterFunc(time.Hour, c.coalesceTFunc)
+	c.coalesce.Stop()
 	c.short = time.AfterFunc(time.Hour, c.shortTFunc)
 	c.short.Stop()
 	c.long = time.AfterFunc(time.Hour, c.longTFunc)
 	c.long.Stop()
+	c.idle = time.AfterFunc(c.idleTimeout, c.idleTFunc)
+	c.keepAlive = time.AfterFunc(c.keepAlivePeriod, c.keepAliveTFunc)
+	c.linger.Store(-1)
+	c.advertised.Store(uint32(opts.readBuffer) - 1) // the peer knows it from the handshake
+	c.unreaded.onCommand = c.handleOrderedCommand
 	go func() {
 		err := c.run()
 		if err != nil {
-			if !c.internalErr.Load() {
-				c.toRead.close(err)
-			}
-
 			c.close(fmt.Errorf("running the connection: %w", err), false)
-		} else {
+		}
+		if !c.finReceived.Load() { // otherwise it is already closed in order
 			c.toRead.close(c.closeErr.Load().(error))
 		}
+		c.datagrams.close(c.closeErr.Load().(error))
+		c.closeStreams(c.closeErr.Load().(error))
 	}()
 	return c
 }
 
+// Read returns all received data before reporting that the connection is closed,
+// after orderly close by the peer it returns [io.EOF]
 func (c *conn) Read(b []byte) (int, error) {
+	if c.messages {
+		return c.ReadMessage(b)
+	}
+	if c.internalErr.Load() { // closed locally, so nobody is waiting for the rest of data
+		return 0, c.closeErr.Load().(error)
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if c.unordered.Load() {
+		n, err = c.toRead.readPacket(b)
+	} else {
+		n, err = c.toRead.read(b)
+	}
+	if n != 0 {
+		c.updateWindow()
+	}
+	return n, err
+}
+
+func (c *conn) ReadMessage(b []byte) (int, error) {
+	if !c.messages {
+		return 0, ErrNotMessageMode
+	}
+	if c.internalErr.Load() {
+		return 0, c.closeErr.Load().(error)
+	}
+
+	n, err := c.toRead.readMessage(b)
+	c.updateWindow()
+	return n, err
+}
+
+// Write blocks while the congestion window is full
+// or the peer is not ready to receive more data,
+// the tail that doesn't fill the packet may be sent later (see [Conn.SetNoDelay])
+func (c *conn) Write(b []byte) (n int, err error) {
+	if c.messages {
+		return c.WriteMessage(b)
+	}
 	if clErr := c.closeErr.Load(); clErr != nil {
 		return 0, clErr.(error)
 	}
 
-	return c.toRead.read(b)
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	if c.noDelay.Load() {
+		return c.send(b, c.writeDeadline, writePart{})
+	}
+	return c.coalesceWrite(b)
 }
 
-func (c *conn) Write(b []byte) (int, error) {
+// WriteMessage blocks like Write, if the message is written partially,
+// the peer never reads it
+func (c *conn) WriteMessage(b []byte) (int, error) {
+	return c.WriteMessageWithLifetime(b, 0)
+}
+
+// the lifetime starts when the message is written, so it includes waiting for the window
+func (c *conn) WriteMessageWithLifetime(b []byte, lifetime time.Duration) (int, error) {
+	if !c.messages {
+		return 0, ErrNotMessageMode
+	}
 	if clErr := c.closeErr.Load(); clErr != nil {
 		return 0, clErr.(error)
 	}
 
-	ok, n, err := c.group().appendAndSend(b)
+	var expires time.Time
+	if lifetime > 0 {
+		expires = time.Now().Add(lifetime)
+	}
+
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	return c.send(b, c.writeDeadline, writePart{expires: expires})
+}
+
+// SendDatagram doesn't wait for the window, because the datagram is sent only once,
+// it may be outdated after waiting
+func (c *conn) SendDatagram(b []byte) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+	if len(b) > c.flight.packetSize()-headerSize-1 {
+		return ErrDatagramTooLarge
+	}
+
+	p := datagramPacket(b)
+	if !c.flight.hasRoom(p.len()) {
+		return ErrDatagramDropped
+	}
+	data := getBuf(p.len())
+	defer data.free()
+	packetSize, err := p.encode(data.data)
+	if err != nil { // should never happen
+		panic(err)
+	}
+
+	written, err := c.pacer.Write(data.data[:packetSize])
+	if err != nil {
+		return fmt.Errorf("failed to write to main connection: %w", err)
+	}
+	if written != packetSize {
+		return ErrPacketCorrupted
+	}
+	return nil
+}
+
+func (c *conn) ReceiveDatagram(b []byte) (int, error) {
+	if c.internalErr.Load() {
+		return 0, c.closeErr.Load().(error)
+	}
+
+	return c.datagrams.readOne(b)
+}
+
+// coalesceWrite sends only full packets,
+// the rest waits for the next writes or for the timer
+func (c *conn) coalesceWrite(b []byte) (n int, err error) {
+	if c.writeDeadline.isExceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	dataSize := c.flight.packetSize() - headerSize
+	if len(c.coalesced)+len(b) < dataSize {
+		if len(c.coalesced) == 0 {
+			c.coalesce.Reset(coalesceDelay)
+		}
+		c.coalesced = append(c.coalesced, b...)
+		return len(b), nil
+	}
+
+	if len(c.coalesced) != 0 { // complete the waiting packet first
+		fill := dataSize - len(c.coalesced)
+		c.coalesced = append(c.coalesced, b[:fill]...)
+		written, err := c.send(c.coalesced, c.writeDeadline, writePart{})
+		c.coalesced = c.coalesced[:0]
+		c.coalesce.Stop()
+		if err != nil {
+			return max(written-(dataSize-fill), 0), err
+		}
+		n, b = fill, b[fill:]
+	}
+
+	full := len(b) / dataSize * dataSize
+	if full != 0 {
+		written, err := c.send(b[:full], c.writeDeadline, writePart{})
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	if len(b) != full {
+		c.coalesced = append(c.coalesced, b[full:]...)
+		c.coalesce.Reset(coalesceDelay)
+	}
+	return n + len(b) - full, nil
+}
+
+func (c *conn) coalesceTFunc() {
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	if c.isTornDown() {
+		return
+	}
+
+	c.lockedFlush(false)
+}
+
+// the data is already accepted by Write, so the deadline is checked only if withDeadline
+func (c *conn) lockedFlush(withDeadline bool) error {
+	if len(c.coalesced) == 0 {
+		return nil
+	}
+
+	var d *deadline
+	if withDeadline {
+		d = c.writeDeadline
+	}
+	_, err := c.send(c.coalesced, d, writePart{})
+	c.coalesced = c.coalesced[:0]
+	c.coalesce.Stop()
+	return err
+}
+
+// send waits for the room in the window for every part of b until the deadline d (nil means none),
+// in message mode b is the whole message, data of the stream also waits for the room in its window
+func (c *conn) send(b []byte, d *deadline, part writePart) (n int, err error) {
+	var expired <-chan time.Time
+	if !part.expires.IsZero() {
+		t := time.NewTimer(time.Until(part.expires))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	for {
+		if d != nil && d.isExceeded() {
+			return n, os.ErrDeadlineExceeded
+		}
+		if !part.expires.IsZero() && !time.Now().Before(part.expires) {
+			return n, ErrMessageExpired
+		}
+
+		room, flowLimited, changed := c.flight.available(c.peekNextPacketNum())
+		packetSize := c.flight.packetSize()
+		var streamChanged <-chan struct{}
+		switch {
+		case part.stream != nil: // stream headers take place of data
+			packetSize -= streamHeaderSize
+			var streamRoom int
+			streamRoom, streamChanged = part.stream.available(packetSize)
+			if streamRoom < room { // window updates of streams are resent, so the probe is not needed
+				room, flowLimited = streamRoom, false
+			}
+		case c.messages: // fragment flags take place of data
+			packetSize -= fragmentHeaderSize
+		}
+		size := fitWindow(room, len(b), packetSize)
+		if size == 0 && len(b) != 0 {
+			var probe <-chan time.Time
+			if flowLimited { // the update of the limit may be lost
+				probe = time.After(c.flight.rtt.rto())
+			}
+			select {
+			case <-changed:
+			case <-streamChanged:
+			case <-probe:
+				err := c.sendCommand(pingPacket)
+				if err != nil {
+					return n, err
+				}
+			case <-deadlineWait(d):
+			case <-expired:
+			case <-c.closing: // Close waits for coalesceMu held by the blocked write
+				return n, c.closeErr.Load().(error)
+			}
+			continue
+		}
+
+		part.first, part.last = n == 0, size == len(b)
+		written, err := c.write(b[:size], part)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[size:]
+		if len(b) == 0 {
+			return n, nil
+		}
+	}
+}
+
+func deadlineWait(d *deadline) <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.wait()
+}
+
+// writePart describes the part of data that is written at once
+type writePart struct {
+	first, last bool      // the part starts or ends the message in message mode
+	expires     time.Time // zero if the message never expires
+	stream      *stream   // nil for data of the connection
+}
+
+func (c *conn) write(b []byte, part writePart) (int, error) {
+	appendAndSend := func(g *group) (bool, int, error) {
+		switch {
+		case part.stream != nil:
+			return g.appendAndSendStream(b, part.stream)
+		case c.messages:
+			return g.appendAndSendMessage(b, part)
+		}
+		return g.appendAndSend(b)
+	}
+
+	ok, n, err := appendAndSend(c.group())
 	if !ok {
-		_, n, err = c.nextGroup().appendAndSend(b)
+		_, n, err = appendAndSend(c.nextGroup())
 	}
 	if err != nil {
 		c.close(fmt.Errorf("writing: %w", err), false)
@@ -153,72 +653,430 @@ func (c *conn) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Close sends fin after all written data,
+// how long it blocks depends on [Conn.SetLinger]
 func (c *conn) Close() error {
-	return c.close(errCloseFuncCalled, true)
+	if !c.setCloseErr(errCloseFuncCalled, true) {
+		return nil
+	}
+
+	linger := c.linger.Load()
+	if linger == 0 {
+		return c.close(errCloseFuncCalled, true)
+	}
+
+	c.toRead.stop(errCloseFuncCalled)
+	c.datagrams.stop(errCloseFuncCalled)
+	c.coalesceMu.Lock()
+	err := c.lockedSendCoalesced()
+	c.coalesceMu.Unlock()
+	if err != nil {
+		return errors.Join(err, c.close(errCloseFuncCalled, true))
+	}
+	c.finSent.Store(true)
+	err = c.sendCommand(finPacket)
+	if err != nil {
+		return errors.Join(err, c.close(errCloseFuncCalled, true))
+	}
+	if linger < 0 {
+		return nil
+	}
+
+	select {
+	case <-c.stopGroups: // fin is acknowledged or peer didn't respond
+		return nil
+	case <-time.After(time.Duration(linger) * time.Second):
+		return c.close(errCloseFuncCalled, true)
+	}
+}
+
+func (c *conn) CloseWithError(code uint64, reason string) error {
+	if len(reason) > maxResetReasonSize {
+		reason = strings.ToValidUTF8(reason[:maxResetReasonSize], "")
+	}
+	if c.isTornDown() {
+		return nil
+	}
+	why := applicationCloseErr(&ApplicationError{Code: code, Reason: reason})
+	c.setCloseErr(why, true) // it aborts lingering Close
+	c.toRead.stop(why)
+	c.datagrams.stop(why)
+
+	sendErr := c.sendPacketOutOfGroup(resetPacket(c.nextPacketNum(), code, reason))
+	return errors.Join(c.closeLocaly(why, true), sendErr)
+}
+
+// lockedSendCoalesced sends coalesced writes before fin without waiting for the window,
+// like commands, because it is at most one packet
+func (c *conn) lockedSendCoalesced() error {
+	if len(c.coalesced) == 0 {
+		return nil
+	}
+
+	_, err := c.write(c.coalesced, writePart{})
+	c.coalesced = c.coalesced[:0]
+	c.coalesce.Stop()
+	return err
+}
+
+// SetDeadline sets the read and write deadlines,
+// after the deadline Read and Write return [os.ErrDeadlineExceeded].
+// A zero value for t means I/O operations will not time out.
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.toRead.setReadDeadline(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetKeepAlive(keepalive bool) error {
+	c.aliveMu.Lock()
+	defer c.aliveMu.Unlock()
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.keepAliveOn = keepalive
+	if keepalive {
+		c.keepAlive.Reset(c.keepAlivePeriod)
+	} else {
+		c.keepAlive.Stop()
+	}
+	return nil
+}
+
+func (c *conn) SetKeepAlivePeriod(d time.Duration) error {
+	c.aliveMu.Lock()
+	defer c.aliveMu.Unlock()
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	if d <= 0 {
+		d = defaultKeepAlivePeriod
+	}
+	c.keepAlivePeriod = d
+	if c.keepAliveOn {
+		c.keepAlive.Reset(d)
+	}
+	return nil
+}
+
+func (c *conn) SetLinger(sec int) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.linger.Store(int64(sec))
+	return nil
+}
+
+func (c *conn) SetCongestionController(cc CongestionController) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	if cc == nil {
+		cc = defaultCongestionController()
+	}
+	c.flight.setController(cc)
+	return nil
+}
+
+func (c *conn) SetNoDelay(noDelay bool) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	c.noDelay.Store(noDelay)
+	if noDelay {
+		return c.lockedFlush(false)
+	}
+	return nil
+}
+
+func (c *conn) Flush() error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+	return c.lockedFlush(true)
+}
+
+func (c *conn) SetUnordered(unordered bool) error {
+	if c.messages {
+		return ErrUnorderedMessages
+	}
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.unordered.Store(unordered)
+	return nil
+}
+
+func (c *conn) SetMaxPacingRate(rate int) error {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.flight.setMaxPacingRate(rate)
+	return nil
+}
+
+func (c *conn) SetIdleTimeout(d time.Duration) error {
+	c.aliveMu.Lock()
+	defer c.aliveMu.Unlock()
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	c.idleTimeout = max(d, 0)
+	if c.idleTimeout > 0 {
+		c.idle.Reset(c.idleTimeout)
+	} else {
+		c.idle.Stop()
+	}
+	return nil
 }
 
 // reading
 
 func (c *conn) run() error {
 	for {
-		data, internalErr := <-c.out.r
-		if !internalErr { // external connection error
+		var (
+			data        reusable[[]byte]
+			internalErr bool
+		)
+		select {
+		case data, internalErr = <-c.out.r:
+		case <-c.stopGroups: // torn down, out.close may not close the channel
+			return nil
+		}
+		if !internalErr {
+			if c.isTornDown() { // channel is closed by out.close
+				return nil
+			}
+			// external connection error
 			return fmt.Errorf("failed to read from main connection: %w", *c.out.rerr)
 		}
 		if data.data == nil { // internal connection closed
 			return nil
 		}
+		if c.opener != nil {
+			opened, err := c.opener.open(data.data)
+			if err != nil { // forged or replayed packets don't affect the connection
+				data.free()
+				continue
+			}
+			data.data = opened
+		}
 
 		pv, err := decodePacket(data.data)
 		if err != nil {
 			data.free()
 			return fmt.Errorf("invalid packet: %w", err)
 		}
+		if pv.version != protocolVersion { // packets of other versions would be parsed wrong
+			data.free()
+			continue
+		}
 		p := reusable[packet]{
 			data: pv,
 			free: data.free,
 		}
+		c.resetAliveTimers()
+		if err := c.receivePacket(p, false); err != nil {
+			return err
+		}
+	}
+}
 
-		var (
-			command command = -1
-			payload []byte
-		)
-		if p.data.isCommand {
-			command, payload, err = commandPacketType(p.data)
-			if err != nil {
-				p.free()
-				return err
-			}
+// receivePacket handles the received packet or the one rebuilt from repair packets,
+// the rebuilt packet is not added to its block, because the block is already complete
+func (c *conn) receivePacket(p reusable[packet], fromRepair bool) error {
+	var (
+		command command = -1
+		payload []byte
+		err     error
+	)
+	if p.data.isCommand {
+		command, payload, err = commandPacketType(p.data)
+		if err != nil {
+			p.free()
+			return err
 		}
-		cmdReceivedPackets := command == commandReceivedPackets
+		if command.isHandshake() { // connection is already established
+			p.free()
+			return nil
+		}
+	}
+	unnumbered := command.isUnnumbered()
 
-		if !cmdReceivedPackets {
-			if !c.addToReceived(p.data.number) {
-				p.free()
-				err := c.sendReceivedPackets()
-				if err != nil {
-					return fmt.Errorf("failed to send received packets: %w", err)
-				}
-				continue
-			}
+	switch command {
+	case commandDatagram: // the reader takes it out of order
+		c.receiveDatagram(reusable[[]byte]{data: payload, free: p.free})
+		return nil
+	case commandRepair:
+		r, err := decodeRepair(payload)
+		if err != nil {
+			p.free()
+			return fmt.Errorf("invalid packet: %w", err)
+		}
+		if c.receivedBefore(addPacketNumber(p.data.number, r.count)) {
+			c.repairs.resize(r.count) // the block is complete, only its size is learned
+			p.free()
+			return nil
+		}
+		rebuilt, ok := c.repairs.repair(p.data.number, r)
+		p.free()
+		if ok {
+			return c.receivePacket(rebuilt, true)
+		}
+		return nil
+	}
+
+	if !unnumbered && packetNumberDiff(p.data.number, c.receiveLimit()) > c.limitSlack() {
+		p.free() // the peer ignores the limit
+		return nil
+	}
+
+	var (
+		s     *stream
+		frame streamFrame
+	)
+	isStream := command == commandStream || command == commandStreamFin
+	if isStream {
+		frame, err = decodeStreamFrame(payload)
+		if err != nil {
+			p.free()
+			return fmt.Errorf("invalid packet: %w", err)
 		}
+		var ok bool
+		s, ok = c.streamOf(frame, command == commandStream && len(frame.data) != 0)
+		if !ok { // it is not acknowledged, so the peer sends it again
+			p.free()
+			return nil
+		}
+	}
 
-		if p.data.isCommand {
-			err := c.handleCommand(p.data.number, command, payload)
+	var (
+		rebuilt   reusable[packet]
+		isRebuilt bool
+	)
+	if !unnumbered {
+		if !c.addToReceived(p.data.number) {
+			if command == commandFin && c.finReceived.Load() { // fin ack was lost
+				err = c.sendPacketOutOfGroup(finAckPacket(p.data.number))
+			}
+			p.free()
+			if err == nil {
+				err = c.sendReceivedPackets()
+			}
 			if err != nil {
-				p.free()
-				return fmt.Errorf("failed to handle command: %w", err)
+				return fmt.Errorf("failed to send received packets: %w", err)
 			}
+			return nil
 		}
+		if !fromRepair {
+			rebuilt, isRebuilt = c.repairs.received(p.data) // before the data is passed to the reader
+		}
+	}
 
-		if !cmdReceivedPackets {
-			for toRead := range c.unreaded.append(p) {
-				c.toRead.write(toRead)
-			}
-		} else {
+	if p.data.isCommand {
+		err := c.handleCommand(p.data.number, command, payload)
+		if err != nil {
 			p.free()
+			if isRebuilt {
+				rebuilt.free()
+			}
+			return fmt.Errorf("failed to handle command: %w", err)
+		}
+	}
+
+	switch {
+	case isStream:
+		c.receiveStream(s, command, frame, p)
+	case !p.data.isCommand && c.unordered.Load():
+		c.receiveUnordered(p)
+	case !unnumbered:
+		c.deliver(c.unreaded.append(p))
+	default:
+		p.free()
+	}
+	if isRebuilt {
+		return c.receivePacket(rebuilt, true)
+	}
+	return nil
+}
+
+// receiveUnordered passes the data packet to the reader at once,
+// but fin is still handled after all previous packets
+func (c *conn) receiveUnordered(p reusable[packet]) {
+	if c.closeErr.Load() != nil { // nobody will read it after close
+		p.free()
+	} else {
+		c.toRead.write(reusable[[]byte]{data: p.data.data, free: p.free})
+	}
+	c.deliver(c.unreaded.append(orderPlaceholder(p.data.number)))
+}
+
+// receiveStream passes the packet to its stream out of order of the connection
+func (c *conn) receiveStream(s *stream, command command, frame streamFrame, p reusable[packet]) {
+	c.deliver(c.unreaded.append(orderPlaceholder(p.data.number)))
+	if s == nil { // the stream is closed
+		p.free()
+		return
+	}
+
+	sp := packet{header: header{number: frame.seq}, data: frame.data}
+	if command == commandStreamFin || len(frame.data) == 0 { // handled by the stream in order
+		sp.isCommand, sp.data = true, p.data.data[:1]
+	}
+	s.receive(reusable[packet]{data: sp, free: p.free})
+}
+
+// orderPlaceholder takes place of the packet that is passed out of order,
+// it is the empty command, so it is not passed to the reader
+func orderPlaceholder(number uint32) reusable[packet] {
+	return reusable[packet]{
+		data: packet{header: header{number: number, isCommand: true}},
+		free: func() {},
+	}
+}
+
+// deliver passes packets that are completed in order to the reader
+func (c *conn) deliver(completed iter.Seq[reusable[[]byte]]) {
+	for toRead := range completed {
+		if c.closeErr.Load() != nil { // nobody will read it after close
+			toRead.free()
+			continue
 		}
+		c.toRead.write(toRead)
 	}
+	c.readPoint.Store(c.unreaded.nextToRead)
 }
 
 func (c *conn) handleCommand(number uint32, command command, payload []byte) error {
@@ -226,41 +1084,212 @@ func (c *conn) handleCommand(number uint32, command command, payload []byte) err
 	case commandCloseConn:
 		outErr := c.closeLocaly(errRemotelyClosed, false)
 		return outErr
+	case commandReset: // the data that is not read yet is discarded
+		code, reason, err := decodeReset(payload)
+		if err != nil {
+			return err
+		}
+		if c.setCloseErr(applicationCloseErr(&ApplicationError{Code: code, Reason: reason, Remote: true}), false) {
+			c.toRead.stop(c.closeErr.Load().(error))
+			c.datagrams.stop(c.closeErr.Load().(error))
+		}
+		return c.teardown()
 	case commandReceivedPackets:
-		sended, err := decodeReceivedPackets(payload)
+		rp, err := decodeReceivedPackets(payload)
 		if err != nil {
 			return err
 		}
-		c.markSendedPackets(number, sended)
+		c.markSendedPackets(number, rp)
+		return nil
+	case commandConfirmConn: // connection is already created by the listener
+		return nil
+	case commandPing: // it is enough to acknowledge it
+		return nil
+	case commandFin: // handled in order, see [conn.handleOrderedCommand]
+		return nil
+	case commandFinAck:
+		if c.finSent.Load() && !c.finReceived.Load() {
+			return c.teardown()
+		}
+		return nil // if both sides sent fin, connection will be closed after time wait
+	case commandProbe: // the probe is received, so the path carries packets of its size
+		return c.sendPacketOutOfGroup(probeAckPacket(headerSize + 1 + len(payload) + c.flight.overhead))
+	case commandProbeAck:
+		size, err := decodeProbeAck(payload)
+		if err != nil {
+			return err
+		}
+		c.pmtud.acked(size)
+		return nil
+	case commandForward:
+		return c.skipTo(number)
+	case commandStream, commandStreamFin: // passed to the stream in [conn.run]
+		return nil
+	case commandStreamWindow:
+		return c.setStreamLimit(payload)
+	case commandCrypto: // handled in order, see [conn.handleOrderedCommand]
 		return nil
 	default:
 		panic("unknown command") // should never happen
 	}
 }
 
-func (c *conn) markSendedPackets(version uint32, sended []rng[uint32]) {
-	c.sendedMu.Lock()
-	defer c.sendedMu.Unlock()
+// handles commands after all previous packets are received
+func (c *conn) handleOrderedCommand(p packet) {
+	command, payload, err := commandPacketType(p)
+	if err != nil {
+		return
+	}
+	if command == commandCrypto {
+		c.receiveCrypto(payload)
+		return
+	}
+	if command != commandFin {
+		return
+	}
+
+	c.setCloseErr(errRemotelyClosed, false)
+	c.finReceived.Store(true)
+	c.toRead.close(io.EOF) // all data before fin is already in the queue
+	c.closeStreams(io.EOF)
+	c.sendPacketOutOfGroup(finAckPacket(p.number))
+	time.AfterFunc(timeWaitRTOs*c.flight.rtt.rto(), func() { c.teardown() })
+}
+
+// datagrams are dropped if the reader doesn't take them in time
+func (c *conn) receiveDatagram(d reusable[[]byte]) {
+	if c.closeErr.Load() != nil || c.datagrams.free() == 0 {
+		d.free()
+		return
+	}
+	c.datagrams.write(d)
+}
 
-	if version > c.sendedVersion {
+func (c *conn) markSendedPackets(version uint32, rp receivedPackets) {
+	now := time.Now()
+	forward, point := false, uint32(0)
+	c.sendedMu.Lock()
+	newer := packetNumberDiff(version, c.sendedVersion) > 0
+	if newer {
 		c.sendedVersion = version
-		*c.sended = sended
+		// blocks that did not fit into the packet may be missing in newer versions,
+		// but the receiver never forgets received packets, so they are merged
+		ranges := rp.ranges()
+		*c.sended = rangesUnionFunc(rangesTrimFunc(*c.sended, ranges[0][0], packetNumberDiff), ranges, packetNumberDiff)
+		if packetNumberDiff(rp.cumulative, c.peerCumulative) > 0 {
+			c.peerCumulative = rp.cumulative
+			c.abandoned = rangesTrimFunc(c.abandoned, rp.cumulative, packetNumberDiff)
+		}
+		// the forward packet may be lost, so it is sent until the peer skips abandoned packets
+		point = c.lockedForwardPoint()
+		forward = point != c.peerCumulative
+	}
+	c.sendedMu.Unlock()
+
+	if newer {
+		c.flight.acked(rp.ranges(), rp.ackDelay, now)
+		c.flight.setLimit(rp.limit)
+	}
+	if forward {
+		c.sendPacketOutOfGroup(forwardPacket(point))
+	}
+}
+
+// abandonPackets is called by groups with packets of expired messages,
+// they are not resent, so the peer is told to stop waiting for them
+func (c *conn) abandonPackets(numbers []uint32) {
+	for _, number := range numbers {
+		c.flight.abandoned(number)
+	}
+
+	c.sendedMu.Lock()
+	for _, number := range numbers {
+		if packetNumberDiff(number, c.peerCumulative) >= 0 {
+			c.abandoned, _ = rangesTryAppendFunc(c.abandoned, number, packetNumberDiff)
+		}
+	}
+	point := c.lockedForwardPoint()
+	forward := point != c.peerCumulative
+	c.sendedMu.Unlock()
+
+	if forward {
+		c.sendPacketOutOfGroup(forwardPacket(point))
+	}
+}
+
+// lockedForwardPoint returns the packet number before which all packets
+// are either received by the peer or abandoned
+func (c *conn) lockedForwardPoint() uint32 {
+	point := c.peerCumulative
+	if len(c.abandoned) == 0 {
+		return point
+	}
+	for _, r := range rangesUnionFunc(*c.sended, c.abandoned, packetNumberDiff) {
+		if packetNumberDiff(r[0], point) > 0 {
+			break
+		}
+		if packetNumberDiff(r[1], point) >= 0 {
+			point = nextPacketNumber(r[1])
+		}
+	}
+	return point
+}
+
+// skipTo stops waiting for packets before to, because the sender abandoned them,
+// it is ignored if the connection is not in message mode
+func (c *conn) skipTo(to uint32) error {
+	if !c.messages || packetNumberDiff(to, c.receiveLimit()) > c.limitSlack()+1 {
+		return nil
+	}
+
+	c.receivedMu.Lock()
+	if packetNumberDiff(to, c.cumulative) <= 0 {
+		c.receivedMu.Unlock()
+		return nil
+	}
+	c.cumulative = to
+	c.received = rangesTrimFunc(c.received, to, packetNumberDiff)
+	if len(c.received) != 0 && c.received[0][0] == c.cumulative {
+		c.cumulative = nextPacketNumber(c.received[0][1])
+		c.received = slices.Delete(c.received, 0, 1)
 	}
+	c.receivedMu.Unlock()
+
+	c.deliver(c.unreaded.skip(to))
+	return c.sendReceivedPackets()
 }
 
 func (c *conn) addToReceived(number uint32) (added bool) {
 	c.receivedMu.Lock()
-	c.received, added = rangesTryAppend(c.received, number)
+	if packetNumberDiff(number, c.cumulative) >= 0 {
+		c.received, added = rangesTryAppendFunc(c.received, number, packetNumberDiff)
+	}
+	if added {
+		if c.received[len(c.received)-1][1] == number {
+			c.newestAt = time.Now()
+		}
+		if c.received[0][0] == c.cumulative { // the gap is filled
+			c.cumulative = nextPacketNumber(c.received[0][1])
+			c.received = slices.Delete(c.received, 0, 1)
+		}
+	}
 	c.receivedMu.Unlock()
 
 	if added {
-		if !c.short.Reset(rShortTime) { // one of previous timers was excided, so start new cicle
-			c.long.Reset(rLongTime)
+		if !c.short.Reset(c.opts.ackDelay) { // one of previous timers was excided, so start new cicle
+			c.long.Reset(c.opts.maxAckDelay)
 		}
 	}
 	return added
 }
 
+// receivedBefore reports whether all packets before the number are received
+func (c *conn) receivedBefore(number uint32) bool {
+	c.receivedMu.RLock()
+	defer c.receivedMu.RUnlock()
+	return packetNumberDiff(number, c.cumulative) <= 0
+}
+
 func (c *conn) shortTFunc() {
 	if !c.long.Stop() {
 		return
@@ -277,11 +1306,62 @@ func (c *conn) longTFunc() {
 	c.sendReceivedPackets()
 }
 
+// liveness
+
+func (c *conn) resetAliveTimers() {
+	c.aliveMu.Lock()
+	defer c.aliveMu.Unlock()
+	if c.closeErr.Load() != nil {
+		return
+	}
+
+	if c.idleTimeout > 0 {
+		c.idle.Reset(c.idleTimeout)
+	}
+	if c.keepAliveOn {
+		c.keepAlive.Reset(c.keepAlivePeriod)
+	}
+	c.probing = false
+}
+
+func (c *conn) stopAliveTimers() {
+	c.aliveMu.Lock()
+	c.idle.Stop()
+	c.keepAlive.Stop()
+	c.aliveMu.Unlock()
+}
+
+// the peer is considered dead, so the connection is closed without notifying it
+func (c *conn) idleTFunc() {
+	if c.closeErr.Load() != nil {
+		return
+	}
+
+	c.closeLocaly(ErrIdleTimeout, false)
+}
+
+// probe is sent reliably, so if the peer doesn't acknowledge it,
+// the connection will be closed by the group with [ErrIdleTimeout]
+func (c *conn) keepAliveTFunc() {
+	c.aliveMu.Lock()
+	if !c.keepAliveOn || c.closeErr.Load() != nil {
+		c.aliveMu.Unlock()
+		return
+	}
+	c.keepAlive.Reset(c.keepAlivePeriod) // probe again if the peer stays silent
+	c.probing = true
+	c.aliveMu.Unlock()
+
+	c.sendCommand(pingPacket)
+}
+
 // close
 
+// abortive close, the peer is notified with a single close packet
+// which is handled immediately, so it doesn't wait for the rest of data
 func (c *conn) close(why error, internal bool) error {
 	var sendCloseErr error
-	if c.closeErr.Load() == nil {
+	if !c.isTornDown() {
 		sendCloseErr = c.sendCloseCommand()
 	}
 	closeLocalErr := c.closeLocaly(why, internal)
@@ -289,34 +1369,148 @@ func (c *conn) close(why error, internal bool) error {
 }
 
 func (c *conn) closeLocaly(why error, internal bool) (outErr error) {
+	c.setCloseErr(why, internal)
+	return c.teardown()
+}
+
+// error from internal event (close call) overwrites error from external event
+func (c *conn) setCloseErr(why error, internal bool) (first bool) {
 	prevErr := c.closeErr.Load()
 	if internal {
-		c.internalErr.Store(true)
 		c.closeErr.Store(why)
-	} else if !c.internalErr.Load() {
+		c.internalErr.Store(true) // closeErr must be set before
+	} else if prevErr == nil {
 		c.closeErr.Store(why)
 	}
-	if prevErr == nil { // first call
+	c.closingOnce.Do(func() { close(c.closing) })
+	return prevErr == nil
+}
+
+// stops all components of the connection,
+// only first call returns the error of closing the main connection
+func (c *conn) teardown() (outErr error) {
+	c.teardownOnce.Do(func() {
+		c.stopAliveTimers()
+		c.coalesce.Stop()
 		close(c.stopGroups)
-		return c.out.close()
-	}
-	return nil
+		c.flight.stop()
+		c.pmtud.stop()
+		outErr = c.out.close()
+	})
+	return outErr
 }
 
+func (c *conn) isTornDown() bool {
+	return isClosed(c.stopGroups)
+}
+
+// the peer that doesn't answer the probe is idle,
+// even if other packets are not acknowledged too
 func (c *conn) closeOnNoResponse() {
-	c.close(errNoResponse, false)
+	c.aliveMu.Lock()
+	why := errNoResponse
+	if c.probing {
+		why = ErrIdleTimeout
+	}
+	c.aliveMu.Unlock()
+	c.close(why, false)
 }
 
 // commands
 
 func (c *conn) sendReceivedPackets() error {
+	limit := c.receiveLimit()
 	c.receivedMu.Lock()
-	p := receivedPacketsPacket(c.nextRecivP, c.received)
-	c.nextRecivP++
+	p := receivedPacketsPacket(c.nextRecivP, receivedPackets{
+		cumulative: c.cumulative,
+		blocks:     ackBlocks(c.received),
+		ackDelay:   time.Since(c.newestAt),
+		limit:      limit,
+	})
+	c.nextRecivP = nextPacketNumber(c.nextRecivP)
 	c.receivedMu.Unlock()
+	c.advertised.Store(limit)
 	return c.sendPacketOutOfGroup(p)
 }
 
+// ackBlocks chooses blocks that fit into received packets:
+// the first ones, because the sender is going to resend packets in their gaps,
+// and the last one, so the sender knows the newest received packet
+func ackBlocks(received []rng[uint32]) []rng[uint32] {
+	if len(received) <= maxAckBlocks {
+		return received
+	}
+	return append(slices.Clip(received[:maxAckBlocks-1]), received[len(received)-1])
+}
+
+// flow control
+
+// receiveLimit returns the last packet number that the connection is ready to receive,
+// packets up to it fit into the free space of the read queue after all previous are read
+func (c *conn) receiveLimit() uint32 {
+	return addPacketNumber(c.readPoint.Load(), c.toRead.free()-1)
+}
+
+func (c *conn) updateWindow() {
+	if packetNumberDiff(c.receiveLimit(), c.advertised.Load()) >= c.windowUpdateThreshold() {
+		c.sendReceivedPackets()
+	}
+}
+
+// the receiver advertises its limit again when the reader frees this number of packets,
+// so the sender that is blocked by the limit doesn't wait for the probe
+func (c *conn) windowUpdateThreshold() int {
+	return max(c.opts.readBuffer/4, 1)
+}
+
+// packets that are further beyond the limit are dropped,
+// commands may be sent beyond it, because they don't wait for the reader
+func (c *conn) limitSlack() int {
+	return c.opts.connBuffer
+}
+
+// applies the parameters that the peer sent in the handshake
+func (c *conn) setPeerParameters(params transportParameters) {
+	if params.readBuffer != 0 {
+		c.flight.initLimit(addPacketNumber(0, int(min(params.readBuffer, receivedHistory))-1))
+	}
+	if params.maxAckDelay != 0 { // otherwise the peer uses default delays
+		c.flight.rtt.setPeerAckDelays(
+			time.Duration(params.ackDelay)*time.Microsecond,
+			time.Duration(params.maxAckDelay)*time.Microsecond,
+		)
+	}
+}
+
+// path mtu
+
+// startPathMTUDiscovery probes packet sizes up to the size that both sides are able to receive,
+// it should be called only if packets are sent with the don't-fragment bit (see [setDontFragment])
+func (c *conn) startPathMTUDiscovery(params transportParameters) {
+	if params.maxPacketSize != 0 {
+		c.pmtud.start(min(int(params.maxPacketSize), c.opts.maxPacketSize))
+	}
+}
+
+// probes are sent once, the discovery sends them again if they are lost,
+// size is the size on the wire, so it includes the overhead of sealing
+func (c *conn) sendProbe(size int) error {
+	return c.sendPacketOutOfGroup(probePacket(size - c.flight.overhead))
+}
+
+// sends command through the groups, so it will be resent until it is received
+func (c *conn) sendCommand(newPacket func(number uint32) packet) error {
+	if c.isTornDown() {
+		return c.closeErr.Load().(error)
+	}
+
+	ok, err := c.group().appendAndSendCommand(newPacket)
+	if !ok {
+		_, err = c.nextGroup().appendAndSendCommand(newPacket)
+	}
+	return err
+}
+
 // dont add to any group, because command should be sent only once
 func (c *conn) sendCloseCommand() error {
 	packetNum := c.nextPacketNum()
@@ -325,11 +1519,11 @@ func (c *conn) sendCloseCommand() error {
 }
 
 func (c *conn) sendPacketOutOfGroup(p packet) error {
-	if clErr := c.closeErr.Load(); clErr != nil {
-		return clErr.(error)
+	if c.isTornDown() {
+		return c.closeErr.Load().(error)
 	}
 
-	data := getPacketBuf()
+	data := getBuf(p.len())
 	packetSize, err := p.encode(data.data)
 	if err != nil { // should never happen
 		panic(err)
@@ -346,6 +1540,17 @@ func (c *conn) sendPacketOutOfGroup(p packet) error {
 	return nil
 }
 
+// like [conn.nextPacketNum], but the number is not taken
+func (c *conn) peekNextPacketNum() uint32 {
+	c.lastGroupMu.Lock()
+	defer c.lastGroupMu.Unlock()
+
+	if c.lastGroup != nil {
+		return c.lastGroup.peekNextPacket()
+	}
+	return 0
+}
+
 func (c *conn) nextPacketNum() uint32 {
 	c.lastGroupMu.Lock()
 	defer c.lastGroupMu.Unlock()
@@ -363,8 +1568,8 @@ func (c *conn) group() *group {
 	defer c.lastGroupMu.Unlock()
 
 	if c.lastGroup == nil {
-		g := newGroup(c.out.w, c.closeOnNoResponse,
-			c.stopGroups, c.sendedMu, c.sended, 0)
+		g := newGroup(c.pacer, c.closeOnNoResponse, c.abandonPackets,
+			c.stopGroups, c.flight, c.sendedMu, c.sended, 0, c.opts.resendTries)
 		c.lastGroup = g
 		return g
 	}
@@ -376,8 +1581,8 @@ func (c *conn) nextGroup() *group {
 	c.lastGroupMu.Lock()
 	defer c.lastGroupMu.Unlock()
 
-	g := newGroup(c.out.w, c.closeOnNoResponse,
-		c.stopGroups, c.sendedMu, c.sended, c.lastGroup.nextPacket)
+	g := newGroup(c.pacer, c.closeOnNoResponse, c.abandonPackets,
+		c.stopGroups, c.flight, c.sendedMu, c.sended, c.lastGroup.nextPacket, c.opts.resendTries)
 	c.lastGroup = g
 	return g
 }
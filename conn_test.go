@@ -3,7 +3,10 @@ package sudp
 import (
 	"bytes"
 	"errors"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -11,32 +14,639 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// time for the connection to handle packets in tests
+const testSlack = 50 * time.Millisecond
+
 func TestConn_Write(t *testing.T) {
 	t.Run("Implementations must not retain parameter", func(t *testing.T) {
 		assert := assert.New(t)
 		in := make(chan reusable[[]byte], 2)
 		inerr := new(error)
 		out := &testPacketBuffer{t: t}
-		conn := newConn(in, inerr, out, nil)
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetNoDelay(true))
+
+		msg := []byte{1, 2, 3, 4, 5}
+		_, err := conn.Write(msg)
+		assert.NoError(err)
+		copy(msg, []byte{7, 7, 7, 7, 7})
+		_, err = conn.Write(msg)
+		assert.NoError(err)
+
+		// wait for resend
+		time.Sleep(initialRTO)
+
+		time.Sleep(testSlack)
+
+		// if we rewrite first message conn will resend it 2 times
+		ps := out.Packets()
+		assert.Equal([]byte{1, 2, 3, 4, 5}, ps[0].data)
+		assert.Equal([]byte{7, 7, 7, 7, 7}, ps[1].data)
+		assert.Equal([]byte{1, 2, 3, 4, 5}, ps[2].data)
+		assert.Equal([]byte{7, 7, 7, 7, 7}, ps[3].data)
+	})
+
+	t.Run("Small writes should be coalesced into one packet", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := []byte{1, 2, 3}
+		_, err := conn.Write(msg)
+		assert.NoError(err)
+		copy(msg, []byte{7, 7, 7})
+		_, err = conn.Write(msg)
+		assert.NoError(err)
+		assert.Empty(out.Packets(), "should wait for more data")
+		time.Sleep(coalesceDelay + testSlack)
+
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			assert.Equal([]byte{1, 2, 3, 7, 7, 7}, ps[0].data)
+		}
+	})
+
+	t.Run("Should send full packets at once and keep the tail", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		n, err := conn.Write(make([]byte, minDataSize-1))
+		assert.NoError(err)
+		assert.Equal(minDataSize-1, n)
+		n, err = conn.Write(make([]byte, minDataSize+2))
+		assert.NoError(err)
+		assert.Equal(minDataSize+2, n)
+
+		ps := out.Packets()
+		if assert.Len(ps, 2) {
+			assert.Len(ps[0].data, minDataSize)
+			assert.Len(ps[1].data, minDataSize)
+		}
+		assert.NoError(conn.Flush())
+		ps = out.Packets()
+		if assert.Len(ps, 3) {
+			assert.Len(ps[2].data, 1)
+		}
+	})
+
+	t.Run("Disabling delay should send waiting data", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(conn.SetNoDelay(true))
+		_, err = conn.Write([]byte{4, 5, 6})
+		assert.NoError(err)
+
+		ps := out.Packets()
+		if assert.Len(ps, 2) {
+			assert.Equal([]byte{1, 2, 3}, ps[0].data)
+			assert.Equal([]byte{4, 5, 6}, ps[1].data)
+		}
+	})
+
+	t.Run("Close should send waiting data before fin", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(conn.Close())
+
+		ps := out.Packets()
+		if assert.Len(ps, 2) {
+			assert.Equal([]byte{1, 2, 3}, ps[0].data)
+			tp, _, err := commandPacketType(ps[1])
+			assert.NoError(err)
+			assert.Equal(commandFin, tp)
+		}
+	})
+}
+
+func TestConn_CongestionWindow(t *testing.T) {
+	t.Run("Write should wait until window has room", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetCongestionController(&testCongestionController{window: 2 * minPacketSize}))
+
+		var written atomic.Bool
+		go func() {
+			n, err := conn.Write(make([]byte, 3*minDataSize))
+			assert.NoError(err)
+			assert.Equal(3*minDataSize, n)
+			written.Store(true)
+		}()
+		time.Sleep(testSlack)
+		assert.Len(out.Packets(), 2)
+		assert.False(written.Load())
+
+		msg := make([]byte, 1024)
+		n, err := receivedPacketsPacket(0, receivedPackets{cumulative: 1}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+
+		assert.Eventually(written.Load, time.Second, 10*time.Millisecond)
+		assert.Len(out.Packets(), 3)
+	})
+
+	t.Run("Write should return written part after deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetCongestionController(&testCongestionController{window: 2 * minPacketSize}))
+
+		assert.NoError(conn.SetWriteDeadline(time.Now().Add(testSlack)))
+		n, err := conn.Write(make([]byte, 3*minDataSize))
+
+		assert.Equal(2*minDataSize, n)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestConn_FlowControl(t *testing.T) {
+	t.Run("Write should wait until receiver raises limit", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.flight.initLimit(1)
+
+		var written atomic.Bool
+		go func() {
+			n, err := conn.Write(make([]byte, 3*minDataSize))
+			assert.NoError(err)
+			assert.Equal(3*minDataSize, n)
+			written.Store(true)
+		}()
+		time.Sleep(testSlack)
+		assert.Len(out.Packets(), 2)
+		assert.False(written.Load())
+
+		msg := make([]byte, 1024)
+		n, err := receivedPacketsPacket(0, receivedPackets{limit: 2}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+
+		assert.Eventually(written.Load, time.Second, 10*time.Millisecond)
+		assert.Len(out.Packets(), 3)
+	})
+
+	t.Run("Read should advertise freed space without waiting for timers", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.advertised.Store(uint32(userCap - conn.windowUpdateThreshold())) // as if the reader was slow
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(0, []byte("Hello")).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		n, err = conn.Read(make([]byte, 1024))
+		assert.NoError(err)
+		assert.Equal(5, n)
+
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			assert.EqualValues(userCap, testDecodeReceivedPackets(t, ps[0]).limit)
+		}
+	})
+
+	t.Run("Should drop packets far beyond limit", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(uint32(userCap+conn.limitSlack()), []byte("Hello")).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(rShortTime + testSlack)
+
+		assert.EqualValues(1, freeCalls.Load())
+		assert.Empty(out.Packets(), "dropped packet should not be acknowledged")
+	})
+}
+
+func TestConn_LossRecovery(t *testing.T) {
+	t.Run("Should resend only missing packet when later packets are acknowledged", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		_, err := conn.Write(make([]byte, 5*minDataSize))
+		assert.NoError(err)
+		msg := make([]byte, 1024)
+		n, err := receivedPacketsPacket(0, receivedPackets{cumulative: 1, blocks: []rng[uint32]{{2, 4}}}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+
+		ps := out.Packets()
+		if assert.Len(ps, 6) {
+			assert.EqualValues(1, ps[5].number)
+		}
+	})
+
+	t.Run("Should probe the tail when acknowledgments stop", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.flight.rtt.addSample(10*time.Millisecond, 0)
+
+		pto, ok := conn.flight.rtt.probeTimeout()
+		assert.True(ok)
+		assert.Less(pto+testSlack/2, conn.flight.rtt.rto(), "should be before the timeout")
+
+		_, err := conn.Write(make([]byte, 2*minDataSize))
+		assert.NoError(err)
+		time.Sleep(pto + testSlack/2)
+
+		ps := out.Packets()
+		if assert.Len(ps, 3) {
+			assert.EqualValues(1, ps[2].number)
+		}
+	})
+}
+
+func TestConn_PathMTU(t *testing.T) {
+	t.Run("Should acknowledge probe with its size", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, maxPacketSize)
+		n, err := probePacket(ethernetPacketSize).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			tp, payload, err := commandPacketType(ps[0])
+			assert.NoError(err)
+			assert.Equal(commandProbeAck, tp)
+			size, err := decodeProbeAck(payload)
+			assert.NoError(err)
+			assert.Equal(ethernetPacketSize, size)
+		}
+		assert.EqualValues(1, freeCalls.Load())
+	})
+
+	t.Run("Should split data into packets of confirmed size", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.startPathMTUDiscovery(transportParameters{maxPacketSize: ethernetPacketSize})
+		time.Sleep(testSlack)
+
+		ps := out.Packets()
+		if assert.NotEmpty(ps) {
+			assert.Equal(commonPacketSizes[0], ps[0].len(), "common size should be probed first")
+		}
+		msg := make([]byte, 16)
+		n, err := probeAckPacket(ethernetPacketSize).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+
+		assert.Equal(ethernetPacketSize, conn.flight.packetSize())
+		_, err = conn.Write(make([]byte, 2*(ethernetPacketSize-headerSize)))
+		assert.NoError(err)
+		ps = out.Packets()
+		if assert.GreaterOrEqual(len(ps), 2) {
+			assert.Equal(ethernetPacketSize, ps[len(ps)-1].len())
+			assert.Equal(ethernetPacketSize, ps[len(ps)-2].len())
+		}
+	})
+}
+
+func TestConn_Datagrams(t *testing.T) {
+	t.Run("Should read datagrams out of order and without acknowledgment", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(1, []byte{1, 2, 3}).encode(msg) // the first packet is missing
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		dmsg := make([]byte, 1024)
+		n, err = datagramPacket([]byte{4, 5, 6}).encode(dmsg)
+		assert.NoError(err)
+		in <- newTestReusable(dmsg[:n], &freeCalls)
+
+		buf := make([]byte, 8)
+		n, err = conn.ReceiveDatagram(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{4, 5, 6}, buf[:n])
+		time.Sleep(rShortTime + testSlack)
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			rp := testDecodeReceivedPackets(t, ps[0])
+			assert.Equal([]rng[uint32]{{1, 1}}, rp.blocks, "datagram should not be acknowledged")
+		}
+	})
+
+	t.Run("Should send datagram without retransmission", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		assert.NoError(conn.SendDatagram([]byte{1, 2, 3}))
+		time.Sleep(initialRTO + testSlack)
+
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			tp, payload, err := commandPacketType(ps[0])
+			assert.NoError(err)
+			assert.Equal(commandDatagram, tp)
+			assert.Equal([]byte{1, 2, 3}, payload)
+		}
+	})
+
+	t.Run("Should not send datagram that doesn't fit", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetCongestionController(&testCongestionController{window: minPacketSize}))
+
+		assert.ErrorIs(conn.SendDatagram(make([]byte, minDataSize)), ErrDatagramTooLarge)
+		assert.NoError(conn.SetNoDelay(true))
+		_, err := conn.Write(make([]byte, minDataSize))
+		assert.NoError(err)
+		assert.ErrorIs(conn.SendDatagram([]byte{1}), ErrDatagramDropped)
+		assert.Len(out.Packets(), 1)
+	})
+}
+
+func TestConn_MessageLifetime(t *testing.T) {
+	t.Run("Should abandon expired message and tell the peer to skip it", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.messages = true
+
+		_, err := conn.WriteMessageWithLifetime([]byte{1, 2, 3}, initialRTO/2)
+		assert.NoError(err)
+		time.Sleep(initialRTO + testSlack)
+
+		ps := out.Packets()
+		if assert.Len(ps, 2, "should not be resent") {
+			tp, _, err := commandPacketType(ps[1])
+			assert.NoError(err)
+			assert.Equal(commandForward, tp)
+			assert.EqualValues(1, ps[1].number)
+		}
+
+		msg := make([]byte, 1024)
+		n, err := receivedPacketsPacket(0, receivedPackets{cumulative: 0}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+		assert.Len(out.Packets(), 3, "lost forward should be resent")
+		assert.False(conn.isTornDown())
+	})
+
+	t.Run("Should return error if message expires before it is sent", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.messages = true
+		assert.NoError(conn.SetCongestionController(&testCongestionController{window: minPacketSize}))
+
+		_, err := conn.WriteMessage(make([]byte, minDataSize-fragmentHeaderSize))
+		assert.NoError(err)
+		_, err = conn.WriteMessageWithLifetime([]byte{1}, testSlack)
+		assert.ErrorIs(err, ErrMessageExpired)
+		assert.Len(out.Packets(), 1)
+	})
+
+	t.Run("Should skip abandoned packets on forward", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.messages = true
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(2, []byte{firstFragmentFlag | lastFragmentFlag, 5}).encode(msg) // 0 and 1 are abandoned
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		fmsg := make([]byte, 1024)
+		n, err = forwardPacket(2).encode(fmsg)
+		assert.NoError(err)
+		in <- newTestReusable(fmsg[:n], &freeCalls)
+
+		buf := make([]byte, 8)
+		n, err = conn.ReadMessage(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{5}, buf[:n])
+		ps := out.Packets()
+		if assert.NotEmpty(ps) {
+			rp := testDecodeReceivedPackets(t, ps[len(ps)-1])
+			assert.EqualValues(3, rp.cumulative)
+		}
+	})
+}
+
+func TestConn_Unordered(t *testing.T) {
+	t.Run("Should read packets as they arrive and EOF after all of them", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 4)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetUnordered(true))
+		send := func(p packet) {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+
+		send(dataPacket(1, []byte{2}))
+		send(dataPacket(2, []byte{3}))
+		send(finPacket(3))
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{2}, buf[:n], "packets should not be merged")
+		n, err = conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{3}, buf[:n])
+
+		send(dataPacket(1, []byte{2})) // duplicate
+		send(dataPacket(0, []byte{1}))
+		n, err = conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1}, buf[:n])
+		_, err = conn.Read(buf)
+		assert.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("Should not be set in message mode", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.messages = true
+
+		assert.ErrorIs(conn.SetUnordered(true), ErrUnorderedMessages)
+	})
+}
+
+func TestConn_FEC(t *testing.T) {
+	t.Run("Lost packet should be rebuilt without retransmission", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 8)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		send := func(p packet) {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+		sum := func(ps ...packet) repair {
+			r := repair{count: len(ps), sum: make([]byte, 1)}
+			for _, p := range ps {
+				r.length ^= uint16(len(p.data))
+				xor(r.sum, p.data)
+			}
+			return r
+		}
+
+		first := []packet{dataPacket(0, []byte{1}), dataPacket(1, []byte{2})}
+		second := []packet{dataPacket(2, []byte{3}), dataPacket(3, []byte{4})}
+		send(first[0])
+		send(first[1])
+		send(repairPacket(0, sum(first...))) // the size of blocks is learned
+		send(second[1])
+		send(repairPacket(2, sum(second...)))
+
+		buf := make([]byte, 8)
+		_, err := io.ReadFull(conn, buf[:4])
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3, 4}, buf[:4])
+		assert.Empty(conn.repairs.blocks, "rebuilt packet should not start a new block")
+		time.Sleep(testSlack)
+		assert.EqualValues(5, freeCalls.Load())
+	})
+
+	t.Run("Should validate block size", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		size := conn.flight.packetSize()
+
+		for _, blockSize := range []int{-1, 1, 3, 128} {
+			assert.ErrorIs(conn.SetFEC(blockSize), ErrInvalidFECBlockSize, "size %d", blockSize)
+		}
+		assert.NoError(conn.SetFEC(8))
+		assert.Equal(size-fecReserve, conn.flight.packetSize(), "packets should leave room for repair")
+		assert.NoError(conn.SetFEC(0))
+		assert.Equal(size, conn.flight.packetSize())
+	})
+}
+
+func TestConn_Version(t *testing.T) {
+	t.Run("Packets of other versions should be dropped", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
 
-		msg := []byte{1, 2, 3, 4, 5}
-		_, err := conn.Write(msg)
-		assert.NoError(err)
-		copy(msg, []byte{7, 7, 7, 7, 7})
-		_, err = conn.Write(msg)
+		msg := make([]byte, 1024)
+		p := closeConnectionPacket(0)
+		p.version = 2
+		n, err := p.encode(msg)
 		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
 
-		// wait for resend
-		time.Sleep(sShortTime)
+		assert.EqualValues(1, freeCalls.Load())
+		assert.False(conn.isTornDown())
+	})
+}
+
+func TestConn_PSK(t *testing.T) {
+	t.Run("Not authenticated packets should be dropped", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		conn.opener = &pskOpener{keys: handshakeKeys(testPSK)}
 
-		time.Sleep(deliveryDelay / 2)
+		msg := make([]byte, 1024)
+		n, err := closeConnectionPacket(0).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		in <- newTestReusable([]byte{1}, &freeCalls)
+		time.Sleep(testSlack)
 
-		// if we rewrite first message conn will resend it 2 times
-		ps := out.Packets()
-		assert.Equal([]byte{1, 2, 3, 4, 5}, ps[0].data)
-		assert.Equal([]byte{7, 7, 7, 7, 7}, ps[1].data)
-		assert.Equal([]byte{1, 2, 3, 4, 5}, ps[2].data)
-		assert.Equal([]byte{7, 7, 7, 7, 7}, ps[3].data)
+		assert.EqualValues(2, freeCalls.Load())
+		assert.False(conn.isTornDown(), "forged close should be ignored")
 	})
 }
 
@@ -47,7 +657,7 @@ func TestConn_ReceivedPackets(t *testing.T) {
 		in := make(chan reusable[[]byte], 2)
 		inerr := new(error)
 		out := &testPacketBuffer{t: t}
-		_ = newConn(in, inerr, out, nil)
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
 
 		msg := make([]byte, 1024)
 		n, err := dataPacket(0, []byte("Hello")).encode(msg)
@@ -60,12 +670,13 @@ func TestConn_ReceivedPackets(t *testing.T) {
 
 		time.Sleep(rShortTime)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		ps := out.Packets()
 		assert.GreaterOrEqual(len(ps), 1)
 		received := testDecodeReceivedPackets(t, ps[0])
-		assert.Equal([]rng[uint32]{{0, 1}}, received)
+		assert.EqualValues(2, received.cumulative)
+		assert.Empty(received.blocks)
 		assert.EqualValues(0, freeCalls.Load(), "should keep all packets")
 	})
 
@@ -78,7 +689,7 @@ func TestConn_ReceivedPackets(t *testing.T) {
 		smallWindow := rShortTime / 2
 		smallWindowPackets := int(rLongTime / smallWindow)
 		restToTime := rLongTime - smallWindow*time.Duration(smallWindowPackets)
-		_ = newConn(in, inerr, out, nil)
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
 
 		for i := range smallWindowPackets {
 			msg := make([]byte, 1024)
@@ -89,12 +700,13 @@ func TestConn_ReceivedPackets(t *testing.T) {
 		}
 		time.Sleep(restToTime)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		ps := out.Packets()
 		assert.GreaterOrEqual(len(ps), 1)
 		received := testDecodeReceivedPackets(t, ps[0])
-		assert.Equal([]rng[uint32]{{69, uint32(69 + smallWindowPackets - 1)}}, received)
+		assert.EqualValues(0, received.cumulative)
+		assert.Equal([]rng[uint32]{{69, uint32(69 + smallWindowPackets - 1)}}, received.blocks)
 		assert.EqualValues(0, freeCalls.Load(), "should keep all packets")
 	})
 
@@ -104,7 +716,7 @@ func TestConn_ReceivedPackets(t *testing.T) {
 		in := make(chan reusable[[]byte], 2)
 		inerr := new(error)
 		out := &testPacketBuffer{t: t}
-		_ = newConn(in, inerr, out, nil)
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
 
 		msg := make([]byte, 1024)
 		n, err := dataPacket(0, []byte("Hello")).encode(msg)
@@ -123,14 +735,86 @@ func TestConn_ReceivedPackets(t *testing.T) {
 		assert.NoError(err)
 		in <- newTestReusable(msg[:n], &freeCalls)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		ps := out.Packets()
 		assert.GreaterOrEqual(len(ps), 1)
 		received := testDecodeReceivedPackets(t, ps[0])
-		assert.Equal([]rng[uint32]{{0, 1}}, received)
+		assert.EqualValues(2, received.cumulative)
 		assert.EqualValues(1, freeCalls.Load(), "should free received packet")
 	})
+
+	t.Run("Should fit any number of gaps into received packets", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		for i := range uint32(2 * maxAckBlocks) {
+			msg := make([]byte, 1024)
+			n, err := dataPacket(2*i+1, []byte("Hello")).encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+		time.Sleep(rShortTime + testSlack)
+
+		ps := out.Packets()
+		if assert.GreaterOrEqual(len(ps), 1) {
+			received := testDecodeReceivedPackets(t, ps[0])
+			assert.EqualValues(0, received.cumulative)
+			assert.Len(received.blocks, maxAckBlocks)
+			assert.Equal(rng[uint32]{1, 1}, received.blocks[0], "gaps near cumulative should be reported")
+			assert.Equal(rng[uint32]{4*maxAckBlocks - 1, 4*maxAckBlocks - 1}, received.blocks[maxAckBlocks-1], "newest packet should be reported")
+		}
+
+		for i := range uint32(2 * maxAckBlocks) {
+			msg := make([]byte, 1024)
+			n, err := dataPacket(2*i, []byte("Hello")).encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+		time.Sleep(testSlack)
+
+		conn.receivedMu.RLock()
+		assert.EqualValues(4*maxAckBlocks, conn.cumulative)
+		assert.Empty(conn.received, "history before cumulative should be pruned")
+		conn.receivedMu.RUnlock()
+	})
+}
+
+func TestConn_MarkSendedPackets(t *testing.T) {
+	t.Run("Should keep only the newest version even if version wraps around", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte])
+		inerr := new(error)
+		conn := newConn(defaultOptions(), in, inerr, bytes.NewBuffer(nil), nil)
+		defer conn.Close()
+
+		conn.markSendedPackets(0, receivedPackets{cumulative: 2})
+		assert.Equal([]rng[uint32]{{addPacketNumber(2, -receivedHistory), 1}}, *conn.sended, "first version should be accepted")
+
+		conn.markSendedPackets(maxPacketNumber, receivedPackets{cumulative: 3})
+		assert.Equal([]rng[uint32]{{addPacketNumber(2, -receivedHistory), 1}}, *conn.sended, "old version should be ignored")
+
+		conn.sendedVersion = maxPacketNumber - 1
+		conn.markSendedPackets(1, receivedPackets{cumulative: 4})
+		assert.Equal([]rng[uint32]{{addPacketNumber(4, -receivedHistory), 3}}, *conn.sended, "wrapped version should be newer")
+	})
+
+	t.Run("Should remember blocks missing in newer versions", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte])
+		inerr := new(error)
+		conn := newConn(defaultOptions(), in, inerr, bytes.NewBuffer(nil), nil)
+		defer conn.Close()
+
+		conn.markSendedPackets(0, receivedPackets{cumulative: 2, blocks: []rng[uint32]{{5, 6}, {9, 9}}})
+		conn.markSendedPackets(1, receivedPackets{cumulative: 3, blocks: []rng[uint32]{{9, 10}}})
+
+		assert.Equal([]rng[uint32]{{addPacketNumber(3, -receivedHistory), 2}, {5, 6}, {9, 10}}, *conn.sended)
+	})
 }
 
 func TestConn_Close(t *testing.T) {
@@ -141,7 +825,7 @@ func TestConn_Close(t *testing.T) {
 		inRawErr := errors.New("read err")
 		inerr := &inRawErr
 		out := errWriter{errors.New("write err")}
-		conn := newConn(in, inerr, out, nil)
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
 
 		_ = conn.Close()
 		buf := make([]byte, 1024)
@@ -164,7 +848,8 @@ func TestConn_Close(t *testing.T) {
 			outCloseCount++
 			return nil
 		}
-		conn := newConn(in, inerr, out, outClose)
+		conn := newConn(defaultOptions(), in, inerr, out, outClose)
+		assert.NoError(conn.SetLinger(0))
 
 		err := conn.Close()
 		assert.NoError(err)
@@ -172,6 +857,389 @@ func TestConn_Close(t *testing.T) {
 
 		assert.Equal(1, outCloseCount)
 	})
+
+	t.Run("Close should release write blocked by the peer", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenConfig("udp", "127.0.0.1:0", &Config{ReadBuffer: 8})
+		assert.NoError(err)
+		defer l.Close()
+		conn, err := Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		srvConn, err := l.Accept() // it never reads
+		assert.NoError(err)
+		defer srvConn.Close()
+		assert.NoError(conn.(Conn).SetNoDelay(true))
+
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(make([]byte, 64*minDataSize))
+			writeErr <- err
+		}()
+		time.Sleep(testSlack)
+
+		closed := make(chan struct{})
+		go func() {
+			conn.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			assert.Fail("Close should return")
+		}
+		select {
+		case err := <-writeErr:
+			assert.ErrorIs(err, net.ErrClosed)
+		case <-time.After(time.Second):
+			assert.Fail("Write should return")
+		}
+	})
+}
+
+func TestConn_CloseWithError(t *testing.T) {
+	t.Run("Should send reset with truncated reason", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		assert.NoError(conn.CloseWithError(7, strings.Repeat("ы", maxResetReasonSize)))
+		assert.NoError(conn.CloseWithError(8, "twice"))
+
+		ps := out.Packets()
+		if assert.Len(ps, 1) {
+			tp, payload, err := commandPacketType(ps[0])
+			assert.NoError(err)
+			assert.Equal(commandReset, tp)
+			code, reason, err := decodeReset(payload)
+			assert.NoError(err)
+			assert.EqualValues(7, code)
+			assert.Equal(strings.Repeat("ы", maxResetReasonSize/2), reason)
+		}
+		_, err := conn.Read(make([]byte, 8))
+		var appErr *ApplicationError
+		assert.ErrorAs(err, &appErr)
+	})
+
+	t.Run("Received reset should discard data that is not read", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(0, []byte{1}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(bytes.Clone(msg[:n]), &freeCalls)
+		n, err = resetPacket(1, 3, "server shutting down").encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+		_, err = conn.Read(make([]byte, 8))
+
+		var appErr *ApplicationError
+		if assert.ErrorAs(err, &appErr) {
+			assert.Equal(&ApplicationError{Code: 3, Reason: "server shutting down", Remote: true}, appErr)
+		}
+		assert.True(conn.isTornDown())
+	})
+}
+
+func TestConn_Read(t *testing.T) {
+	t.Run("Should return received data before error after remote close", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		for _, p := range []packet{dataPacket(0, []byte("Hello")), closeConnectionPacket(1)} {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+		assert.Eventually(func() bool { return conn.closeErr.Load() != nil }, time.Second, 10*time.Millisecond)
+
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("Hello"), buf[:n])
+		n, err = conn.Read(buf)
+		assert.Zero(n)
+		assert.ErrorIs(err, errRemotelyClosed)
+	})
+
+	t.Run("Should discard received data after local close", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, 1024)
+		n, err := dataPacket(0, []byte("Hello")).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(testSlack)
+		assert.NoError(conn.Close())
+
+		n, err = conn.Read(make([]byte, 1024))
+		assert.Zero(n)
+		assert.ErrorIs(err, errCloseFuncCalled)
+	})
+}
+
+func TestConn_KeepAlive(t *testing.T) {
+	t.Run("Should send ping when nothing is received for keepalive period", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		defer conn.Close()
+
+		assert.NoError(conn.SetKeepAlivePeriod(50 * time.Millisecond))
+		time.Sleep(75 * time.Millisecond)
+
+		ps := out.Packets()
+		assert.Len(ps, 1)
+		tp, _, err := commandPacketType(ps[0])
+		assert.NoError(err)
+		assert.Equal(commandPing, tp)
+	})
+
+	t.Run("Shouldn't send ping if keepalive is disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		defer conn.Close()
+
+		assert.NoError(conn.SetKeepAlivePeriod(50 * time.Millisecond))
+		assert.NoError(conn.SetKeepAlive(false))
+		time.Sleep(75 * time.Millisecond)
+
+		assert.Empty(out.Packets())
+	})
+}
+
+func TestConn_IdleTimeout(t *testing.T) {
+	t.Run("Should close silent connection", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		var outClosed atomic.Bool
+		conn := newConn(defaultOptions(), in, inerr, out, func() error {
+			outClosed.Store(true)
+			in <- reusable[[]byte]{}
+			return nil
+		})
+
+		assert.NoError(conn.SetKeepAlive(false))
+		assert.NoError(conn.SetIdleTimeout(50 * time.Millisecond))
+		n, err := conn.Read(make([]byte, 1024))
+
+		assert.Zero(n)
+		assert.ErrorIs(err, ErrIdleTimeout)
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.True(outClosed.Load())
+		assert.Empty(out.Packets(), "peer is considered dead so it shouldn't be notified")
+	})
+
+	t.Run("Received packets should postpone idle timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		defer conn.Close()
+
+		assert.NoError(conn.SetKeepAlive(false))
+		assert.NoError(conn.SetIdleTimeout(100 * time.Millisecond))
+		for i := range 5 {
+			msg := make([]byte, 1024)
+			n, err := dataPacket(uint32(i), []byte("Hello")).encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		assert.Nil(conn.closeErr.Load())
+	})
+
+	t.Run("Non-positive timeout should disable it", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		defer conn.Close()
+
+		assert.NoError(conn.SetKeepAlive(false))
+		assert.NoError(conn.SetIdleTimeout(50 * time.Millisecond))
+		assert.NoError(conn.SetIdleTimeout(0))
+		time.Sleep(100 * time.Millisecond)
+
+		assert.Nil(conn.closeErr.Load())
+	})
+}
+
+func TestConn_Fin(t *testing.T) {
+	t.Run("Close should send fin and resend it until it is acknowledged", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		var outClosed atomic.Bool
+		conn := newConn(defaultOptions(), in, inerr, out, func() error {
+			outClosed.Store(true)
+			return nil
+		})
+
+		assert.NoError(conn.Close())
+		time.Sleep(initialRTO + testSlack)
+
+		ps := out.Packets()
+		assert.Len(ps, 2)
+		for _, p := range ps {
+			tp, _, err := commandPacketType(p)
+			assert.NoError(err)
+			assert.Equal(commandFin, tp)
+			assert.EqualValues(0, p.number)
+		}
+		assert.False(outClosed.Load(), "should wait for fin ack")
+
+		msg := make([]byte, 1024)
+		n, err := finAckPacket(0).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+
+		assert.Eventually(outClosed.Load, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Fin should be handled after all previous data", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 3)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		var outClosed atomic.Bool
+		conn := newConn(defaultOptions(), in, inerr, out, func() error {
+			outClosed.Store(true)
+			return nil
+		})
+
+		for _, p := range []packet{finPacket(2), dataPacket(1, []byte("World")), dataPacket(0, []byte("Hello"))} {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+
+		buf := make([]byte, 1024)
+		n, _ := conn.Read(buf)
+		assert.Equal([]byte("HelloWorld"), buf[:n])
+		n, err := conn.Read(buf)
+		assert.Zero(n)
+		assert.ErrorIs(err, io.EOF)
+		_, err = conn.Write([]byte{1, 2, 3})
+		assert.ErrorIs(err, errRemotelyClosed)
+
+		ps := out.Packets()
+		assert.Len(ps, 1)
+		tp, _, err := commandPacketType(ps[0])
+		assert.NoError(err)
+		assert.Equal(commandFinAck, tp)
+		assert.EqualValues(2, ps[0].number)
+
+		assert.False(outClosed.Load(), "should wait in time wait")
+		assert.Eventually(outClosed.Load, 2*timeWaitRTOs*initialRTO, 10*time.Millisecond)
+	})
+
+	t.Run("Retransmitted fin should be acknowledged again in time wait", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
+
+		for range 2 {
+			msg := make([]byte, 1024)
+			n, err := finPacket(0).encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+		time.Sleep(testSlack)
+
+		var finAcks int
+		for _, p := range out.Packets() {
+			if tp, _, _ := commandPacketType(p); tp == commandFinAck {
+				finAcks++
+			}
+		}
+		assert.Equal(2, finAcks)
+	})
+}
+
+func TestConn_SetLinger(t *testing.T) {
+	t.Run("Zero linger should close at once with close packet", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		var outClosed atomic.Bool
+		conn := newConn(defaultOptions(), in, inerr, out, func() error {
+			outClosed.Store(true)
+			return nil
+		})
+
+		assert.NoError(conn.SetNoDelay(true))
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(conn.SetLinger(0))
+		assert.NoError(conn.Close())
+
+		assert.True(outClosed.Load())
+		ps := out.Packets()
+		assert.Len(ps, 2)
+		tp, _, err := commandPacketType(ps[1])
+		assert.NoError(err)
+		assert.Equal(commandCloseConn, tp)
+	})
+
+	t.Run("Positive linger should block until timeout if fin isn't acknowledged", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		var outClosed atomic.Bool
+		conn := newConn(defaultOptions(), in, inerr, out, func() error {
+			outClosed.Store(true)
+			return nil
+		})
+
+		assert.NoError(conn.SetLinger(1))
+		start := time.Now()
+		assert.NoError(conn.Close())
+
+		assert.GreaterOrEqual(time.Since(start), time.Second)
+		assert.True(outClosed.Load())
+		ps := out.Packets()
+		tp, _, err := commandPacketType(ps[len(ps)-1])
+		assert.NoError(err)
+		assert.Equal(commandCloseConn, tp, "rest of data should be discarded")
+	})
 }
 
 type errWriter struct {
@@ -0,0 +1,71 @@
+package sudp
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a point in time that can be moved or cleared at any moment,
+// the channel returned by [deadline.wait] is closed when it is exceeded
+type deadline struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	exceeded chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		exceeded: make(chan struct{}),
+	}
+}
+
+// zero t clears the deadline, t in the past exceeds it immediately
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.exceeded // wait for the timer function to close channel
+	}
+	d.timer = nil
+
+	exceeded := isClosed(d.exceeded)
+	if t.IsZero() {
+		if exceeded {
+			d.exceeded = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if exceeded {
+			d.exceeded = make(chan struct{})
+		}
+		ch := d.exceeded
+		d.timer = time.AfterFunc(dur, func() { close(ch) })
+		return
+	}
+
+	if !exceeded {
+		close(d.exceeded)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.exceeded
+}
+
+func (d *deadline) isExceeded() bool {
+	return isClosed(d.wait())
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+func TestDeadline(t *testing.T) {
+	t.Run("New deadline is never exceeded", func(t *testing.T) {
+		assert := assert.New(t)
+		d := newDeadline()
+
+		assert.False(d.isExceeded())
+	})
+
+	t.Run("Past time exceeds immediately", func(t *testing.T) {
+		assert := assert.New(t)
+		d := newDeadline()
+
+		d.set(time.Now().Add(-time.Second))
+
+		assert.True(d.isExceeded())
+	})
+
+	t.Run("Future time exceeds after it passes", func(t *testing.T) {
+		assert := assert.New(t)
+		d := newDeadline()
+
+		d.set(time.Now().Add(50 * time.Millisecond))
+		assert.False(d.isExceeded())
+
+		select {
+		case <-d.wait():
+		case <-time.After(time.Second):
+			assert.Fail("deadline wasn't exceeded")
+		}
+		assert.True(d.isExceeded())
+	})
+
+	t.Run("Zero time clears deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		d := newDeadline()
+
+		d.set(time.Now())
+		assert.True(d.isExceeded())
+		d.set(time.Time{})
+		assert.False(d.isExceeded())
+
+		d.set(time.Now().Add(50 * time.Millisecond))
+		d.set(time.Time{})
+		time.Sleep(100 * time.Millisecond)
+		assert.False(d.isExceeded())
+	})
+
+	t.Run("Deadline can be moved", func(t *testing.T) {
+		assert := assert.New(t)
+		d := newDeadline()
+
+		d.set(time.Now().Add(time.Hour))
+		wait := d.wait()
+		d.set(time.Now().Add(50 * time.Millisecond))
+		assert.False(d.isExceeded())
+
+		select {
+		case <-wait:
+		case <-time.After(time.Second):
+			assert.Fail("deadline wasn't exceeded")
+		}
+	})
+}
+
+func TestConn_Nettest(t *testing.T) {
+	t.Run("Dialed connection", func(t *testing.T) {
+		nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+			return loopbackPipe(false)
+		})
+	})
+
+	t.Run("Accepted connection", func(t *testing.T) {
+		nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+			return loopbackPipe(true)
+		})
+	})
+}
+
+// loopbackPipe returns the dialed and the accepted connections, or vice versa if accepted is first
+func loopbackPipe(acceptedFirst bool) (c1, c2 net.Conn, stop func(), err error) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dialed, err := Dial("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, nil, nil, err
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		dialed.Close()
+		l.Close()
+		return nil, nil, nil, err
+	}
+
+	stop = func() {
+		dialed.Close()
+		accepted.Close()
+		l.Close()
+	}
+	if acceptedFirst {
+		return accepted, dialed, stop, nil
+	}
+	return dialed, accepted, stop, nil
+}
@@ -1,14 +1,78 @@
 package sudp
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"slices"
 	"time"
 )
 
+// Dial opens the connection to the address and blocks until the server accepts it
 func Dial(network, address string) (net.Conn, error) {
+	c, err := dial(network, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialMessages works like [Dial], but opens the connection in message mode,
+// the server must listen with [ListenMessages]
+func DialMessages(network, address string) (MessageConn, error) {
+	c, err := dial(network, address, &Config{Messages: true})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialPSK works like [Dial], but every packet of the connection is encrypted and authenticated
+// with keys derived from the pre-shared key, which must be at least 16 bytes long.
+// The server must listen with [ListenPSK] and the same key.
+func DialPSK(network, address string, psk []byte) (net.Conn, error) {
+	c, err := dial(network, address, &Config{PSK: psk})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialTLS works like [Dial], but the connection is authenticated and encrypted
+// with keys of the TLS 1.3 handshake, which is done with the config before DialTLS returns.
+// The server must listen with [ListenTLS].
+func DialTLS(network, address string, config *tls.Config) (TLSConn, error) {
+	if config == nil {
+		return nil, errNoTLSConfig
+	}
+	c, err := dial(network, address, &Config{TLS: config})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialConfig works like [Dial], but the connection is tuned by the config,
+// it can be obtained with type assertion to [MessageConn] in message mode
+// and to [TLSConn] in TLS mode. Nil config has default values.
+func DialConfig(network, address string, config *Config) (Conn, error) {
+	c, err := dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func dial(network, address string, config *Config) (*dconn, error) {
+	opts, err := config.options()
+	if err != nil {
+		return nil, err
+	}
 	serverAddr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve address: %w", err)
@@ -18,20 +82,152 @@ func Dial(network, address string) (net.Conn, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial: %w", err)
 	}
+	dontFragment := setDontFragment(src) == nil // otherwise path mtu is not discovered
+
+	local := opts.transportParameters()
+	if opts.psk != nil {
+		local.nonce = make([]byte, pskNonceSize)
+		rand.Read(local.nonce)
+	}
+	cookie, params, rtt, err := dialHandshake(src, local, opts.handshakeProtection(), opts.resendTries)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to open connection: %w", err)
+	}
 
-	readCh := make(chan reusable[[]byte], connCap)
+	readCh := make(chan reusable[[]byte], opts.connBuffer)
 	readErr := new(error)
-	go readToCh(readCh, readErr, src)
-	conn := newConn(readCh, readErr, src, func() error {
-		readCh <- reusable[[]byte]{}
-		return src.Close()
+	out, opener := opts.protect(src, true, local.nonce, cookie)
+	conn := newConn(opts, readCh, readErr, out, src.Close) // readToCh closes readCh after src is closed
+	conn.addrs = src
+	conn.opener = opener
+	conn.flight.overhead = opts.overhead()
+	if opts.tls != nil {
+		conn.crypto = make(chan cryptoData, cryptoCap)
+	}
+	go readToCh(readCh, readErr, src) // after the connection is set up, so its fields are not changed while it reads
+	conn.flight.rtt.addSample(rtt, 0)
+	conn.setPeerParameters(params)
+	err = conn.sendCommand(func(number uint32) packet {
+		return confirmConnectionPacket(number, cookie, local)
 	})
+	if err != nil {
+		conn.close(err, false)
+		return nil, fmt.Errorf("failed to confirm connection: %w", err)
+	}
+	if opts.tls != nil {
+		err = conn.tlsHandshake(tls.QUICClient(&tls.QUICConfig{TLSConfig: tlsConfig(opts.tls)}), local, params)
+		if err != nil {
+			conn.close(err, false)
+			return nil, fmt.Errorf("failed to open connection: %w", err)
+		}
+	}
+	if dontFragment { // after the TLS handshake, so probes are sealed like other packets
+		conn.startPathMTUDiscovery(params)
+	}
 	return &dconn{
 		conn:    conn,
 		addrSrc: src,
 	}, nil
 }
 
+// dialHandshake sends initial packet until the server answers with accept,
+// returns cookie that should be sent back in confirm packet,
+// parameters of the server and rtt sample, which is measured from the first initial packet,
+// so if it was resent, rtt is overestimated rather than underestimated.
+// Packets are protected by hs, nil hs means that they are not protected.
+// If the server doesn't support the version of local parameters,
+// the handshake is started again with the best common version (see handshake.go).
+// Initial is resent tries times.
+func dialHandshake(src net.Conn, local transportParameters, hs handshakeProtection, tries int) (cookie []byte, params transportParameters, rtt time.Duration, err error) {
+	initial := getPacketBuf()
+	defer initial.free()
+	initialSize, err := initialConnectionPacket(local).encode(initial.data)
+	if err != nil { // should never happen
+		panic(err)
+	}
+	if hs != nil {
+		sealed := hs.seal(make([]byte, 0, initialSize+sealOverhead+1), initial.data[:initialSize])
+		initialSize = copy(initial.data, sealed)
+	}
+
+	buf := getPacketBuf()
+	defer buf.free()
+	defer src.SetReadDeadline(time.Time{})
+
+	resendDelay := initialRTO
+	sentAt := time.Now()
+	for range tries + 1 {
+		written, err := src.Write(initial.data[:initialSize])
+		if err != nil {
+			return nil, transportParameters{}, 0, fmt.Errorf("failed to write to main connection: %w", err)
+		}
+		if written != initialSize {
+			return nil, transportParameters{}, 0, ErrPacketCorrupted
+		}
+
+		src.SetReadDeadline(time.Now().Add(resendDelay))
+		for {
+			n, err := src.Read(buf.data)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, transportParameters{}, 0, fmt.Errorf("failed to read from main connection: %w", err)
+			}
+
+			data := buf.data[:n]
+			if hs != nil {
+				data, err = hs.open(data)
+				if err != nil {
+					continue
+				}
+			}
+			p, err := decodePacket(data)
+			if err != nil || !p.isCommand || p.version != local.version && p.version != negotiationVersion {
+				continue
+			}
+			command, payload, err := commandPacketType(p)
+			if err != nil {
+				continue
+			}
+			switch command {
+			case commandVersions:
+				versions, err := decodeVersions(payload)
+				if err != nil || slices.Contains(versions, local.version) { // it is not an answer to our initial
+					continue
+				}
+				version, ok := bestCommonVersion(versions)
+				if !ok {
+					return nil, transportParameters{}, 0, fmt.Errorf("%w: peer supports %v", errUnsupportedVersion, versions)
+				}
+				if version >= local.version { // it should never move to better versions, so the negotiation ends
+					continue
+				}
+				local.version = version
+				return dialHandshake(src, local, hs, tries)
+			case commandAcceptConn:
+				cookie, params, err := decodeCookieAndParameters(payload)
+				if err != nil {
+					return nil, transportParameters{}, 0, err
+				}
+				err = params.validate(local.messages)
+				if err != nil {
+					return nil, transportParameters{}, 0, err
+				}
+				return bytes.Clone(cookie), params, time.Since(sentAt), nil
+			case commandCloseConn:
+				return nil, transportParameters{}, 0, errConnRefused
+			}
+		}
+
+		resendDelay *= 2
+	}
+	return nil, transportParameters{}, 0, errHandshakeTimeout
+}
+
+var _ MessageConn = (*dconn)(nil)
+
 type dconn struct {
 	*conn
 	addrSrc net.Conn
@@ -45,21 +241,6 @@ func (c *dconn) RemoteAddr() net.Addr {
 	return c.addrSrc.RemoteAddr()
 }
 
-// For now SUDP doesn't support deadline
-func (c *dconn) SetDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
-
-// For now SUDP doesn't support deadline
-func (c *dconn) SetReadDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
-
-// For now SUDP doesn't support deadline
-func (c *dconn) SetWriteDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
-
 func readToCh(dst chan reusable[[]byte], dstErr *error, src io.Reader) {
 	for {
 		buf := getPacketBuf()
@@ -72,7 +253,7 @@ func readToCh(dst chan reusable[[]byte], dstErr *error, src io.Reader) {
 		}
 		if len(dst) != cap(dst) {
 			buf.data = buf.data[:n]
-			dst <- buf
+			dst <- fitPacketBuf(buf)
 		} else { // if buffer is full, drop packet
 			buf.free()
 		}
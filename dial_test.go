@@ -2,8 +2,11 @@ package sudp
 
 import (
 	"bytes"
-	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -18,6 +21,150 @@ func TestDial(t *testing.T) {
 
 		assert.Error(err)
 	})
+
+	t.Run("Should be refused if nobody listens", func(t *testing.T) {
+		assert := assert.New(t)
+		src, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(err)
+		addr := src.LocalAddr().String()
+		assert.NoError(src.Close())
+
+		conn, err := Dial("udp", addr)
+
+		assert.Nil(conn)
+		assert.ErrorIs(err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("Should send confirm as the first packet", func(t *testing.T) {
+		assert := assert.New(t)
+		srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(err)
+		defer srv.Close()
+		cookie := bytes.Repeat([]byte{69}, cookieSize)
+		go func() {
+			buf := make([]byte, maxPacketSize)
+			_, addr, err := srv.ReadFromUDPAddrPort(buf)
+			assert.NoError(err)
+			n, err := acceptConnectionPacket(cookie, defaultOptions().transportParameters()).encode(buf)
+			assert.NoError(err)
+			_, err = srv.WriteToUDPAddrPort(buf[:n], addr)
+			assert.NoError(err)
+		}()
+
+		conn, err := Dial("udp", srv.LocalAddr().String())
+		assert.NoError(err)
+		defer conn.Close()
+
+		buf := make([]byte, maxPacketSize)
+		srv.SetReadDeadline(time.Now().Add(initialRTO))
+		n, err := srv.Read(buf)
+		assert.NoError(err)
+		p, err := decodePacket(buf[:n])
+		assert.NoError(err)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		assert.Equal(commandConfirmConn, tp)
+		assert.EqualValues(0, p.number)
+		confirmCookie, params, err := decodeCookieAndParameters(payload)
+		assert.NoError(err)
+		assert.Equal(cookie, confirmCookie)
+		assert.Equal(defaultOptions().transportParameters(), params)
+	})
+
+	t.Run("Should start the handshake again with the common version", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
+		src, err := net.Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		defer src.Close()
+		local := defaultOptions().transportParameters()
+		local.version = 5 // the listener doesn't support it
+
+		_, params, _, err := dialHandshake(src, local, nil, resendTries)
+
+		assert.NoError(err)
+		assert.EqualValues(protocolVersion, params.version)
+	})
+
+	t.Run("Should fail without common version", func(t *testing.T) {
+		assert := assert.New(t)
+		srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(err)
+		defer srv.Close()
+		go func() {
+			buf := make([]byte, maxPacketSize)
+			_, addr, err := srv.ReadFromUDPAddrPort(buf)
+			assert.NoError(err)
+			n, err := versionsPacket([]byte{7, 6}).encode(buf)
+			assert.NoError(err)
+			_, err = srv.WriteToUDPAddrPort(buf[:n], addr)
+			assert.NoError(err)
+		}()
+
+		conn, err := Dial("udp", srv.LocalAddr().String())
+
+		assert.Nil(conn)
+		assert.ErrorIs(err, errUnsupportedVersion)
+	})
+}
+
+func TestDialConfig(t *testing.T) {
+	t.Run("Should exchange data with tuned connections", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenConfig("udp", "127.0.0.1:0", &Config{ReadBuffer: 8, AckDelay: 5 * time.Millisecond, MaxAckDelay: 10 * time.Millisecond})
+		assert.NoError(err)
+		defer l.Close()
+		conn, err := DialConfig("udp", l.Addr().String(), &Config{ConnBuffer: 16, ResendTries: 5, MaxPacketSize: minPacketSize})
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+		data := bytes.Repeat([]byte{1, 2, 3}, 8*maxDataSize) // beyond the read buffer of the server
+
+		go func() {
+			_, err := conn.Write(data)
+			assert.NoError(err)
+		}()
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(srvConn, buf)
+		assert.NoError(err)
+		assert.Equal(data, buf)
+
+		rtt := conn.(*dconn).flight.rtt
+		rtt.mu.Lock()
+		assert.Equal(10*time.Millisecond, rtt.maxAckDelay, "timeouts should take delays of the peer")
+		rtt.mu.Unlock()
+		assert.LessOrEqual(conn.(*dconn).flight.packetSize(), minPacketSize)
+	})
+
+	t.Run("Listener should refuse connections beyond the backlog", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenConfig("udp", "127.0.0.1:0", &Config{AcceptBacklog: 1})
+		assert.NoError(err)
+		defer l.Close()
+
+		conn, err := DialConfig("udp", l.Addr().String(), nil)
+		assert.NoError(err)
+		defer conn.Close()
+		assert.Eventually(func() bool {
+			return len(l.(*listener).newConns) == 1
+		}, 10*initialRTO, 10*time.Millisecond, "connection should be confirmed")
+		_, err = DialConfig("udp", l.Addr().String(), nil)
+
+		assert.ErrorIs(err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("Should not accept invalid config", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := DialConfig("udp", "127.0.0.1:8090", &Config{ResendTries: -1})
+		assert.ErrorIs(err, ErrInvalidConfig)
+		_, err = ListenConfig("udp", "127.0.0.1:0", &Config{ReadBuffer: -1})
+		assert.ErrorIs(err, ErrInvalidConfig)
+	})
 }
 
 func TestDialConn_Close(t *testing.T) {
@@ -57,41 +204,438 @@ func TestDialConn_Close(t *testing.T) {
 		assert.Zero(n)
 		assert.ErrorIs(err, net.ErrClosed)
 	})
+
+	t.Run("Both sides should see the application error of reset", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := srvConn.Read(make([]byte, 8))
+			readErr <- err
+		}()
+
+		assert.NoError(conn.(Conn).CloseWithError(42, "auth failed"))
+
+		var appErr *ApplicationError
+		if assert.ErrorAs(<-readErr, &appErr) {
+			assert.Equal(&ApplicationError{Code: 42, Reason: "auth failed", Remote: true}, appErr)
+		}
+		_, err := srvConn.Write([]byte{1})
+		assert.ErrorAs(err, &appErr)
+		assert.ErrorIs(err, net.ErrClosed)
+		_, err = conn.Write([]byte{1})
+		if assert.ErrorAs(err, &appErr) {
+			assert.Equal(&ApplicationError{Code: 42, Reason: "auth failed"}, appErr)
+		}
+	})
+
+	t.Run("Peer should read all data written before close", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		var expected []byte
+		for i := range 100 {
+			msg := bytes.Repeat([]byte{byte(i)}, 100)
+			expected = append(expected, msg...)
+			_, err := conn.Write(msg)
+			assert.NoError(err)
+		}
+		assert.NoError(conn.Close())
+
+		var actual []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := srvConn.Read(buf)
+			actual = append(actual, buf[:n]...)
+			if err != nil {
+				assert.ErrorIs(err, io.EOF)
+				break
+			}
+		}
+		assert.Equal(expected, actual)
+	})
+
+	t.Run("Close with linger should block until fin is acknowledged", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(conn.(Conn).SetLinger(5))
+		start := time.Now()
+		assert.NoError(conn.Close())
+
+		assert.Less(time.Since(start), 5*time.Second)
+		assert.ErrorIs(conn.(*dconn).addrSrc.SetReadDeadline(time.Time{}), net.ErrClosed)
+		buf := make([]byte, 8)
+		n, _ := srvConn.Read(buf)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+	})
 }
 
 func TestDialConn_SetDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should time out reading and writing", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := dconn{}
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
 
-		err := conn.SetDeadline(time.Now())
+		assert.NoError(conn.SetDeadline(time.Now().Add(-time.Second)))
+		_, err := conn.Read(make([]byte, 8))
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+		_, err = conn.Write([]byte{1, 2, 3})
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		assert.NoError(conn.SetDeadline(time.Time{}))
+		_, err = conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		_, err = srvConn.Write([]byte{4, 5, 6})
+		assert.NoError(err)
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{4, 5, 6}, buf[:n])
+	})
+
+	t.Run("Should return error after close", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, _, closeAll := dialedPair(assert)
+		closeAll()
+
+		assert.ErrorIs(conn.SetDeadline(time.Now()), net.ErrClosed)
 	})
 }
 
 func TestDialConn_SetReadDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should unblock read with timeout error", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := dconn{}
+		conn, _, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		start := time.Now()
+		assert.NoError(conn.SetReadDeadline(start.Add(50 * time.Millisecond)))
+		n, err := conn.Read(make([]byte, 8))
 
-		err := conn.SetReadDeadline(time.Now())
+		assert.Zero(n)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+		var netErr net.Error
+		if assert.ErrorAs(err, &netErr) {
+			assert.True(netErr.Timeout())
+		}
+		assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("Should move deadline of blocked read", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, _, closeAll := dialedPair(assert)
+		defer closeAll()
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(time.Hour)))
+
+		start := time.Now()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			conn.SetReadDeadline(time.Now())
+		}()
+		_, err := conn.Read(make([]byte, 8))
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+		assert.Less(time.Since(start), time.Hour)
+	})
+
+	t.Run("Should read after deadline is cleared", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+		assert.NoError(conn.SetReadDeadline(time.Time{}))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			srvConn.Write([]byte{1, 2, 3})
+		}()
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
 	})
 }
 
 func TestDialConn_SetWriteDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should fail writing after deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		assert.NoError(conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)))
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		time.Sleep(100 * time.Millisecond)
+		n, err := conn.Write([]byte{4, 5, 6})
+		assert.Zero(n)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+
+		assert.NoError(conn.SetWriteDeadline(time.Now().Add(time.Hour)))
+		_, err = conn.Write([]byte{7, 8, 9})
+		assert.NoError(err)
+		buf := make([]byte, 8)
+		n, err = srvConn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+		n, err = srvConn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{7, 8, 9}, buf[:n])
+	})
+}
+
+// returns dialed connection and its accepted pair
+func TestDialMessages(t *testing.T) {
+	t.Run("Every message should be read entirely by single read", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenMessages("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
+		conn, err := DialMessages("udp", l.Addr().String())
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+		big := bytes.Repeat([]byte{1, 2, 3}, 3*maxDataSize)
+
+		for _, msg := range [][]byte{{1}, {2, 3}, big, {}, {4}} {
+			n, err := conn.WriteMessage(msg)
+			assert.NoError(err)
+			assert.Equal(len(msg), n)
+		}
+
+		buf := make([]byte, len(big)+1)
+		for _, msg := range [][]byte{{1}, {2, 3}, big, {}, {4}} {
+			n, err := srvConn.(MessageConn).ReadMessage(buf)
+			assert.NoError(err)
+			assert.Equal(msg, buf[:n])
+		}
+	})
+
+	t.Run("Should be refused by stream listener", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := dconn{}
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
 
-		err := conn.SetWriteDeadline(time.Now())
+		conn, err := DialMessages("udp", l.Addr().String())
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		assert.Nil(conn)
+		assert.ErrorIs(err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("Stream connection should not read messages", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, _, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		_, err := conn.(MessageConn).ReadMessage(make([]byte, 8))
+
+		assert.ErrorIs(err, ErrNotMessageMode)
 	})
 }
 
+func TestDialPSK(t *testing.T) {
+	t.Run("Should exchange data in both directions", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenPSK("udp", "127.0.0.1:0", testPSK)
+		assert.NoError(err)
+		defer l.Close()
+		conn, err := DialPSK("udp", l.Addr().String(), testPSK)
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+		data := bytes.Repeat([]byte{1, 2, 3}, 3*maxDataSize)
+
+		go func() {
+			_, err := conn.Write(data)
+			assert.NoError(err)
+		}()
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(srvConn, buf)
+		assert.NoError(err)
+		assert.Equal(data, buf)
+
+		_, err = srvConn.Write([]byte("Hello"))
+		assert.NoError(err)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("Hello"), buf[:n])
+	})
+
+	t.Run("Should exchange data with FEC", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenPSK("udp", "127.0.0.1:0", testPSK)
+		assert.NoError(err)
+		defer l.Close()
+		conn, err := DialPSK("udp", l.Addr().String(), testPSK)
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+		assert.NoError(conn.(Conn).SetFEC(4))
+		data := bytes.Repeat([]byte{1, 2, 3}, 3*maxDataSize)
+
+		go func() {
+			_, err := conn.Write(data)
+			assert.NoError(err)
+		}()
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(srvConn, buf)
+		assert.NoError(err)
+		assert.Equal(data, buf)
+	})
+
+	t.Run("Server should acknowledge resent confirm", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := ListenPSK("udp", "127.0.0.1:0", testPSK)
+		assert.NoError(err)
+		defer l.Close()
+		var (
+			fromServer   int
+			confirmSize  int
+			firstConfirm time.Time
+			resent       bool // after all acknowledgments of the first confirm are sent
+		)
+		addr, stop := udpProxy(assert, l.Addr().String(), func(fromClient bool, b []byte) bool {
+			if !fromClient {
+				fromServer++
+				return fromServer > 1 && !resent // the first one is accept
+			}
+			if confirmSize == 0 && fromServer != 0 {
+				confirmSize, firstConfirm = len(b), time.Now()
+			} else if len(b) == confirmSize && time.Since(firstConfirm) > rLongTime+20*time.Millisecond {
+				resent = true
+			}
+			return false
+		})
+		defer stop()
+
+		conn, err := DialConfig("udp", addr, &Config{PSK: testPSK, ResendTries: 1})
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+		time.Sleep(10 * minRTO) // the client would close without response
+
+		_, err = srvConn.Write([]byte("Hello"))
+		assert.NoError(err)
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("Hello"), buf[:n])
+	})
+
+	t.Run("Should not accept short key", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := DialPSK("udp", "127.0.0.1:8090", []byte{1, 2, 3})
+		assert.ErrorIs(err, ErrShortPSK)
+		_, err = ListenPSK("udp", "127.0.0.1:0", []byte{1, 2, 3})
+		assert.ErrorIs(err, ErrShortPSK)
+	})
+}
+
+func TestDialConn_Datagrams(t *testing.T) {
+	t.Run("Should exchange datagrams along with data", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		assert.NoError(conn.(Conn).SendDatagram([]byte{4, 5, 6}))
+
+		buf := make([]byte, 8)
+		n, err := srvConn.(Conn).ReceiveDatagram(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{4, 5, 6}, buf[:n])
+		n, err = srvConn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+	})
+
+	t.Run("Should fail receiving after close", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, _, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		assert.NoError(conn.Close())
+		_, err := conn.(Conn).ReceiveDatagram(make([]byte, 8))
+
+		assert.ErrorIs(err, net.ErrClosed)
+	})
+}
+
+func TestDialConn_Streams(t *testing.T) {
+	t.Run("Streams should be independent and half-closed", func(t *testing.T) {
+		assert := assert.New(t)
+		conn, srvConn, closeAll := dialedPair(assert)
+		defer closeAll()
+		big := bytes.Repeat([]byte{1, 2, 3}, 3*maxDataSize)
+
+		first, err := conn.(Conn).OpenStream()
+		assert.NoError(err)
+		second, err := srvConn.(Conn).OpenStream()
+		assert.NoError(err)
+		assert.EqualValues(0, first.StreamID())
+		assert.EqualValues(1, second.StreamID())
+		assert.Equal(conn.RemoteAddr(), first.RemoteAddr())
+
+		_, err = first.Write(big)
+		assert.NoError(err)
+		assert.NoError(first.CloseWrite())
+		_, err = second.Write([]byte("from server"))
+		assert.NoError(err)
+
+		srvFirst, err := srvConn.(Conn).AcceptStream()
+		assert.NoError(err)
+		data, err := io.ReadAll(srvFirst)
+		assert.NoError(err)
+		assert.Equal(big, data)
+		_, err = srvFirst.Write([]byte("reply"))
+		assert.NoError(err, "write side should stay open")
+		assert.NoError(srvFirst.Close())
+
+		data, err = io.ReadAll(first)
+		assert.NoError(err)
+		assert.Equal([]byte("reply"), data)
+
+		cliSecond, err := conn.(Conn).AcceptStream()
+		assert.NoError(err)
+		buf := make([]byte, 16)
+		n, err := cliSecond.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("from server"), buf[:n])
+	})
+}
+
+func dialedPair(assert *assert.Assertions) (net.Conn, net.Conn, func()) {
+	l, err := Listen("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	conn, err := Dial("udp", l.Addr().String())
+	assert.NoError(err)
+	srvConn, err := l.Accept()
+	assert.NoError(err)
+
+	return conn, srvConn, func() {
+		conn.Close()
+		srvConn.Close()
+		l.Close()
+	}
+}
+
 func periodicalServerMsg(assert *assert.Assertions, msg []byte, tickCount int, tick time.Duration) string {
 	l, err := Listen("udp", "127.0.0.1:0")
 	assert.NoError(err)
@@ -120,3 +664,59 @@ func periodicalServerMsg(assert *assert.Assertions, msg []byte, tickCount int, t
 
 	return l.Addr().String()
 }
+
+// udpProxy forwards packets between the first client and target,
+// drop is called by one goroutine at a time and reports whether the packet is lost
+func udpProxy(assert *assert.Assertions, target string, drop func(fromClient bool, b []byte) bool) (addr string, stop func()) {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	assert.NoError(err)
+	back, err := net.DialUDP("udp", nil, targetAddr)
+	assert.NoError(err)
+
+	var (
+		mu     sync.Mutex
+		client *net.UDPAddr
+	)
+	forward := func(fromClient bool, b []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !drop(fromClient, b)
+	}
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, from, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			client = from
+			mu.Unlock()
+			if forward(true, buf[:n]) {
+				back.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			to := client
+			mu.Unlock()
+			if forward(false, buf[:n]) {
+				front.WriteToUDP(buf[:n], to)
+			}
+		}
+	}()
+
+	return front.LocalAddr().String(), func() {
+		front.Close()
+		back.Close()
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package sudp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setDontFragment makes the kernel send packets with the don't-fragment bit
+// without limiting them by its own path mtu estimate,
+// so packets that are too big for the path are dropped and the discovery sees it (see pmtud.go)
+func setDontFragment(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	err = rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil { // one of them fails if the socket is of the other family
+		return errors.Join(err4, err6)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sudp
+
+import (
+	"errors"
+	"net"
+)
+
+// setDontFragment is not supported on this platform,
+// so packets are fragmented by the network and connections use minPacketSize
+func setDontFragment(c *net.UDPConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,301 @@
+package sudp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+/*
+	Forward error correction (see [Conn.SetFEC]):
+
+	Numbered packets are split into blocks of blockSize packets, the block starts at the number
+	that is a multiple of its size. After the last packet of the block the sender writes
+	the repair packet with the sum (XOR) of all packets of the block:
+
+	 | header (number of the first packet) | flag | count and command bit | length | sum of data |
+
+	Data of packets is summed after the header and padded with zeros to the longest one,
+	so the receiver that has the repair and all packets of the block except one
+	rebuilds the missing packet without waiting for its retransmission.
+	Blocks are formed only from packets that are sent for the first time,
+	the block is abandoned if any of its packets is not sent in order (e.g. close command).
+	Packets are smaller by fecReserve bytes, so the repair packet fits the path.
+	The receiver learns the size of blocks from repair packets,
+	so packets of the first block and of the first block after the change are not rebuilt.
+*/
+
+const (
+	maxFECBlockSize = 64 // received packets of the block are bits of uint64
+	// bytes of the repair header that don't fit the packet with the same data
+	fecReserve = repairHeaderSize - headerSize
+	// number of blocks the receiver keeps, the oldest are dropped
+	fecBlocksCap = 64
+)
+
+var ErrInvalidFECBlockSize = errors.New("fec block size should be zero or power of two from 2 to 64")
+
+func validFECBlockSize(size int) bool {
+	return size == 0 || size >= 2 && size <= maxFECBlockSize && size&(size-1) == 0
+}
+
+// fecWriter is the writer of groups, it sums written packets and writes repair packets
+type fecWriter struct {
+	w    io.Writer
+	room func() int // size of packets with the reserve
+
+	mu    sync.Mutex
+	size  int // zero if disabled
+	sent  bool
+	next  uint32 // the number after the newest sent packet
+	count int    // packets in the block, zero if there is no block
+	first uint32
+	sum   repair
+}
+
+func newFECWriter(w io.Writer, room func() int) *fecWriter {
+	return &fecWriter{w: w, room: room}
+}
+
+func (fw *fecWriter) setSize(size int) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.size, fw.count = size, 0
+	if size != 0 && fw.sum.sum == nil {
+		fw.sum.sum = make([]byte, 0, maxPacketSize-repairHeaderSize)
+	}
+}
+
+func (fw *fecWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.size == 0 || !fw.add(b) || fw.count < fw.size {
+		return n, nil
+	}
+	fw.count = 0
+	return n, fw.writeRepair()
+}
+
+// add sums the packet if it is the next packet of the block
+func (fw *fecWriter) add(b []byte) bool {
+	p, err := decodePacket(b)
+	if err != nil || isUnnumberedPacket(p) {
+		return false
+	}
+	if fw.sent && packetNumberDiff(p.number, fw.next) < 0 { // retransmission
+		return false
+	}
+	if fw.sent && p.number != fw.next { // the skipped packet is not summed
+		fw.count = 0
+	}
+	fw.sent, fw.next = true, nextPacketNumber(p.number)
+
+	if p.number%uint32(fw.size) == 0 {
+		fw.first, fw.count = p.number, 0
+		fw.sum = repair{count: fw.size, sum: fw.sum.sum[:0]}
+	} else if fw.count == 0 {
+		return false
+	}
+	if headerSize+fecReserve+max(len(p.data), len(fw.sum.sum)) > fw.room() {
+		fw.count = 0 // the repair doesn't fit the path
+		return false
+	}
+
+	fw.count++
+	fw.sum.isCommand = fw.sum.isCommand != p.isCommand
+	fw.sum.length ^= uint16(len(p.data))
+	if len(p.data) > len(fw.sum.sum) {
+		fw.sum.sum = append(fw.sum.sum, make([]byte, len(p.data)-len(fw.sum.sum))...)
+	}
+	xor(fw.sum.sum, p.data)
+	return true
+}
+
+func (fw *fecWriter) writeRepair() error {
+	p := repairPacket(fw.first, fw.sum)
+	buf := getBuf(p.len())
+	defer buf.free()
+	n, err := p.encode(buf.data)
+	if err != nil {
+		return err
+	}
+	written, err := fw.w.Write(buf.data[:n])
+	if err != nil {
+		return err
+	}
+	if written != n {
+		return ErrPacketCorrupted
+	}
+	return nil
+}
+
+func isUnnumberedPacket(p packet) bool {
+	if !p.isCommand {
+		return false
+	}
+	command, _, err := commandPacketType(p)
+	return err != nil || command.isUnnumbered()
+}
+
+// fecDecoder sums received packets of blocks and rebuilds lost ones,
+// it is used only by the reading goroutine of the connection
+type fecDecoder struct {
+	size   int // of blocks of the peer, zero until the first repair
+	blocks map[uint32]*fecBlock
+}
+
+type fecBlock struct {
+	received  uint64 // bits of received packets by their index in the block
+	repaired  bool   // the repair is added to the sum
+	isCommand bool
+	length    uint16
+	sum       reusable[[]byte] // of data, it becomes data of the rebuilt packet
+	width     int              // of the sum, the longest data
+}
+
+// received adds data of the new numbered packet to its block,
+// it returns the rebuilt packet if the packet completes the block
+func (d *fecDecoder) received(p packet) (reusable[packet], bool) {
+	if d.size == 0 {
+		return reusable[packet]{}, false
+	}
+	first := p.number &^ uint32(d.size-1)
+	b := d.block(first)
+	bit := uint64(1) << (p.number - first)
+	if b.received&bit != 0 {
+		return reusable[packet]{}, false
+	}
+	b.received |= bit
+	b.add(p.isCommand, len(p.data), p.data)
+	return d.rebuild(first, b)
+}
+
+// repair adds the repair packet to its block,
+// it returns the rebuilt packet if the repair completes the block
+func (d *fecDecoder) repair(first uint32, r repair) (reusable[packet], bool) {
+	d.resize(r.count)
+	if first%uint32(d.size) != 0 || len(r.sum) > maxPacketSize-headerSize {
+		return reusable[packet]{}, false
+	}
+	b := d.block(first)
+	if b.repaired {
+		return reusable[packet]{}, false
+	}
+	b.repaired = true
+	b.add(r.isCommand, int(r.length), r.sum)
+	return d.rebuild(first, b)
+}
+
+// resize drops blocks if the peer changed the size
+func (d *fecDecoder) resize(size int) {
+	if size != d.size {
+		d.reset()
+		d.size = size
+	}
+}
+
+func (d *fecDecoder) block(first uint32) *fecBlock {
+	if b, ok := d.blocks[first]; ok {
+		return b
+	}
+	if d.blocks == nil {
+		d.blocks = make(map[uint32]*fecBlock)
+	}
+	if len(d.blocks) >= fecBlocksCap {
+		oldest := first
+		for f := range d.blocks {
+			if packetNumberDiff(f, oldest) < 0 {
+				oldest = f
+			}
+		}
+		d.drop(oldest)
+	}
+	b := &fecBlock{sum: getPacketBuf()}
+	d.blocks[first] = b
+	return b
+}
+
+// rebuild returns the missing packet of the block if it is the only one,
+// the block is dropped when it is complete
+func (d *fecDecoder) rebuild(first uint32, b *fecBlock) (reusable[packet], bool) {
+	received := bits.OnesCount64(b.received)
+	if received == d.size {
+		d.drop(first)
+		return reusable[packet]{}, false
+	}
+	if received < d.size-1 || !b.repaired {
+		return reusable[packet]{}, false
+	}
+
+	delete(d.blocks, first) // the sum is freed with the rebuilt packet
+	index := bits.TrailingZeros64(^b.received)
+	if int(b.length) > b.width {
+		b.sum.free()
+		return reusable[packet]{}, false
+	}
+	return reusable[packet]{
+		data: packet{
+			header: header{
+				version:   protocolVersion,
+				isCommand: b.isCommand,
+				number:    addPacketNumber(first, index),
+			},
+			data: b.sum.data[:b.length],
+		},
+		free: b.sum.free,
+	}, true
+}
+
+func (d *fecDecoder) drop(first uint32) {
+	d.blocks[first].sum.free()
+	delete(d.blocks, first)
+}
+
+func (d *fecDecoder) reset() {
+	for first := range d.blocks {
+		d.drop(first)
+	}
+}
+
+func (b *fecBlock) add(isCommand bool, length int, data []byte) {
+	b.isCommand = b.isCommand != isCommand
+	b.length ^= uint16(length)
+	if len(data) > b.width {
+		clear(b.sum.data[b.width:len(data)])
+		b.width = len(data)
+	}
+	xor(b.sum.data, data)
+}
+
+// xor adds src to dst, which is not shorter
+func xor(dst, src []byte) {
+	for i, v := range src {
+		dst[i] ^= v
+	}
+}
+
+func (c *conn) SetFEC(blockSize int) error {
+	if !validFECBlockSize(blockSize) {
+		return fmt.Errorf("%w: %d", ErrInvalidFECBlockSize, blockSize)
+	}
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return clErr.(error)
+	}
+
+	if blockSize != 0 { // new packets fit with the repair before blocks are formed
+		c.flight.setReserve(fecReserve)
+		c.fec.setSize(blockSize)
+	} else {
+		c.fec.setSize(0)
+		c.flight.setReserve(0)
+	}
+	return nil
+}
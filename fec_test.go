@@ -0,0 +1,165 @@
+package sudp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFECWriter(t *testing.T) {
+	newWriter := func(size int) (*testWireBuffer, *fecWriter) {
+		w := &testWireBuffer{}
+		fw := newFECWriter(w, func() int { return minPacketSize })
+		fw.setSize(size)
+		return w, fw
+	}
+	write := func(assert *assert.Assertions, fw *fecWriter, ps ...packet) {
+		for _, p := range ps {
+			b := make([]byte, p.len())
+			n, err := p.encode(b)
+			assert.NoError(err)
+			_, err = fw.Write(b[:n])
+			assert.NoError(err)
+		}
+	}
+
+	t.Run("Lost packet should be rebuilt from repair", func(t *testing.T) {
+		assert := assert.New(t)
+		w, fw := newWriter(4)
+		block := []packet{dataPacket(4, []byte("Hello")), pingPacket(5), dataPacket(6, []byte("Hi")), finPacket(7)}
+
+		write(assert, fw, pingPacket(3))
+		write(assert, fw, block...)
+
+		if assert.Len(w.packets, 6) {
+			repairPv, err := decodePacket(w.packets[5])
+			assert.NoError(err)
+			assert.EqualValues(4, repairPv.number)
+			command, payload, err := commandPacketType(repairPv)
+			assert.NoError(err)
+			assert.Equal(commandRepair, command)
+			r, err := decodeRepair(payload)
+			assert.NoError(err)
+			assert.Equal(4, r.count)
+
+			for lost := range block {
+				var d fecDecoder
+				_, ok := d.repair(repairPv.number, r)
+				assert.False(ok)
+				var rebuilt reusable[packet]
+				for i, p := range block {
+					if i != lost {
+						assert.False(ok)
+						rebuilt, ok = d.received(p)
+					}
+				}
+				if assert.True(ok) {
+					assert.Equal(block[lost], rebuilt.data)
+					rebuilt.free()
+				}
+				assert.Empty(d.blocks, "complete block should be dropped")
+			}
+		}
+	})
+
+	t.Run("Retransmissions should not be summed", func(t *testing.T) {
+		assert := assert.New(t)
+		w, fw := newWriter(2)
+
+		write(assert, fw, dataPacket(0, []byte{1}), dataPacket(0, []byte{1}), dataPacket(1, []byte{2}))
+
+		if assert.Len(w.packets, 4) {
+			p, err := decodePacket(w.packets[3])
+			assert.NoError(err)
+			_, payload, _ := commandPacketType(p)
+			r, err := decodeRepair(payload)
+			assert.NoError(err)
+			assert.Equal([]byte{1 ^ 2}, r.sum)
+		}
+	})
+
+	t.Run("Block with skipped packet should be abandoned", func(t *testing.T) {
+		assert := assert.New(t)
+		w, fw := newWriter(2)
+
+		write(assert, fw, dataPacket(0, []byte{1}), dataPacket(3, []byte{2}), dataPacket(4, []byte{3}), dataPacket(5, []byte{4}))
+
+		if assert.Len(w.packets, 5) {
+			p, err := decodePacket(w.packets[4])
+			assert.NoError(err)
+			assert.True(p.isCommand)
+			assert.EqualValues(4, p.number)
+		}
+	})
+
+	t.Run("Block should be abandoned if the repair doesn't fit the path", func(t *testing.T) {
+		assert := assert.New(t)
+		w, fw := newWriter(2)
+
+		write(assert, fw, dataPacket(0, make([]byte, minPacketSize-headerSize)), dataPacket(1, []byte{1}))
+
+		assert.Len(w.packets, 2)
+	})
+
+	t.Run("Unnumbered commands should not be summed", func(t *testing.T) {
+		assert := assert.New(t)
+		w, fw := newWriter(2)
+
+		write(assert, fw, dataPacket(0, []byte{1}), finAckPacket(0), dataPacket(1, []byte{2}))
+
+		assert.Len(w.packets, 4)
+	})
+}
+
+func TestFECDecoder(t *testing.T) {
+	t.Run("Should rebuild only the single lost packet", func(t *testing.T) {
+		assert := assert.New(t)
+		var d fecDecoder
+		d.size = 4
+
+		d.received(dataPacket(9, []byte{1}))
+		d.received(dataPacket(10, []byte{2}))
+		_, ok := d.repair(8, repair{count: 4, length: 1 ^ 1 ^ 1 ^ 1, sum: []byte{1 ^ 2 ^ 3 ^ 4}})
+		assert.False(ok)
+
+		rebuilt, ok := d.received(dataPacket(11, []byte{3}))
+		if assert.True(ok) {
+			assert.EqualValues(8, rebuilt.data.number)
+			assert.False(rebuilt.data.isCommand)
+			assert.Equal([]byte{4}, rebuilt.data.data)
+			rebuilt.free()
+		}
+		assert.Empty(d.blocks)
+	})
+
+	t.Run("Should reset blocks when size of the peer changes", func(t *testing.T) {
+		assert := assert.New(t)
+		var d fecDecoder
+
+		d.received(dataPacket(1, []byte{1}))
+		assert.Empty(d.blocks, "size is not known yet")
+		d.repair(0, repair{count: 2, sum: []byte{}})
+		d.received(dataPacket(2, []byte{1}))
+		assert.Len(d.blocks, 2)
+
+		_, ok := d.repair(4, repair{count: 4, sum: []byte{}})
+		assert.False(ok)
+		assert.Equal(4, d.size)
+		assert.Len(d.blocks, 1)
+	})
+
+	t.Run("Number of kept blocks should be limited", func(t *testing.T) {
+		assert := assert.New(t)
+		var d fecDecoder
+		d.size = 2
+
+		for i := range 2 * fecBlocksCap {
+			d.received(dataPacket(uint32(2*i), []byte{1}))
+		}
+
+		assert.Len(d.blocks, fecBlocksCap)
+		assert.NotContains(d.blocks, uint32(0), "the oldest block should be dropped")
+		d.reset()
+		assert.Empty(d.blocks)
+	})
+}
@@ -0,0 +1,356 @@
+package sudp
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// a packet is lost when this number of later packets is acknowledged (like in RFC 9002)
+	packetThreshold = 3
+	// or when a later packet is acknowledged and it was sent this part of rtt earlier
+	timeThreshold = 9.0 / 8
+)
+
+type sentPacket struct {
+	number        uint32
+	size          int
+	at            time.Time
+	retransmitted bool
+	group         *group // resends the packet, nil if it is not resent
+}
+
+// flight tracks packets that are sent but not acknowledged yet,
+// it takes rtt samples from their acknowledgments
+// and limits sending by the window of the congestion controller
+// and by the limit of the receiver (flow control).
+// It resends lost packets before their groups time out:
+// the ones that are missing in acknowledgments (fast retransmit)
+// and the last one if acknowledgments stop coming (tail-loss probe).
+// It is shared by all groups of the connection.
+type flight struct {
+	rtt   *rttStats
+	probe *time.Timer
+
+	mu            sync.Mutex
+	cc            CongestionController
+	bytes         int           // sent but not acknowledged
+	packets       []sentPacket  // ordered by packet numbers
+	recoveryStart time.Time     // losses of packets sent before it belong to the same loss event
+	limit         uint32        // the last packet number that the peer is ready to receive
+	pmtu          int           // size of full packets on the wire (see pmtud.go)
+	overhead      int           // bytes added to packets on the wire (see psk.go), it is set before the connection is used
+	reserve       int           // bytes left for repair packets (see fec.go)
+	maxRate       int           // configured limit of the pacing rate, zero if none
+	stopped       bool          // the connection is torn down, packets are not probed
+	changed       chan struct{} // closed and replaced when the window may have room
+}
+
+func newFlight() *flight {
+	f := &flight{
+		rtt:     newRTTStats(),
+		cc:      defaultCongestionController(),
+		limit:   userCap - 1, // until the peer tells its limit, it is assumed to be the same as ours
+		pmtu:    minPacketSize,
+		changed: make(chan struct{}),
+	}
+	f.probe = time.AfterFunc(time.Hour, f.probeTFunc)
+	f.probe.Stop()
+	return f
+}
+
+// packets sent not in order of their numbers are not tracked
+func (f *flight) sent(g *group, number uint32, size int, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.packets) != 0 && packetNumberDiff(number, f.packets[len(f.packets)-1].number) <= 0 {
+		return
+	}
+	f.packets = append(f.packets, sentPacket{number: number, size: size, at: now, group: g})
+	f.bytes += size
+	f.lockedArmProbe()
+}
+
+func (f *flight) retransmitted(number uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if i, ok := f.find(number); ok {
+		f.packets[i].retransmitted = true
+	}
+}
+
+// lost starts a new loss event if the packet was sent after the previous one started,
+// so the window is reduced only once for the packets lost together
+func (f *flight) lost(number uint32, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if i, ok := f.find(number); ok {
+		f.lockedLost(i, now)
+	}
+}
+
+func (f *flight) lockedLost(i int, now time.Time) {
+	if !f.packets[i].at.After(f.recoveryStart) {
+		return
+	}
+	f.recoveryStart = now
+	f.cc.OnLoss(now)
+}
+
+// acked removes acknowledged packets and takes the rtt sample from the newest of them,
+// ackDelay is the time the receiver held the acknowledgment after receiving it.
+// Packets that are considered lost because of later acknowledged packets are resent in the background.
+func (f *flight) acked(received []rng[uint32], ackDelay time.Duration, now time.Time) {
+	if len(received) == 0 {
+		return
+	}
+	newest := received[len(received)-1][1]
+
+	f.mu.Lock()
+
+	var ackedBytes int
+	notAcked := f.packets[:0]
+	ri := 0
+	for _, p := range f.packets {
+		for ri < len(received) && packetNumberDiff(received[ri][1], p.number) < 0 {
+			ri++
+		}
+		if ri == len(received) || !received[ri].inFunc(p.number, packetNumberDiff) {
+			notAcked = append(notAcked, p)
+			continue
+		}
+
+		f.bytes -= p.size
+		if p.at.After(f.recoveryStart) { // window doesn't grow in recovery
+			ackedBytes += p.size
+		}
+		if p.number == newest && !p.retransmitted {
+			f.rtt.addSample(now.Sub(p.at), ackDelay)
+		}
+	}
+	clear(f.packets[len(notAcked):])
+	f.packets = notAcked
+
+	if ackedBytes != 0 {
+		f.cc.OnAck(ackedBytes, f.rtt.smoothed(), now)
+	}
+	lost := f.lockedDetectLost(newest, now)
+	f.lockedArmProbe()
+	f.notify()
+	f.mu.Unlock()
+
+	if len(lost) != 0 { // resends are paced, so they don't block the reading goroutine
+		go func() {
+			for _, p := range lost {
+				p.group.resend(p.number)
+			}
+		}()
+	}
+}
+
+// lockedDetectLost marks packets before newest acknowledged one as lost (RFC 9002)
+// and returns the ones that should be resent now
+func (f *flight) lockedDetectLost(newest uint32, now time.Time) (lost []sentPacket) {
+	lossDelay := max(time.Duration(timeThreshold*float64(f.rtt.smoothed())), rttGranularity)
+	for i := range f.packets {
+		p := &f.packets[i]
+		if packetNumberDiff(newest, p.number) <= 0 {
+			break
+		}
+		if p.retransmitted { // it is already resent, the group will check it
+			continue
+		}
+		if packetNumberDiff(newest, p.number) < packetThreshold && now.Sub(p.at) < lossDelay {
+			continue
+		}
+
+		f.lockedLost(i, now)
+		p.retransmitted = true
+		if p.group != nil {
+			lost = append(lost, *p)
+		}
+	}
+	return lost
+}
+
+// the probe is restarted when packets are sent or acknowledged,
+// without the sample the group timeouts are used
+func (f *flight) lockedArmProbe() {
+	if pto, ok := f.rtt.probeTimeout(); ok && len(f.packets) != 0 && !f.stopped {
+		f.probe.Reset(pto)
+	} else {
+		f.probe.Stop()
+	}
+}
+
+// probeTFunc resends the last packet, so its acknowledgment shows
+// what packets of the tail are lost, instead of waiting for the timeout of the group
+func (f *flight) probeTFunc() {
+	f.mu.Lock()
+	if len(f.packets) == 0 || f.packets[len(f.packets)-1].retransmitted { // the group will check it
+		f.mu.Unlock()
+		return
+	}
+	p := &f.packets[len(f.packets)-1]
+	p.retransmitted = true
+	g, number := p.group, p.number
+	f.mu.Unlock()
+
+	if g != nil {
+		g.resend(number)
+	}
+}
+
+// abandoned removes the packet that is not resent anymore, so it doesn't take the window
+func (f *flight) abandoned(number uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, ok := f.find(number)
+	if !ok {
+		return
+	}
+	f.bytes -= f.packets[i].size
+	f.packets = slices.Delete(f.packets, i, i+1)
+	f.lockedArmProbe()
+	f.notify()
+}
+
+// hasRoom reports whether the packet of size bytes fits into the congestion window,
+// it is used for packets which are not tracked, because they are not acknowledged
+func (f *flight) hasRoom(size int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bytes == 0 || f.cc.Window()-f.bytes >= size
+}
+
+// initLimit sets the limit of the receiver before the first packet is sent
+func (f *flight) initLimit(limit uint32) {
+	f.mu.Lock()
+	f.limit = limit
+	f.mu.Unlock()
+}
+
+// setLimit updates the limit of the receiver, it can only grow
+func (f *flight) setLimit(limit uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if packetNumberDiff(limit, f.limit) > 0 {
+		f.limit = limit
+		f.notify()
+	}
+}
+
+// available returns how many bytes may be sent now if the next packet number is next
+// and the channel that is closed when it may change,
+// at least one packet may be sent if nothing is in flight.
+// flowLimited reports that the room is limited by the receiver, not by the congestion window.
+func (f *flight) available(next uint32) (room int, flowLimited bool, changed <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	room = f.cc.Window() - f.bytes
+	if f.bytes == 0 {
+		room = max(room, f.pmtu)
+	}
+	if flowRoom := (packetNumberDiff(f.limit, next) + 1) * f.pmtu; flowRoom < room {
+		return max(flowRoom, 0), true, f.changed
+	}
+	return room, false, f.changed
+}
+
+// setPacketSize is called when the bigger packet size is confirmed for the path
+func (f *flight) setPacketSize(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size > f.pmtu {
+		f.pmtu = size
+		f.notify()
+	}
+}
+
+// packetSize returns the size of full packets before they are sealed
+func (f *flight) packetSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pmtu - f.overhead - f.reserve
+}
+
+// repairSize returns the size of repair packets before they are sealed (see fec.go)
+func (f *flight) repairSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pmtu - f.overhead
+}
+
+func (f *flight) setReserve(reserve int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reserve = reserve
+}
+
+// pacingRate returns the rate of the congestion controller limited by the configured one,
+// zero means without pacing
+func (f *flight) pacingRate() int {
+	srtt := f.rtt.smoothed()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rate := f.cc.PacingRate(srtt)
+	if f.maxRate > 0 && (rate <= 0 || rate > f.maxRate) {
+		return f.maxRate
+	}
+	return rate
+}
+
+func (f *flight) setMaxPacingRate(rate int) {
+	f.mu.Lock()
+	f.maxRate = max(rate, 0)
+	f.mu.Unlock()
+}
+
+func (f *flight) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	f.probe.Stop()
+}
+
+func (f *flight) setController(cc CongestionController) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cc = cc
+	f.notify()
+}
+
+func (f *flight) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *flight) find(number uint32) (int, bool) {
+	i, ok := slices.BinarySearchFunc(f.packets, number, func(p sentPacket, number uint32) int {
+		return packetNumberDiff(p.number, number)
+	})
+	return i, ok
+}
+
+// fitWindow returns how much of data may be sent in room bytes of the window,
+// the window is filled only with full packets of packetSize except the last packet of data
+func fitWindow(room, data, packetSize int) int {
+	dataSize := packetSize - headerSize
+	packets := (data + dataSize - 1) / dataSize
+	if data+packets*headerSize <= room {
+		return data
+	}
+	return max(room, 0) / packetSize * dataSize
+}
@@ -0,0 +1,314 @@
+package sudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlight_Acked(t *testing.T) {
+	t.Run("Should take sample from the newest acknowledged packet excluding ack delay", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.rtt.addSample(100*time.Millisecond, 0)
+		now := time.Now()
+
+		f.sent(nil, 10, 100, now)
+		f.sent(nil, 11, 100, now.Add(50*time.Millisecond))
+		f.sent(nil, 12, 100, now.Add(100*time.Millisecond))
+		f.acked([]rng[uint32]{{10, 11}}, 20*time.Millisecond, now.Add(170*time.Millisecond))
+
+		// sample is 170 - 50 - 20 = 100ms
+		assert.Equal(100*time.Millisecond, f.rtt.smoothed())
+		assert.Equal(100, f.bytes)
+		assert.Len(f.packets, 1)
+		assert.EqualValues(12, f.packets[0].number)
+	})
+
+	t.Run("Should keep packets in gaps", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		now := time.Now()
+
+		for i := range uint32(6) {
+			f.sent(nil, i, 100, now)
+		}
+		f.acked([]rng[uint32]{{0, 1}, {3, 3}, {5, 5}}, 0, now)
+
+		assert.Equal(200, f.bytes)
+		assert.Len(f.packets, 2)
+		assert.EqualValues(2, f.packets[0].number)
+		assert.EqualValues(4, f.packets[1].number)
+	})
+
+	t.Run("Should not take sample from retransmitted packet", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		now := time.Now()
+
+		f.sent(nil, maxPacketNumber, 100, now)
+		f.sent(nil, 0, 100, now)
+		f.retransmitted(0)
+		f.acked([]rng[uint32]{{maxPacketNumber, 0}}, 0, now.Add(time.Second))
+
+		assert.False(f.rtt.hasSample)
+		assert.Empty(f.packets)
+		assert.Zero(f.bytes)
+	})
+
+	t.Run("Should take sample only once", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		now := time.Now()
+
+		f.sent(nil, 0, 100, now)
+		f.acked([]rng[uint32]{{0, 0}}, 0, now.Add(200*time.Millisecond))
+		f.acked([]rng[uint32]{{0, 0}}, 0, now.Add(time.Second))
+
+		assert.Equal(200*time.Millisecond, f.rtt.smoothed())
+	})
+
+	t.Run("Should report acknowledged bytes to congestion controller", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		cc := &testCongestionController{window: initialWindow}
+		f.setController(cc)
+		now := time.Now()
+
+		f.sent(nil, 0, 100, now)
+		f.sent(nil, 1, 200, now)
+		f.sent(nil, 2, 300, now)
+		f.acked([]rng[uint32]{{0, 0}, {2, 2}}, 0, now)
+
+		assert.Equal(400, cc.acked)
+	})
+}
+
+func TestFlight_Lost(t *testing.T) {
+	t.Run("Packets lost together should be one loss event", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		cc := &testCongestionController{window: initialWindow}
+		f.setController(cc)
+		now := time.Now()
+
+		f.sent(nil, 0, 100, now)
+		f.sent(nil, 1, 100, now)
+		f.lost(0, now.Add(time.Second))
+		f.lost(1, now.Add(2*time.Second))
+		assert.Equal(1, cc.losses)
+
+		f.sent(nil, 2, 100, now.Add(3*time.Second))
+		f.lost(2, now.Add(4*time.Second))
+		assert.Equal(2, cc.losses)
+	})
+
+	t.Run("Packets acknowledged in recovery should not grow window", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		cc := &testCongestionController{window: initialWindow}
+		f.setController(cc)
+		now := time.Now()
+
+		f.sent(nil, 0, 100, now)
+		f.sent(nil, 1, 100, now)
+		f.lost(0, now.Add(time.Second))
+		f.sent(nil, 2, 100, now.Add(2*time.Second))
+		f.acked([]rng[uint32]{{0, 2}}, 0, now.Add(3*time.Second))
+
+		assert.Equal(100, cc.acked)
+		assert.Zero(f.bytes)
+	})
+}
+
+func TestFlight_DetectLost(t *testing.T) {
+	t.Run("Packet should be lost when three later packets are acknowledged", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		cc := &testCongestionController{window: initialWindow}
+		f.setController(cc)
+		now := time.Now()
+
+		for i := range uint32(5) {
+			f.sent(nil, i, 100, now)
+		}
+		f.acked([]rng[uint32]{{1, 2}}, 0, now)
+		assert.False(f.packets[0].retransmitted, "two later packets are not enough")
+		f.acked([]rng[uint32]{{1, 3}}, 0, now)
+
+		assert.True(f.packets[0].retransmitted)
+		assert.False(f.packets[1].retransmitted)
+		assert.Equal(1, cc.losses)
+	})
+
+	t.Run("Packet should be lost when later packet is acknowledged long after it was sent", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.rtt.addSample(100*time.Millisecond, 0)
+		now := time.Now()
+
+		f.sent(nil, 0, 100, now)
+		f.sent(nil, 1, 100, now.Add(10*time.Millisecond))
+		f.acked([]rng[uint32]{{1, 1}}, 0, now.Add(20*time.Millisecond))
+		assert.False(f.packets[0].retransmitted)
+		f.acked([]rng[uint32]{{1, 1}}, 0, now.Add(200*time.Millisecond))
+
+		assert.True(f.packets[0].retransmitted)
+	})
+}
+
+func TestFlight_Available(t *testing.T) {
+	t.Run("Should limit bytes in flight by window", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.setController(&testCongestionController{window: 3 * minPacketSize})
+		now := time.Now()
+
+		room, _, _ := f.available(0)
+		assert.Equal(3*minPacketSize, room)
+
+		f.sent(nil, 0, minPacketSize, now)
+		f.sent(nil, 1, minPacketSize, now)
+		f.sent(nil, 2, minPacketSize, now)
+		room, _, changed := f.available(3)
+		assert.Zero(room)
+
+		f.acked([]rng[uint32]{{0, 0}}, 0, now)
+		assert.True(isClosed(changed), "waiting writers should be notified")
+		room, _, _ = f.available(3)
+		assert.Equal(minPacketSize, room)
+	})
+
+	t.Run("Should allow one packet when nothing is in flight", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.setController(&testCongestionController{window: 0})
+
+		room, _, _ := f.available(0)
+		assert.Equal(minPacketSize, room)
+	})
+
+	t.Run("Should limit room by receiver limit", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.initLimit(maxPacketNumber) // the limit wraps around
+
+		room, flowLimited, _ := f.available(maxPacketNumber - 1)
+		assert.Equal(2*minPacketSize, room)
+		assert.True(flowLimited)
+
+		room, flowLimited, changed := f.available(0)
+		assert.Zero(room)
+		assert.True(flowLimited)
+
+		f.setLimit(maxPacketNumber - 5)
+		assert.False(isClosed(changed), "limit should not shrink")
+		f.setLimit(1)
+		assert.True(isClosed(changed), "waiting writers should be notified")
+		room, _, _ = f.available(0)
+		assert.Equal(2*minPacketSize, room)
+	})
+
+	t.Run("Should count packets of discovered size", func(t *testing.T) {
+		assert := assert.New(t)
+		f := newTestFlight(t)
+		f.setController(&testCongestionController{window: 0})
+		f.initLimit(1)
+		_, _, changed := f.available(0)
+
+		f.setPacketSize(ethernetPacketSize)
+		assert.True(isClosed(changed), "waiting writers should be notified")
+		f.setPacketSize(minPacketSize)
+
+		assert.Equal(ethernetPacketSize, f.packetSize(), "size should not shrink")
+		room, _, _ := f.available(0)
+		assert.Equal(ethernetPacketSize, room)
+		room, _, _ = f.available(1)
+		assert.Equal(ethernetPacketSize, room)
+	})
+}
+
+func TestFlight_Abandoned(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFlight(t)
+	f.setController(&testCongestionController{window: 4 * minPacketSize})
+	now := time.Now()
+	for i := range 3 {
+		f.sent(nil, uint32(i), minPacketSize, now)
+	}
+
+	f.abandoned(1)
+	f.abandoned(7) // not sent
+
+	assert.Equal(2*minPacketSize, f.bytes)
+	if assert.Len(f.packets, 2) {
+		assert.EqualValues(0, f.packets[0].number)
+		assert.EqualValues(2, f.packets[1].number)
+	}
+	room, _, _ := f.available(3)
+	assert.Equal(2*minPacketSize, room, "abandoned packet should not take the window")
+}
+
+func TestFlight_HasRoom(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFlight(t)
+	f.setController(&testCongestionController{window: minPacketSize})
+
+	assert.True(f.hasRoom(2*minPacketSize), "should allow packet when nothing is in flight")
+	f.sent(nil, 0, minPacketSize/2, time.Now())
+	assert.True(f.hasRoom(minPacketSize / 2))
+	assert.False(f.hasRoom(minPacketSize/2 + 1))
+}
+
+func TestFlight_PacingRate(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFlight(t)
+	f.rtt.addSample(100*time.Millisecond, 0)
+	rate := f.cc.PacingRate(f.rtt.smoothed())
+	assert.Positive(rate)
+
+	f.setMaxPacingRate(rate / 2)
+	assert.Equal(rate/2, f.pacingRate())
+	f.setMaxPacingRate(2 * rate)
+	assert.Equal(rate, f.pacingRate(), "limit should not raise the rate")
+	f.setController(&testCongestionController{window: initialWindow})
+	assert.Equal(2*rate, f.pacingRate(), "limit should pace controller without pacing")
+	f.setMaxPacingRate(0)
+	assert.Zero(f.pacingRate())
+}
+
+func TestFitWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(10, fitWindow(maxPacketSize, 10, maxPacketSize))
+	assert.Equal(maxDataSize, fitWindow(maxPacketSize, maxDataSize, maxPacketSize))
+	assert.Equal(maxDataSize, fitWindow(maxPacketSize, maxDataSize+1, maxPacketSize))
+	assert.Equal(2*maxDataSize+1, fitWindow(3*maxPacketSize, 2*maxDataSize+1, maxPacketSize))
+	assert.Equal(2*maxDataSize, fitWindow(3*maxPacketSize-1, 3*maxDataSize, maxPacketSize))
+	assert.Equal(2*minDataSize, fitWindow(2*minPacketSize+1, 3*minDataSize, minPacketSize))
+	assert.Zero(fitWindow(headerSize+9, 10, maxPacketSize))
+	assert.Zero(fitWindow(-maxPacketSize, 10, maxPacketSize))
+	assert.Zero(fitWindow(0, 0, maxPacketSize))
+}
+
+// probes of the flight are stopped after the test, so they don't race with it
+func newTestFlight(t *testing.T) *flight {
+	f := newFlight()
+	t.Cleanup(f.stop)
+	return f
+}
+
+type testCongestionController struct {
+	window int
+	acked  int
+	losses int
+}
+
+func (c *testCongestionController) Window() int { return c.window }
+
+func (c *testCongestionController) OnAck(acked int, _ time.Duration, _ time.Time) { c.acked += acked }
+
+func (c *testCongestionController) OnLoss(_ time.Time) { c.losses++ }
+
+func (c *testCongestionController) PacingRate(_ time.Duration) int { return 0 }
@@ -8,34 +8,33 @@ import (
 	"time"
 )
 
-// Since creating the logic for analyzing connections and dynamically changing message wait times
-// would take as much code as the main logic,
-// it was decided to take the average time it takes for a message to ping over relatively long distances
-// (source: Gemini)
-const (
-	deliveryDelay = 100 * time.Millisecond
-	sShortTime    = rShortTime + deliveryDelay
-	sLongTime     = rLongTime + deliveryDelay
-
-	// will see if this is sufficient through further testing
-	resendTries = 3
-)
+// default number of resends before the connection is closed (see [Config.ResendTries]),
+// will see if this is sufficient through further testing
+const resendTries = 3
 
 // In order not to overload the connection by saving all groups,
 // the responsibility for stopping was transferred to the channel,
 // and successfully sent packets are transmitted via a link to their list.
 type group struct {
 	w         io.Writer
+	paced     pacedWriter // w if it paces packets, nil otherwise
 	closeConn func()
+	abandon   func(numbers []uint32)
+	flight    *flight
 
-	short  *time.Timer
-	long   *time.Timer
+	// the group accepts new packets until window ends after its creation,
+	// packets are checked when rto passes after the last of them
+	window time.Time
+	rto    time.Duration // timeout of the check
+	check  *time.Timer
 	stopCh <-chan struct{}
+	tries  int // resends before closeConn
 
 	sendedMu   *sync.RWMutex
 	sended     *[]rng[uint32]
 	packetsMu  sync.Mutex
 	packets    []reusable[[]byte] // mark sent messages by setting them to nil
+	expires    []time.Time        // when packets are abandoned, zero if never
 	nextPacket uint32
 }
 
@@ -46,80 +45,182 @@ type group struct {
 //
 // - closeConn will be called when some packets fail to be sent even after attempts
 //
+// - abandon will be called with packets that are not resent, because their lifetime is over
+//
 // - To stop the group, you need to close stop channel.
 //
+// - With flight, the group tracks sent packets, takes timeouts from their delivery time and reports losses
+//
 // - With sended, the group will periodically take a list of messages that have already been received by the recipient
 //
 // - nextPacket - the number of the first packet in the group
-func newGroup(w io.Writer, closeConn func(), stop <-chan struct{}, sendedMu *sync.RWMutex, sended *[]rng[uint32], nextPacket uint32) *group {
+//
+// - tries - how many times packets are resent before closeConn is called
+func newGroup(w io.Writer, closeConn func(), abandon func(numbers []uint32), stop <-chan struct{}, flight *flight, sendedMu *sync.RWMutex, sended *[]rng[uint32], nextPacket uint32, tries int) *group {
+	rto := flight.rtt.rto()
 	g := &group{
 		w:         w,
 		closeConn: closeConn,
+		abandon:   abandon,
+		flight:    flight,
 
+		// half of rto, so the first packet waits for the check not longer than 1.5 rto
+		window: time.Now().Add(rto / 2),
+		rto:    rto,
 		stopCh: stop,
+		tries:  tries,
 
 		sendedMu:   sendedMu,
 		sended:     sended,
 		nextPacket: nextPacket,
 	}
 
-	g.short = time.AfterFunc(sShortTime, g.shortTFunc)
-	g.long = time.AfterFunc(sLongTime, g.longTFunc)
+	g.paced, _ = w.(pacedWriter)
+	g.check = time.AfterFunc(rto, g.resendUnconfirmed)
 	return g
 }
 
+// pacedWriter is implemented by [pacer],
+// the group waits for the pacing rate without holding its packets,
+// so acknowledgments and resends are not blocked while the burst is written
+type pacedWriter interface {
+	wait(size int) error
+	writeNow(b []byte) (int, error)
+}
+
 // ok indicates whether the group can accept new packets
 func (g *group) appendAndSend(data []byte) (ok bool, n int, err error) {
-	g.packetsMu.Lock()
-	defer g.packetsMu.Unlock()
+	// no need in copying data because it will be realocated
+	return g.appendAndSendFunc(func(nextPacket uint32) ([]packet, uint32) {
+		return dataIntoPackets(nextPacket, data, g.flight.packetSize()-headerSize)
+	}, 0, time.Time{})
+}
+
+// [group.appendAndSendMessage] works like [group.appendAndSend],
+// but data is the part of the message
+func (g *group) appendAndSendMessage(data []byte, part writePart) (ok bool, n int, err error) {
+	return g.appendAndSendFunc(func(nextPacket uint32) ([]packet, uint32) {
+		return messageIntoPackets(nextPacket, data, g.flight.packetSize()-headerSize, part.first, part.last)
+	}, fragmentHeaderSize, part.expires)
+}
+
+// [group.appendAndSendStream] works like [group.appendAndSend],
+// but data belongs to the stream s and takes its sequence numbers
+func (g *group) appendAndSendStream(data []byte, s *stream) (ok bool, n int, err error) {
+	return g.appendAndSendFunc(func(nextPacket uint32) ([]packet, uint32) {
+		ps, next, nextSeq := streamIntoPackets(nextPacket, s.id, s.nextSeq, data, g.flight.packetSize()-headerSize)
+		s.nextSeq = nextSeq
+		return ps, next
+	}, streamHeaderSize, time.Time{})
+}
 
-	if !g.short.Reset(sShortTime) {
-		g.short.Stop()
+// [group.appendAndSendCommand] works like [group.appendAndSend],
+// but sends a single command packet created by newPacket
+func (g *group) appendAndSendCommand(newPacket func(number uint32) packet) (ok bool, err error) {
+	ok, _, err = g.appendAndSendFunc(func(nextPacket uint32) ([]packet, uint32) {
+		return []packet{newPacket(nextPacket)}, nextPacketNumber(nextPacket)
+	}, 0, time.Time{})
+	return ok, err
+}
+
+// n counts data of packets without the header of every packet (e.g. fragment flags),
+// packets are abandoned after expires, zero means never.
+// Packets are recorded before they are written, so they are written without holding the group
+func (g *group) appendAndSendFunc(newPackets func(nextPacket uint32) ([]packet, uint32), header int, expires time.Time) (ok bool, n int, err error) {
+	g.packetsMu.Lock()
+	now := time.Now()
+	if now.After(g.window) {
+		g.packetsMu.Unlock()
+		return false, 0, nil
+	}
+	g.rto = g.flight.rtt.rto()
+	if !g.check.Reset(g.rto) { // check is already started
+		g.check.Stop()
+		g.packetsMu.Unlock()
 		return false, 0, nil
 	}
 
-	// no need in copying data because it will be realocated
-
-	ps, nextPacket := dataIntoPackets(g.nextPacket, data)
+	ps, nextPacket := newPackets(g.nextPacket)
 	g.packets = slices.Grow(g.packets, len(ps))
 	for _, p := range ps {
-		buf := getPacketBuf()
+		buf := getBuf(p.len())
 		packetSize, err := p.encode(buf.data)
 		if err != nil { // should never happen
 			panic(err)
 		}
 		buf.data = buf.data[:packetSize]
 
-		written, err := g.w.Write(buf.data)
-		if err != nil {
-			buf.free()
-			return true, 0, fmt.Errorf("failed to write to main connection: %w", err)
-		}
-		if written != packetSize {
-			buf.free()
-			return true, 0, ErrPacketCorrupted
-		}
-		n += len(p.data)
+		g.flight.sent(g, p.number, packetSize, now)
 		g.packets = append(g.packets, buf)
+		g.expires = append(g.expires, expires)
 	}
 	g.nextPacket = nextPacket
+	g.packetsMu.Unlock()
+
+	for _, p := range ps { // packets written before the error are resent, so they are counted
+		if err := g.write(p.number, false); err != nil {
+			return true, n, err
+		}
+		n += len(p.data) - header
+	}
 	return true, n, nil
 }
 
-func (g *group) shortTFunc() {
-	if !g.long.Stop() {
-		return
+// write waits for the pacing rate without holding packets and writes the packet
+// if it is still not confirmed or abandoned, it is marked as retransmitted if it is resent
+func (g *group) write(number uint32, resent bool) error {
+	g.packetsMu.Lock()
+	data := g.lockedPacket(number, resent)
+	g.packetsMu.Unlock()
+	if data == nil {
+		return nil
 	}
 
-	g.resendUnconfirmed()
-}
+	if g.paced != nil {
+		if err := g.paced.wait(len(data)); err != nil {
+			return fmt.Errorf("failed to write to main connection: %w", err)
+		}
+	}
 
-func (g *group) longTFunc() {
-	if !g.short.Stop() {
-		return
+	g.packetsMu.Lock()
+	defer g.packetsMu.Unlock()
+	data = g.lockedPacket(number, resent) // it may be confirmed while waiting
+	if data == nil {
+		return nil
+	}
+	if resent {
+		g.flight.retransmitted(number)
+	}
+	var (
+		written int
+		err     error
+	)
+	if g.paced != nil {
+		written, err = g.paced.writeNow(data)
+	} else {
+		written, err = g.w.Write(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to main connection: %w", err)
+	}
+	if written != len(data) {
+		return ErrPacketCorrupted
 	}
+	return nil
+}
 
-	g.resendUnconfirmed()
+// lockedPacket returns the packet that is not confirmed yet, otherwise nil,
+// acknowledgments are checked again only for resent packets
+func (g *group) lockedPacket(number uint32, resent bool) []byte {
+	if resent {
+		g.markSended()
+		g.abandonExpired(time.Now())
+	}
+	i := len(g.packets) - packetNumberDiff(g.nextPacket, number)
+	if i < 0 || i >= len(g.packets) {
+		return nil
+	}
+	return g.packets[i].data
 }
 
 func (g *group) resendUnconfirmed() {
@@ -129,38 +230,46 @@ func (g *group) resendUnconfirmed() {
 		g.packetsMu.Unlock()
 	}()
 
-	resendDelay := sShortTime
-	for range resendTries {
+	g.packetsMu.Lock()
+	waited := g.rto
+	g.packetsMu.Unlock()
+	for range g.tries {
 		select {
 		case <-g.stopCh:
 			return
 		default:
 		}
 
-		var hasUnconfirmed bool
+		var unconfirmed []uint32
 		g.packetsMu.Lock()
 		g.markSended()
-		for _, p := range g.packets {
+		g.abandonExpired(time.Now())
+		for i, p := range g.packets {
 			if p.data != nil {
-				hasUnconfirmed = true
-				_, err := g.w.Write(p.data)
-				if err != nil {
-					g.packetsMu.Unlock()
-					return
+				number := addPacketNumber(g.nextPacket, i-len(g.packets))
+				if len(unconfirmed) == 0 {
+					g.flight.lost(number, time.Now())
 				}
+				unconfirmed = append(unconfirmed, number)
 			}
 		}
 		g.packetsMu.Unlock()
-		if !hasUnconfirmed {
+		if len(unconfirmed) == 0 {
 			return
 		}
+		for _, number := range unconfirmed {
+			if err := g.write(number, true); err != nil {
+				return
+			}
+		}
 
-		resendDelay *= 2
-		time.Sleep(resendDelay)
+		waited = g.flight.rtt.timedOut(waited)
+		time.Sleep(withJitter(waited))
 	}
 
 	g.packetsMu.Lock()
 	g.markSended()
+	g.abandonExpired(time.Now())
 	for _, p := range g.packets {
 		if p.data != nil {
 			g.packetsMu.Unlock()
@@ -171,18 +280,27 @@ func (g *group) resendUnconfirmed() {
 	g.packetsMu.Unlock()
 }
 
+// resend writes the packet again if it is not confirmed yet,
+// it doesn't wait for the check (see [flight])
+func (g *group) resend(number uint32) {
+	select {
+	case <-g.stopCh:
+		return
+	default:
+	}
+
+	g.write(number, true)
+}
+
 func (g *group) markSended() {
-	var (
-		psLen      = len(g.packets)
-		nextPacket = int(g.nextPacket)
-	)
+	psLen := len(g.packets)
 	g.sendedMu.RLock()
 	for _, r := range *g.sended {
-		s := psLen - (nextPacket - int(r[0]))
+		s := psLen - packetNumberDiff(g.nextPacket, r[0])
 		if s >= psLen {
 			continue
 		}
-		e := psLen - (nextPacket - int(r[1]))
+		e := psLen - packetNumberDiff(g.nextPacket, r[1])
 		if e < 0 {
 			continue
 		}
@@ -191,6 +309,23 @@ func (g *group) markSended() {
 	g.sendedMu.RUnlock()
 }
 
+// abandonExpired stops resending packets whose lifetime is over,
+// so they don't close the connection
+func (g *group) abandonExpired(now time.Time) {
+	var abandoned []uint32
+	for i, p := range g.packets {
+		if p.data == nil || g.expires[i].IsZero() || now.Before(g.expires[i]) {
+			continue
+		}
+		p.free()
+		g.packets[i] = reusable[[]byte]{}
+		abandoned = append(abandoned, addPacketNumber(g.nextPacket, i-len(g.packets)))
+	}
+	if len(abandoned) != 0 {
+		g.abandon(abandoned)
+	}
+}
+
 func clearPackets(ps []reusable[[]byte]) {
 	for i, p := range ps {
 		if p.data != nil {
@@ -205,7 +340,14 @@ func (g *group) incNextPacket() (nextPacket uint32) {
 	defer g.packetsMu.Unlock()
 
 	g.packets = append(g.packets, reusable[[]byte]{})
+	g.expires = append(g.expires, time.Time{})
 	nextPacket = g.nextPacket
-	g.nextPacket++
+	g.nextPacket = nextPacketNumber(g.nextPacket)
 	return nextPacket
 }
+
+func (g *group) peekNextPacket() uint32 {
+	g.packetsMu.Lock()
+	defer g.packetsMu.Unlock()
+	return g.nextPacket
+}
@@ -1,6 +1,9 @@
 package sudp
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"slices"
 	"strings"
 	"sync"
@@ -18,44 +21,85 @@ func TestGroup_Packets(t *testing.T) {
 			t: t,
 		}
 		sended := &[]rng[uint32]{{0, 100}}
-		g := newGroup(ps, func() {}, make(chan struct{}), &sync.RWMutex{}, sended, 420)
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), &sync.RWMutex{}, sended, 420, resendTries)
 
-		ok, n, err := g.appendAndSend([]byte(strings.Repeat("A", maxDataSize) +
-			strings.Repeat("B", maxDataSize) + strings.Repeat("C", maxDataSize/2)))
+		ok, n, err := g.appendAndSend([]byte(strings.Repeat("A", minDataSize) +
+			strings.Repeat("B", minDataSize) + strings.Repeat("C", minDataSize/2)))
 		assert.True(ok)
-		assert.Equal(maxDataSize*2+maxDataSize/2, n)
+		assert.Equal(minDataSize*2+minDataSize/2, n)
 		assert.NoError(err)
-		ok, n, err = g.appendAndSend([]byte(strings.Repeat("D", maxDataSize/5)))
+		ok, n, err = g.appendAndSend([]byte(strings.Repeat("D", minDataSize/5)))
 		assert.True(ok)
-		assert.Equal(maxDataSize/5, n)
+		assert.Equal(minDataSize/5, n)
 		assert.NoError(err)
 
 		packets := ps.Packets()
 		assert.Len(packets, 4)
 		assert.EqualValues(420, packets[0].number)
 		assert.False(packets[0].isCommand)
-		assert.Equal([]byte(strings.Repeat("A", maxDataSize)), packets[0].data)
+		assert.Equal([]byte(strings.Repeat("A", minDataSize)), packets[0].data)
 		assert.EqualValues(421, packets[1].number)
 		assert.False(packets[0].isCommand)
-		assert.Equal([]byte(strings.Repeat("B", maxDataSize)), packets[1].data)
+		assert.Equal([]byte(strings.Repeat("B", minDataSize)), packets[1].data)
 		assert.EqualValues(422, packets[2].number)
 		assert.False(packets[0].isCommand)
-		assert.Equal([]byte(strings.Repeat("C", maxDataSize/2)), packets[2].data)
+		assert.Equal([]byte(strings.Repeat("C", minDataSize/2)), packets[2].data)
 		assert.EqualValues(423, packets[3].number)
 		assert.False(packets[0].isCommand)
-		assert.Equal([]byte(strings.Repeat("D", maxDataSize/5)), packets[3].data)
+		assert.Equal([]byte(strings.Repeat("D", minDataSize/5)), packets[3].data)
+	})
+
+	t.Run("Should count packets written before the error", func(t *testing.T) {
+		assert := assert.New(t)
+		errWrite := errors.New("write failed")
+		ps := &testFailingWriter{w: &testPacketBuffer{t: t}, writes: 2, err: errWrite}
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), &sync.RWMutex{}, &[]rng[uint32]{}, 0, resendTries)
+
+		ok, n, err := g.appendAndSendStream([]byte(strings.Repeat("A", 3*(minDataSize-streamHeaderSize))), &stream{id: 1})
+
+		assert.True(ok)
+		assert.Equal(2*(minDataSize-streamHeaderSize), n, "stream headers should not be counted")
+		assert.ErrorIs(err, errWrite)
+	})
+
+	t.Run("Paced packets should be written without holding the group", func(t *testing.T) {
+		assert := assert.New(t)
+		ps := &testPacketBuffer{t: t}
+		stop := make(chan struct{})
+		defer close(stop)
+		packetSize := minDataSize + headerSize
+		pacer := newPacer(ps, func() int { return 50 * packetSize }, stop) // packet every 20ms after the burst
+		g := newGroup(pacer, func() {}, func([]uint32) {}, stop, newFlight(), &sync.RWMutex{}, &[]rng[uint32]{}, 0, resendTries)
+		packets := pacingBurst/packetSize + 5
+
+		start := time.Now()
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			ok, n, err := g.appendAndSend(bytes.Repeat([]byte{1}, packets*minDataSize))
+			assert.True(ok)
+			assert.Equal(packets*minDataSize, n)
+			assert.NoError(err)
+		}()
+		time.Sleep(testSlack / 2)
+		g.peekNextPacket()
+		assert.Less(time.Since(start), testSlack, "the group should not be held while packets wait")
+
+		<-written
+		assert.GreaterOrEqual(time.Since(start), 80*time.Millisecond)
+		assert.Len(ps.Packets(), packets)
 	})
 }
 
 func TestGroup_Timers(t *testing.T) {
-	t.Run("Should resend packets after short timer if something is not received and no new data in small window", func(t *testing.T) {
+	t.Run("Should resend packets after rto if something is not received", func(t *testing.T) {
 		assert := assert.New(t)
 		ps := &testPacketBuffer{
 			t: t,
 		}
 		sendedMu := &sync.RWMutex{}
 		sended := &[]rng[uint32]{{33, 34}, {37, 37}}
-		g := newGroup(ps, func() {}, make(chan struct{}), sendedMu, sended, 33)
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
 
 		ok, _, err := g.appendAndSend([]byte("Hello"))
 		assert.True(ok)
@@ -76,12 +120,12 @@ func TestGroup_Timers(t *testing.T) {
 		assert.True(ok)
 		assert.NoError(err)
 
-		time.Sleep(sShortTime)
+		time.Sleep(initialRTO)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		ok, _, _ = g.appendAndSend([]byte("smth"))
-		assert.False(ok, "should be closed for new messages after short timer")
+		assert.False(ok, "should be closed for new messages after rto")
 
 		sendedMu.Lock()
 		*sended = []rng[uint32]{{33, 38}}
@@ -107,46 +151,41 @@ func TestGroup_Timers(t *testing.T) {
 		assert.EqualValues(38, packets[8].number)
 	})
 
-	t.Run("Should resend packets after long timer if something is not received and new data in small window", func(t *testing.T) {
+	t.Run("Should stop accepting packets after window even if new data is written steadily", func(t *testing.T) {
 		assert := assert.New(t)
 		ps := &testPacketBuffer{
 			t: t,
 		}
-		sendedMu := &sync.RWMutex{}
-		sended := &[]rng[uint32]{{33, 34}, {37, 37}, {39, 100}}
-		smallWindow := sShortTime / 2
-		smallWindowPackets := int(sLongTime / smallWindow)
-		restToTime := sLongTime - smallWindow*time.Duration(smallWindowPackets)
-		g := newGroup(ps, func() {}, make(chan struct{}), sendedMu, sended, 33)
+		sended := &[]rng[uint32]{{33, 33}}
+		start := time.Now()
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), &sync.RWMutex{}, sended, 33, resendTries)
 
-		for i := range smallWindowPackets {
-			ok, _, err := g.appendAndSend([]byte{byte(i)})
-			assert.True(ok)
+		var appended int
+		for {
+			ok, _, err := g.appendAndSend([]byte{byte(appended)})
 			assert.NoError(err)
-
-			time.Sleep(smallWindow)
+			if !ok {
+				break
+			}
+			appended++
+			time.Sleep(initialRTO / 8)
 		}
-		time.Sleep(restToTime)
+		assert.GreaterOrEqual(time.Since(start), initialRTO/2)
+		assert.Less(time.Since(start), initialRTO, "steady writing should not postpone resending")
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(initialRTO)
 
-		ok, _, _ := g.appendAndSend([]byte("smth"))
-		assert.False(ok, "should be closed for new messages after long timer")
-
-		sendedMu.Lock()
-		*sended = []rng[uint32]{{33, 100}}
-		sendedMu.Unlock()
+		time.Sleep(testSlack)
 
 		packets := ps.Packets()
-		// sended packets shuld be [33, 34, 35, 36, 37, 38, 39, 40, (35, 36, 38) - it was not in sended]
-		assert.GreaterOrEqual(len(packets), smallWindowPackets+3)
-		for i := range smallWindowPackets {
+		// all packets except the first one should be resent once
+		assert.Len(packets, appended*2-1)
+		for i := range appended {
 			assert.EqualValues(33+i, packets[i].number)
 		}
-
-		assert.EqualValues(35, packets[smallWindowPackets].number)
-		assert.EqualValues(36, packets[smallWindowPackets+1].number)
-		assert.EqualValues(38, packets[smallWindowPackets+2].number)
+		for i := range appended - 1 {
+			assert.EqualValues(34+i, packets[appended+i].number)
+		}
 	})
 }
 
@@ -158,7 +197,7 @@ func TestGroup_Resending(t *testing.T) {
 		}
 		sendedMu := &sync.RWMutex{}
 		sended := &[]rng[uint32]{{34, 35}}
-		g := newGroup(ps, func() {}, make(chan struct{}), sendedMu, sended, 33)
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
 		ok, _, err := g.appendAndSend([]byte{0})
 		assert.True(ok)
 		assert.NoError(err)
@@ -172,9 +211,9 @@ func TestGroup_Resending(t *testing.T) {
 		assert.True(ok)
 		assert.NoError(err)
 
-		time.Sleep(sShortTime * 10)
+		time.Sleep(initialRTO * 10)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		packets := ps.Packets()
 		// sended packets shuld be [33, 34, 35, 36, (33, 36, 33, 36, 33, 36) - it was not in sended]
@@ -203,7 +242,7 @@ func TestGroup_Resending(t *testing.T) {
 		sended := &[]rng[uint32]{{34, 35}}
 		var closedConn atomic.Bool
 		closeConn := func() { closedConn.Store(true) }
-		g := newGroup(ps, closeConn, make(chan struct{}), sendedMu, sended, 33)
+		g := newGroup(ps, closeConn, func([]uint32) {}, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
 
 		ok, _, err := g.appendAndSend([]byte{0})
 		assert.True(ok)
@@ -218,11 +257,11 @@ func TestGroup_Resending(t *testing.T) {
 		assert.True(ok)
 		assert.NoError(err)
 
-		time.Sleep(sShortTime * 10)
+		time.Sleep(initialRTO * 10)
 
-		time.Sleep(sShortTime * 10)
+		time.Sleep(initialRTO * 10)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		assert.True(closedConn.Load())
 	})
@@ -236,7 +275,7 @@ func TestGroup_Resending(t *testing.T) {
 		sended := &[]rng[uint32]{{34, 35}}
 		var closedConn atomic.Bool
 		closeConn := func() { closedConn.Store(true) }
-		g := newGroup(ps, closeConn, make(chan struct{}), sendedMu, sended, 33)
+		g := newGroup(ps, closeConn, func([]uint32) {}, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
 
 		ok, _, err := g.appendAndSend([]byte{0})
 		assert.True(ok)
@@ -251,19 +290,53 @@ func TestGroup_Resending(t *testing.T) {
 		assert.True(ok)
 		assert.NoError(err)
 
-		time.Sleep(sShortTime * 10)
+		time.Sleep(initialRTO * 10)
 
 		sendedMu.Lock()
 		*sended = []rng[uint32]{{33, 46}}
 		sendedMu.Unlock()
 
-		time.Sleep(sShortTime * 10)
+		time.Sleep(initialRTO * 10)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		assert.Len(ps.Packets(), 4+2+2+2)
 		assert.False(closedConn.Load())
 	})
+
+	t.Run("Expired packets should be abandoned instead of closing connection", func(t *testing.T) {
+		assert := assert.New(t)
+		ps := &testPacketBuffer{
+			t: t,
+		}
+		sendedMu := &sync.RWMutex{}
+		sended := &[]rng[uint32]{}
+		var closedConn atomic.Bool
+		closeConn := func() { closedConn.Store(true) }
+		abandonedCh := make(chan []uint32, 1)
+		abandon := func(numbers []uint32) { abandonedCh <- numbers }
+		g := newGroup(ps, closeConn, abandon, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
+
+		ok, _, err := g.appendAndSendMessage([]byte{0}, writePart{first: true, expires: time.Now().Add(initialRTO / 2)})
+		assert.True(ok)
+		assert.NoError(err)
+		ok, _, err = g.appendAndSendMessage([]byte{1}, writePart{last: true, expires: time.Now().Add(initialRTO / 2)})
+		assert.True(ok)
+		assert.NoError(err)
+
+		select {
+		case numbers := <-abandonedCh:
+			assert.Equal([]uint32{33, 34}, numbers)
+		case <-time.After(initialRTO * 2):
+			assert.Fail("packets are not abandoned")
+		}
+
+		time.Sleep(initialRTO * 20)
+
+		assert.Len(ps.Packets(), 2, "abandoned packets should not be resent")
+		assert.False(closedConn.Load())
+	})
+
 }
 
 func TestGroup_IncNextPacket(t *testing.T) {
@@ -276,7 +349,7 @@ func TestGroup_IncNextPacket(t *testing.T) {
 		sended := &[]rng[uint32]{{33, 34}, {36, 37}}
 		var closedConn atomic.Bool
 		closeConn := func() { closedConn.Store(true) }
-		g := newGroup(ps, closeConn, make(chan struct{}), sendedMu, sended, 33)
+		g := newGroup(ps, closeConn, func([]uint32) {}, make(chan struct{}), newFlight(), sendedMu, sended, 33, resendTries)
 
 		ok, _, err := g.appendAndSend([]byte{0}) // 33
 		assert.True(ok)
@@ -295,14 +368,43 @@ func TestGroup_IncNextPacket(t *testing.T) {
 		nextPacket = g.incNextPacket() // 38 (dont care)
 		assert.EqualValues(38, nextPacket)
 
-		time.Sleep(sShortTime)
+		time.Sleep(initialRTO)
 
-		time.Sleep(deliveryDelay / 2)
+		time.Sleep(testSlack)
 
 		assert.Len(ps.Packets(), 4)
 	})
 }
 
+func TestGroup_MarkSended(t *testing.T) {
+	t.Run("Packet numbers wrap around", func(t *testing.T) {
+		assert := assert.New(t)
+		ps := &testPacketBuffer{
+			t: t,
+		}
+		sended := &[]rng[uint32]{{maxPacketNumber - 5, maxPacketNumber}, {1, 1}}
+		g := newGroup(ps, func() {}, func([]uint32) {}, make(chan struct{}), newFlight(), &sync.RWMutex{}, sended, maxPacketNumber-1, resendTries)
+
+		for i := range 4 {
+			ok, _, err := g.appendAndSend([]byte{byte(i)})
+			assert.True(ok)
+			assert.NoError(err)
+		}
+		assert.EqualValues(2, g.nextPacket)
+
+		g.packetsMu.Lock()
+		g.markSended()
+		confirmed := make([]bool, len(g.packets))
+		for i, p := range g.packets {
+			confirmed[i] = p.data == nil
+		}
+		g.packetsMu.Unlock()
+
+		// packets: [max-1, max, 0, 1]
+		assert.Equal([]bool{true, true, false, true}, confirmed)
+	})
+}
+
 type testPacketBuffer struct {
 	t       *testing.T
 	mu      sync.Mutex
@@ -312,7 +414,7 @@ type testPacketBuffer struct {
 func (buf *testPacketBuffer) Write(b []byte) (int, error) {
 	assert := assert.New(buf.t)
 
-	p, err := decodePacket(b)
+	p, err := decodePacket(bytes.Clone(b)) // writer must not retain b
 	assert.NoError(err)
 	buf.mu.Lock()
 	buf.packets = append(buf.packets, p)
@@ -325,3 +427,18 @@ func (buf *testPacketBuffer) Packets() []packet {
 	defer buf.mu.Unlock()
 	return slices.Clone(buf.packets)
 }
+
+// testFailingWriter returns err after the number of successful writes
+type testFailingWriter struct {
+	w      io.Writer
+	writes int
+	err    error
+}
+
+func (fw *testFailingWriter) Write(b []byte) (int, error) {
+	if fw.writes == 0 {
+		return 0, fw.err
+	}
+	fw.writes--
+	return fw.w.Write(b)
+}
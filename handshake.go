@@ -0,0 +1,348 @@
+package sudp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+)
+
+/*
+	Connection opening handshake:
+
+	client                               server
+	   | ------------ initial ------------> |  client parameters
+	   | <------------ accept ------------- |  cookie, server parameters
+	   | ------------ confirm ------------> |  cookie, client parameters
+
+	The server doesn't keep any state until it receives confirm with a valid cookie,
+	so a spoofed packet can't create a connection on the server.
+	Every cookie creates only one connection, so a replayed confirm
+	doesn't create it again after the first one is closed.
+	Initial is resent by the dialer until accept is received,
+	confirm is the first packet of the client connection (number 0),
+	so it is resent until it is received like any other packet.
+
+	If the server can't accept the connection (listener is closed, too many
+	not accepted connections or parameters are not supported) it answers with close command.
+
+	Version negotiation:
+
+	client                               server
+	   | ------- initial (version 2) -----> |
+	   | <------- versions (1, ...) ------- |  versions supported by the server
+	   | ------- initial (version 1) -----> |  the best common version
+
+	The server answers handshake packets of unsupported versions with the list of its versions,
+	the client starts the handshake again with the best version that both sides support.
+	It only moves to older versions, so the negotiation ends. The version is also sent
+	in transport parameters, which are authenticated in TLS mode, so the negotiation can't be downgraded.
+	Connections drop packets of other versions.
+*/
+
+const (
+	// number of bytes in cookie: 4 bytes of unix time, 4 random bytes, so every cookie is unique,
+	// and 12 bytes of mac
+	cookieSize = 4 + 4 + 12
+	// how long the client has to confirm the connection after receiving accept
+	cookieLifetime = 10 * time.Second
+)
+
+var (
+	errConnRefused                = fmt.Errorf("%w: refused by peer", syscall.ECONNREFUSED)
+	errHandshakeTimeout           = errors.New("handshake timeout: no response")
+	errInvalidTransportParameters = errors.New("invalid transport parameters")
+	errUnsupportedVersion         = errors.New("unsupported protocol version")
+	errTooSmallMaxPacketSize      = errors.New("too small max packet size")
+	errModeMismatch               = errors.New("peer uses the other mode (stream or message)")
+	errPSKWithTLS                 = errors.New("pre-shared key can't be used with TLS")
+)
+
+// supportedVersions are protocol versions that we are able to speak, from the newest one,
+// newer versions are better
+var supportedVersions = []byte{protocolVersion}
+
+func isSupportedVersion(version byte) bool {
+	return slices.Contains(supportedVersions, version)
+}
+
+// bestCommonVersion chooses the best of our versions that the peer supports
+func bestCommonVersion(peerVersions []byte) (byte, bool) {
+	for _, v := range supportedVersions {
+		if slices.Contains(peerVersions, v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// options of connections that are chosen by Dial and Listen functions (see [Config])
+type options struct {
+	messages bool        // message mode (see [MessageConn])
+	psk      []byte      // pre-shared key (see psk.go), nil if packets are not sealed
+	tls      *tls.Config // see tls.go, nil if the TLS handshake is not done
+
+	connBuffer    int
+	readBuffer    int
+	acceptBacklog int
+	ackDelay      time.Duration
+	maxAckDelay   time.Duration
+	resendTries   int
+	maxPacketSize int
+}
+
+func defaultOptions() options {
+	return options{
+		connBuffer:    connCap,
+		readBuffer:    userCap,
+		acceptBacklog: newConnsCap,
+		ackDelay:      rShortTime,
+		maxAckDelay:   rLongTime,
+		resendTries:   resendTries,
+		maxPacketSize: maxPacketSize,
+	}
+}
+
+// handshakeProtection protects packets of the opening handshake,
+// which are sent before keys of the connection are known
+type handshakeProtection interface {
+	seal(dst, p []byte) []byte
+	open(b []byte) ([]byte, error)
+}
+
+// packetOpener opens protected packets received by the connection,
+// it is used only by the reading goroutine of the connection
+type packetOpener interface {
+	open(b []byte) ([]byte, error)
+}
+
+// handshakeProtection returns nil if packets are not protected
+func (o options) handshakeProtection() handshakeProtection {
+	switch {
+	case o.psk != nil:
+		return pskHandshake{keys: handshakeKeys(o.psk)}
+	case o.tls != nil:
+		return tlsCleartext{}
+	}
+	return nil
+}
+
+// protect wraps the writer of the new connection and returns the opener of its packets,
+// the nonce of the client and the cookie are taken from the opening handshake.
+// The first packet of the connection of the server is confirm that the listener already opened.
+func (o options) protect(w io.Writer, client bool, nonce, cookie []byte) (io.Writer, packetOpener) {
+	switch {
+	case o.psk != nil:
+		clientKeys, serverKeys := connKeys(o.psk, nonce, cookie)
+		if client {
+			return &sealWriter{w: w, keys: clientKeys, handshake: handshakeKeys(o.psk)}, &pskOpener{keys: serverKeys}
+		}
+		return &sealWriter{w: w, keys: serverKeys}, &pskOpener{keys: clientKeys, handshake: handshakeKeys(o.psk), confirmOpened: true}
+	case o.tls != nil:
+		p := &tlsProtection{w: w, confirmOpened: !client}
+		return p, p
+	}
+	return w, nil
+}
+
+// overhead returns how many bytes are added to full packets on the wire
+func (o options) overhead() int {
+	switch {
+	case o.psk != nil:
+		return sealOverhead
+	case o.tls != nil:
+		return 1 + sealOverhead
+	}
+	return 0
+}
+
+// transport parameters are exchanged during the handshake,
+// so each side knows the limits of its peer
+type transportParameters struct {
+	version       byte   // protocol version
+	maxPacketSize uint16 // max size of packet that endpoint is able to receive
+	connBuffer    uint32 // number of packets that connection may not handle before dropping
+	readBuffer    uint32 // number of packets that may wait for the user to read them
+	messages      bool   // message mode, both sides must use the same mode
+	nonce         []byte // random nonce of the client in pre-shared key mode (see psk.go)
+	// how long received packets wait for more packets before they are acknowledged
+	// and how long they may wait at most, in microseconds (see [Config.AckDelay])
+	ackDelay    uint32
+	maxAckDelay uint32
+}
+
+// encoding of every parameter: | id (1 byte) | len (1 byte) | value (len bytes) |
+// unknown parameters are skipped, so new ones can be added without breaking old peers
+const (
+	paramVersion byte = iota + 1
+	paramMaxPacketSize
+	paramConnBuffer
+	paramReadBuffer
+	paramMessages
+	paramNonce
+	paramAckDelay
+	paramMaxAckDelay
+)
+
+// transportParameters returns local parameters of connections with the options
+func (o options) transportParameters() transportParameters {
+	return transportParameters{
+		version:       protocolVersion,
+		maxPacketSize: uint16(o.maxPacketSize),
+		connBuffer:    uint32(o.connBuffer),
+		readBuffer:    uint32(o.readBuffer),
+		messages:      o.messages,
+		ackDelay:      uint32(o.ackDelay / time.Microsecond),
+		maxAckDelay:   uint32(o.maxAckDelay / time.Microsecond),
+	}
+}
+
+func (tp transportParameters) append(dst []byte) []byte {
+	dst = append(dst, paramVersion, 1, tp.version)
+	dst = binary.BigEndian.AppendUint16(append(dst, paramMaxPacketSize, 2), tp.maxPacketSize)
+	dst = binary.BigEndian.AppendUint32(append(dst, paramConnBuffer, 4), tp.connBuffer)
+	dst = binary.BigEndian.AppendUint32(append(dst, paramReadBuffer, 4), tp.readBuffer)
+	if tp.messages {
+		dst = append(dst, paramMessages, 0)
+	}
+	if tp.nonce != nil {
+		dst = append(append(dst, paramNonce, byte(len(tp.nonce))), tp.nonce...)
+	}
+	dst = binary.BigEndian.AppendUint32(append(dst, paramAckDelay, 4), tp.ackDelay)
+	dst = binary.BigEndian.AppendUint32(append(dst, paramMaxAckDelay, 4), tp.maxAckDelay)
+	return dst
+}
+
+func decodeTransportParameters(src []byte) (transportParameters, error) {
+	var tp transportParameters
+	for len(src) > 0 {
+		if len(src) < 2 || len(src[2:]) < int(src[1]) {
+			return transportParameters{}, errInvalidTransportParameters
+		}
+		id, value := src[0], src[2:2+src[1]]
+		src = src[2+len(value):]
+
+		switch id {
+		case paramVersion:
+			if len(value) != 1 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.version = value[0]
+		case paramMaxPacketSize:
+			if len(value) != 2 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.maxPacketSize = binary.BigEndian.Uint16(value)
+		case paramConnBuffer:
+			if len(value) != 4 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.connBuffer = binary.BigEndian.Uint32(value)
+		case paramReadBuffer:
+			if len(value) != 4 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.readBuffer = binary.BigEndian.Uint32(value)
+		case paramMessages:
+			if len(value) != 0 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.messages = true
+		case paramNonce:
+			if len(value) != pskNonceSize {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.nonce = slices.Clone(value) // the packet buffer is reused
+		case paramAckDelay:
+			if len(value) != 4 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.ackDelay = binary.BigEndian.Uint32(value)
+		case paramMaxAckDelay:
+			if len(value) != 4 {
+				return transportParameters{}, errInvalidTransportParameters
+			}
+			tp.maxAckDelay = binary.BigEndian.Uint32(value)
+		}
+	}
+	return tp, nil
+}
+
+// checks if we are able to communicate with the peer that sent these parameters,
+// messages is the mode of the local side
+func (tp transportParameters) validate(messages bool) error {
+	if !isSupportedVersion(tp.version) {
+		return fmt.Errorf("%w: %d", errUnsupportedVersion, tp.version)
+	}
+	if tp.maxPacketSize < minPacketSize {
+		return fmt.Errorf("%w: %d", errTooSmallMaxPacketSize, tp.maxPacketSize)
+	}
+	if tp.messages != messages {
+		return errModeMismatch
+	}
+	return nil
+}
+
+// cookies allow the server to check that the client received accept packet
+// (so its address is not spoofed), only used cookies are stored until they expire
+type cookies struct {
+	secret [32]byte
+	used   map[string]time.Time // when cookies expire, it is used only by the reading goroutine
+}
+
+func newCookies() *cookies {
+	c := &cookies{used: make(map[string]time.Time)}
+	rand.Read(c.secret[:])
+	return c
+}
+
+func (c *cookies) new(addr netip.AddrPort, now time.Time) []byte {
+	cookie := binary.BigEndian.AppendUint32(make([]byte, 0, cookieSize), uint32(now.Unix()))
+	cookie = cookie[:8]
+	rand.Read(cookie[4:])
+	return append(cookie, c.mac(addr, cookie[:8])...)
+}
+
+func (c *cookies) valid(cookie []byte, addr netip.AddrPort, now time.Time) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint32(cookie)), 0)
+	if now.Sub(created) > cookieLifetime || created.After(now) {
+		return false
+	}
+	return hmac.Equal(cookie[8:], c.mac(addr, cookie[:8]))
+}
+
+// use marks the valid cookie as used, it returns false if the cookie is already used
+func (c *cookies) use(cookie []byte, now time.Time) bool {
+	for used, expires := range c.used {
+		if now.After(expires) { // the cookie is not valid anymore
+			delete(c.used, used)
+		}
+	}
+	if _, ok := c.used[string(cookie)]; ok {
+		return false
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint32(cookie)), 0)
+	c.used[string(cookie)] = created.Add(cookieLifetime)
+	return true
+}
+
+// mac signs the address and the start of the cookie (time and random bytes)
+func (c *cookies) mac(addr netip.AddrPort, start []byte) []byte {
+	h := hmac.New(sha256.New, c.secret[:])
+	addrBytes, _ := addr.MarshalBinary()
+	h.Write(addrBytes)
+	h.Write(start)
+	return h.Sum(nil)[:cookieSize-8]
+}
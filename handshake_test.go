@@ -0,0 +1,159 @@
+package sudp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportParameters(t *testing.T) {
+	t.Run("Coding", func(t *testing.T) {
+		assert := assert.New(t)
+		target := transportParameters{
+			version:       protocolVersion,
+			maxPacketSize: 1500,
+			connBuffer:    69,
+			readBuffer:    420,
+		}
+
+		res, err := decodeTransportParameters(target.append(nil))
+
+		assert.NoError(err)
+		assert.Equal(target, res)
+	})
+
+	t.Run("Should skip unknown parameters", func(t *testing.T) {
+		assert := assert.New(t)
+		target := defaultOptions().transportParameters()
+
+		data := append([]byte{69, 3, 1, 2, 3}, target.append(nil)...)
+		data = append(data, 42, 0)
+		res, err := decodeTransportParameters(data)
+
+		assert.NoError(err)
+		assert.Equal(target, res)
+	})
+
+	t.Run("Coding of message mode", func(t *testing.T) {
+		assert := assert.New(t)
+		target := defaultOptions().transportParameters()
+		target.messages = true
+
+		res, err := decodeTransportParameters(target.append(nil))
+
+		assert.NoError(err)
+		assert.Equal(target, res)
+	})
+
+	t.Run("Coding of nonce", func(t *testing.T) {
+		assert := assert.New(t)
+		target := defaultOptions().transportParameters()
+		target.nonce = make([]byte, pskNonceSize)
+		target.nonce[0] = 1
+
+		res, err := decodeTransportParameters(target.append(nil))
+
+		assert.NoError(err)
+		assert.Equal(target, res)
+
+		_, err = decodeTransportParameters([]byte{paramNonce, 1, 1})
+		assert.ErrorIs(err, errInvalidTransportParameters)
+	})
+
+	t.Run("Invalid format", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := decodeTransportParameters([]byte{paramVersion})
+		assert.ErrorIs(err, errInvalidTransportParameters)
+
+		_, err = decodeTransportParameters([]byte{paramVersion, 2, 1})
+		assert.ErrorIs(err, errInvalidTransportParameters)
+
+		_, err = decodeTransportParameters([]byte{paramMaxPacketSize, 1, 1})
+		assert.ErrorIs(err, errInvalidTransportParameters)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.NoError(defaultOptions().transportParameters().validate(false))
+
+		params := defaultOptions().transportParameters()
+		params.version = protocolVersion + 1
+		assert.ErrorIs(params.validate(false), errUnsupportedVersion)
+
+		params = defaultOptions().transportParameters()
+		params.maxPacketSize = 576
+		assert.ErrorIs(params.validate(false), errTooSmallMaxPacketSize)
+
+		params = defaultOptions().transportParameters()
+		params.messages = true
+		assert.ErrorIs(params.validate(false), errModeMismatch)
+		assert.ErrorIs(defaultOptions().transportParameters().validate(true), errModeMismatch)
+	})
+}
+
+func TestCookies(t *testing.T) {
+	addr := netip.MustParseAddrPort("127.0.0.1:6969")
+	now := time.Now()
+
+	t.Run("Valid cookie", func(t *testing.T) {
+		assert := assert.New(t)
+		c := newCookies()
+
+		cookie := c.new(addr, now)
+
+		assert.Len(cookie, cookieSize)
+		assert.True(c.valid(cookie, addr, now))
+		assert.True(c.valid(cookie, addr, now.Add(cookieLifetime-time.Second)))
+	})
+
+	t.Run("Cookie from other address", func(t *testing.T) {
+		assert := assert.New(t)
+		c := newCookies()
+
+		cookie := c.new(addr, now)
+
+		assert.False(c.valid(cookie, netip.MustParseAddrPort("127.0.0.1:6970"), now))
+		assert.False(c.valid(cookie, netip.MustParseAddrPort("127.0.0.2:6969"), now))
+	})
+
+	t.Run("Expired cookie", func(t *testing.T) {
+		assert := assert.New(t)
+		c := newCookies()
+
+		cookie := c.new(addr, now)
+
+		assert.False(c.valid(cookie, addr, now.Add(cookieLifetime+time.Second)))
+		assert.False(c.valid(cookie, addr, now.Add(-time.Minute)))
+	})
+
+	t.Run("Forged cookie", func(t *testing.T) {
+		assert := assert.New(t)
+		c := newCookies()
+
+		cookie := c.new(addr, now)
+		cookie[cookieSize-1]++
+
+		assert.False(c.valid(cookie, addr, now))
+		assert.False(c.valid(cookie[:cookieSize-1], addr, now))
+		assert.False(newCookies().valid(c.new(addr, now), addr, now), "cookie from other listener")
+	})
+
+	t.Run("Used cookie", func(t *testing.T) {
+		assert := assert.New(t)
+		c := newCookies()
+
+		cookie := c.new(addr, now)
+		other := c.new(addr, now)
+
+		assert.NotEqual(cookie, other, "cookies should be unique")
+		assert.True(c.use(cookie, now))
+		assert.False(c.use(cookie, now.Add(time.Second)))
+		assert.True(c.use(other, now))
+		assert.True(c.use(c.new(addr, now.Add(cookieLifetime+2*time.Second)), now.Add(cookieLifetime+2*time.Second)))
+		assert.Len(c.used, 1, "expired cookies should be forgotten")
+	})
+}
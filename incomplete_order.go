@@ -8,40 +8,76 @@ import (
 type incompleteOrder struct {
 	nextToRead uint32
 	incomplete []reusable[packet]
+	// if set, it is called for every command in order before it is freed
+	onCommand func(p packet)
 }
 
 func (o *incompleteOrder) append(p reusable[packet]) (completed iter.Seq[reusable[[]byte]]) {
+	if packetNumberDiff(p.data.number, o.nextToRead) < 0 { // already readed
+		p.free()
+		return func(yield func(reusable[[]byte]) bool) {}
+	}
 	if p.data.number != o.nextToRead {
 		o.incomplete = binaryInsert(o.incomplete, p)
 		return func(yield func(reusable[[]byte]) bool) {}
 	}
 
 	return func(yield func(reusable[[]byte]) bool) {
-		o.nextToRead++
-		if !yieldDataPacket(yield, p) {
+		o.nextToRead = nextPacketNumber(o.nextToRead)
+		if !o.yieldDataPacket(yield, p) {
 			return
 		}
 
-		lri := -1 // last readed index
-		for i, p := range o.incomplete {
+		readed := 0
+		for _, p := range o.incomplete {
 			if p.data.number != o.nextToRead {
-				lri = i - 1
 				break
 			}
 
-			o.nextToRead++
-			if !yieldDataPacket(yield, p) {
+			o.nextToRead = nextPacketNumber(o.nextToRead)
+			readed++
+			if !o.yieldDataPacket(yield, p) {
 				break
 			}
 		}
-		if lri != -1 {
-			o.incomplete = slices.Delete(o.incomplete, 0, lri+1)
+		o.incomplete = slices.Delete(o.incomplete, 0, readed)
+	}
+}
+
+// skip considers packets before to as read, the missing ones are abandoned by the sender,
+// so the received packets are passed in order and every gap is passed as [gapFragment]
+func (o *incompleteOrder) skip(to uint32) (completed iter.Seq[reusable[[]byte]]) {
+	return func(yield func(reusable[[]byte]) bool) {
+		readed := 0
+		defer func() { o.incomplete = slices.Delete(o.incomplete, 0, readed) }()
+
+		for packetNumberDiff(to, o.nextToRead) > 0 || readed < len(o.incomplete) && o.incomplete[readed].data.number == o.nextToRead {
+			if readed < len(o.incomplete) && o.incomplete[readed].data.number == o.nextToRead {
+				p := o.incomplete[readed]
+				o.nextToRead = nextPacketNumber(o.nextToRead)
+				readed++
+				if !o.yieldDataPacket(yield, p) {
+					return
+				}
+				continue
+			}
+
+			o.nextToRead = to // the gap ends before the next received packet or at to
+			if readed < len(o.incomplete) && packetNumberDiff(o.incomplete[readed].data.number, to) < 0 {
+				o.nextToRead = o.incomplete[readed].data.number
+			}
+			if !yield(gapFragment()) {
+				return
+			}
 		}
 	}
 }
 
-func yieldDataPacket(yield func(reusable[[]byte]) bool, p reusable[packet]) bool {
+func (o *incompleteOrder) yieldDataPacket(yield func(reusable[[]byte]) bool, p reusable[packet]) bool {
 	if p.data.isCommand {
+		if o.onCommand != nil {
+			o.onCommand(p.data)
+		}
 		p.free()
 		return true
 	}
@@ -53,6 +89,6 @@ func yieldDataPacket(yield func(reusable[[]byte]) bool, p reusable[packet]) bool
 }
 
 func binaryInsert(ps []reusable[packet], p reusable[packet]) []reusable[packet] {
-	i, _ := slices.BinarySearchFunc(ps, p, func(a, b reusable[packet]) int { return int(a.data.number) - int(b.data.number) })
+	i, _ := slices.BinarySearchFunc(ps, p, func(a, b reusable[packet]) int { return packetNumberDiff(a.data.number, b.data.number) })
 	return slices.Insert(ps, i, p)
 }
@@ -73,6 +73,44 @@ func TestIncompleteOrder(t *testing.T) {
 	assert.EqualValues(9, freeCalls.Load())
 }
 
+func TestIncompleteOrder_Skip(t *testing.T) {
+	var freeCalls atomic.Uint64
+	pack := func(num uint32) reusable[packet] {
+		return newTestReusable(packet{
+			header: header{
+				number: num,
+			},
+			data: []byte{byte(num)},
+		}, &freeCalls)
+	}
+	assert := assert.New(t)
+
+	io := incompleteOrder{}
+	for _, num := range []uint32{2, 5, 6, 9} {
+		for p := range io.append(pack(num)) {
+			assert.Fail("unordered packet", p)
+		}
+	}
+	// readed: []							incomplete: [2, 5, 6, 9]
+
+	var skipped [][]byte
+	for p := range io.skip(5) {
+		skipped = append(skipped, p.data)
+		p.free()
+	}
+	// readed: [gap, 2, gap, 5, 6]			incomplete: [9]
+
+	gap := gapFragment().data
+	assert.Equal([][]byte{gap, {2}, gap, {5}, {6}}, skipped)
+	assert.EqualValues(7, io.nextToRead)
+
+	for p := range io.skip(6) {
+		assert.Fail("already readed", p)
+	}
+	assert.EqualValues(7, io.nextToRead)
+	assert.EqualValues(3, freeCalls.Load())
+}
+
 func TestIncompleteOrder_CommandPacket(t *testing.T) {
 	var freeCalls atomic.Uint64
 	pack := func(num uint32) reusable[packet] {
@@ -113,6 +151,46 @@ func TestIncompleteOrder_CommandPacket(t *testing.T) {
 	assert.EqualValues(8, freeCalls.Load())
 }
 
+func TestIncompleteOrder_WrapAround(t *testing.T) {
+	var freeCalls atomic.Uint64
+	pack := func(num uint32) reusable[packet] {
+		return newTestReusable(packet{
+			header: header{
+				number: num,
+			},
+			data: []byte{byte(num)},
+		}, &freeCalls)
+	}
+	assert := assert.New(t)
+
+	io := incompleteOrder{nextToRead: maxPacketNumber - 1}
+	for p := range io.append(pack(1)) {
+		assert.Fail("unordered packet", p)
+	}
+	for p := range io.append(pack(maxPacketNumber)) {
+		assert.Fail("unordered packet", p)
+	}
+	for p := range io.append(pack(0)) {
+		assert.Fail("unordered packet", p)
+	}
+	// readed: []										incomplete: [max, 0, 1]
+
+	var actual []byte
+	for p := range io.append(pack(maxPacketNumber - 1)) {
+		actual = append(actual, p.data...)
+		p.free()
+	}
+	assert.Equal([]byte{0xfe, 0xff, 0, 1}, actual)
+	assert.EqualValues(2, io.nextToRead)
+	assert.Empty(io.incomplete)
+	// readed: [max-1, max, 0, 1]						incomplete: []
+
+	for p := range io.append(pack(maxPacketNumber)) {
+		assert.Fail("already readed packet", p)
+	}
+	assert.EqualValues(5, freeCalls.Load(), "already readed packet should be freed")
+}
+
 func TestBinaryInsert(t *testing.T) {
 	pack := func(num uint32) reusable[packet] {
 		return reusable[packet]{
@@ -141,3 +219,56 @@ func TestBinaryInsert(t *testing.T) {
 	res = binaryInsert([]reusable[packet]{pack(1), pack(3), pack(7)}, pack(8))
 	assert.Equal([]reusable[packet]{pack(1), pack(3), pack(7), pack(8)}, res)
 }
+
+func TestBinaryInsert_WrapAround(t *testing.T) {
+	pack := func(num uint32) reusable[packet] {
+		return reusable[packet]{
+			packet{
+				header: header{
+					number: num,
+				},
+			},
+			nil,
+		}
+	}
+	assert := assert.New(t)
+
+	res := binaryInsert([]reusable[packet]{pack(maxPacketNumber), pack(1)}, pack(0))
+	assert.Equal([]reusable[packet]{pack(maxPacketNumber), pack(0), pack(1)}, res)
+
+	res = binaryInsert([]reusable[packet]{pack(maxPacketNumber - 1), pack(0)}, pack(maxPacketNumber))
+	assert.Equal([]reusable[packet]{pack(maxPacketNumber - 1), pack(maxPacketNumber), pack(0)}, res)
+}
+
+func TestIncompleteOrder_OnCommand(t *testing.T) {
+	var freeCalls atomic.Uint64
+	pack := func(num uint32, isCommand bool) reusable[packet] {
+		return newTestReusable(packet{
+			header: header{
+				isCommand: isCommand,
+				number:    num,
+			},
+			data: []byte{byte(num)},
+		}, &freeCalls)
+	}
+	assert := assert.New(t)
+	var order []byte
+	io := incompleteOrder{onCommand: func(p packet) {
+		order = append(order, p.data...)
+	}}
+
+	for range io.append(pack(2, true)) {
+		assert.Fail("unordered packet")
+	}
+	assert.Empty(order, "command should wait for previous packets")
+	for p := range io.append(pack(1, false)) {
+		assert.Fail("unordered packet", p.data)
+	}
+	for p := range io.append(pack(0, false)) {
+		order = append(order, p.data...)
+		p.free()
+	}
+
+	assert.Equal([]byte{0, 1, 2}, order)
+	assert.EqualValues(3, freeCalls.Load())
+}
@@ -1,6 +1,7 @@
 package sudp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -10,10 +11,68 @@ import (
 	"time"
 )
 
-// number of packets that listener may not handle before dropping
+// number of connections that wait for Accept before new ones are refused
 const newConnsCap = 256
 
+// Listen announces on the local address, connections are accepted only after the handshake
 func Listen(network, address string) (net.Listener, error) {
+	l, err := newListener(network, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenMessages works like [Listen], but accepts connections in message mode,
+// they can be obtained with type assertion of accepted connections to [MessageConn]
+func ListenMessages(network, address string) (net.Listener, error) {
+	l, err := newListener(network, address, &Config{Messages: true})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenPSK works like [Listen], but accepts only connections dialed with [DialPSK]
+// and the same pre-shared key, which must be at least 16 bytes long
+func ListenPSK(network, address string, psk []byte) (net.Listener, error) {
+	l, err := newListener(network, address, &Config{PSK: psk})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenTLS works like [Listen], but accepts only connections dialed with [DialTLS],
+// they are accepted after the TLS 1.3 handshake, which is done with the config,
+// and can be obtained with type assertion of accepted connections to [TLSConn]
+func ListenTLS(network, address string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return nil, errNoTLSConfig
+	}
+	l, err := newListener(network, address, &Config{TLS: config})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenConfig works like [Listen], but connections are tuned by the config,
+// accepted connections can be obtained with type assertion to [Conn],
+// [MessageConn] in message mode and [TLSConn] in TLS mode. Nil config has default values.
+func ListenConfig(network, address string, config *Config) (net.Listener, error) {
+	l, err := newListener(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func newListener(network, address string, config *Config) (*listener, error) {
+	opts, err := config.options()
+	if err != nil {
+		return nil, err
+	}
 	addr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve address: %w", err)
@@ -25,8 +84,14 @@ func Listen(network, address string) (net.Listener, error) {
 
 	l := &listener{
 		src:      conn,
-		newConns: make(chan net.Conn, newConnsCap),
+		cookies:  newCookies(),
+		done:     make(chan struct{}),
+		newConns: make(chan net.Conn, opts.acceptBacklog),
 		conns:    make(map[netip.AddrPort]chan<- reusable[[]byte]),
+
+		dontFragment: setDontFragment(conn) == nil,
+		opts:         opts,
+		protection:   opts.handshakeProtection(),
 	}
 	go l.listen()
 	return l, nil
@@ -34,30 +99,55 @@ func Listen(network, address string) (net.Listener, error) {
 
 type listener struct {
 	src            *net.UDPConn
+	cookies        *cookies
 	rerr           atomic.Value
+	doneOnce       sync.Once
+	done           chan struct{} // closed when listener is closed or main connection fails
 	newConnsClosed atomic.Bool
 	newConns       chan net.Conn
 	connsMu        sync.RWMutex
 	conns          map[netip.AddrPort]chan<- reusable[[]byte]
+
+	dontFragment bool // path mtu is discovered only if packets are not fragmented
+	opts         options
+	protection   handshakeProtection // nil if packets are not protected
 }
 
 func (l *listener) Accept() (net.Conn, error) {
-	newConn := <-l.newConns
-
-	if l.newConnsClosed.Load() {
-		if rerr := l.rerr.Load(); rerr != nil {
-			return nil, rerr.(error)
+	select {
+	case newConn := <-l.newConns:
+		if !l.newConnsClosed.Load() {
+			return newConn, nil
 		}
-		return nil, errCloseFuncCalled
+		newConn.Close()
+	case <-l.done:
 	}
-	return newConn, nil
+
+	if rerr := l.rerr.Load(); rerr != nil {
+		return nil, rerr.(error)
+	}
+	return nil, errCloseFuncCalled
 }
 
 func (l *listener) Close() error {
 	l.newConnsClosed.Store(true)
+	l.doneOnce.Do(func() { close(l.done) })
+	l.closeNotAccepted()
 	return l.tryCloseSrc()
 }
 
+// connections that are not accepted before the listener is closed will never be used
+func (l *listener) closeNotAccepted() {
+	for {
+		select {
+		case newConn := <-l.newConns:
+			newConn.Close()
+		default:
+			return
+		}
+	}
+}
+
 func (l *listener) Addr() net.Addr {
 	return l.src.LocalAddr()
 }
@@ -71,7 +161,7 @@ func (l *listener) listen() {
 			buf.free()
 			l.rerr.Store(fmt.Errorf("failed to read from main connection: %w", err))
 			l.newConnsClosed.Store(true)
-			close(l.newConns)
+			l.doneOnce.Do(func() { close(l.done) })
 
 			*readErr = err
 			l.connsMu.Lock()
@@ -84,27 +174,126 @@ func (l *listener) listen() {
 			l.src.Close()
 			return
 		}
+		buf.data = buf.data[:n]
+		buf = fitPacketBuf(buf)
 
 		l.connsMu.RLock()
 		connCh, ok := l.conns[addr]
-		if !ok {
-			newConnCh := l.lockedNewConn(addr, readErr)
-			if newConnCh == nil {
+		if ok {
+			if len(connCh) != cap(connCh) {
+				connCh <- buf
+			} else { // if buffer is full, drop packet
 				buf.free()
-				continue
 			}
+		}
+		l.connsMu.RUnlock()
 
-			connCh = newConnCh
+		if !ok {
+			l.handshake(addr, buf, readErr)
 		}
+	}
+}
 
-		if len(connCh) != cap(connCh) {
-			buf.data = buf.data[:n]
-			connCh <- buf
-		} else { // if buffer is full, drop packet
+// handshake handles packets from unknown addresses,
+// the connection is created only after confirm packet with a valid cookie
+func (l *listener) handshake(addr netip.AddrPort, buf reusable[[]byte], readErr *error) {
+	if l.protection != nil {
+		opened, err := l.protection.open(buf.data)
+		if err != nil {
 			buf.free()
+			return
 		}
-		l.connsMu.RUnlock()
+		buf.data = opened
 	}
+	p, err := decodePacket(buf.data)
+	if err != nil || !p.isCommand {
+		buf.free()
+		return
+	}
+	if !isSupportedVersion(p.version) { // the client may start the handshake again with the common version
+		buf.free()
+		if p.version != negotiationVersion {
+			l.writeTo(versionsPacket(supportedVersions), addr)
+		}
+		return
+	}
+	command, payload, err := commandPacketType(p)
+	if err != nil {
+		buf.free()
+		return
+	}
+
+	switch command {
+	case commandInitialConn:
+		defer buf.free()
+		params, err := decodeTransportParameters(payload)
+		if err != nil {
+			return
+		}
+		if l.validate(params) != nil || !l.canAccept() {
+			l.refuse(addr)
+			return
+		}
+
+		l.writeTo(acceptConnectionPacket(l.cookies.new(addr, time.Now()), l.opts.transportParameters()), addr)
+	case commandConfirmConn:
+		cookie, params, err := decodeCookieAndParameters(payload)
+		if err != nil || !l.cookies.valid(cookie, addr, time.Now()) {
+			buf.free()
+			return
+		}
+		if l.validate(params) != nil || !l.canAccept() {
+			buf.free()
+			l.refuse(addr)
+			return
+		}
+		if !l.cookies.use(cookie, time.Now()) { // replayed confirm of the closed connection
+			buf.free()
+			return
+		}
+
+		l.connsMu.Lock()
+		connCh := l.lockedNewConn(addr, params, cookie, readErr)
+		l.connsMu.Unlock()
+		connCh <- buf                // confirm is the first packet of the connection, in pre-shared key mode it is already opened
+		if l.newConnsClosed.Load() { // listener was closed while creating the connection
+			l.closeNotAccepted()
+		}
+	default:
+		buf.free()
+	}
+}
+
+// validate checks parameters of the client,
+// in pre-shared key mode they must have the nonce for keys of the connection
+func (l *listener) validate(params transportParameters) error {
+	if l.opts.psk != nil && len(params.nonce) != pskNonceSize {
+		return errInvalidTransportParameters
+	}
+	return params.validate(l.opts.messages)
+}
+
+func (l *listener) canAccept() bool {
+	return !l.newConnsClosed.Load() && len(l.newConns) != cap(l.newConns)
+}
+
+// refuse answers with close command, so the client don't need to wait for timeout
+func (l *listener) refuse(addr netip.AddrPort) {
+	l.writeTo(closeConnectionPacket(0), addr)
+}
+
+func (l *listener) writeTo(p packet, addr netip.AddrPort) {
+	data := getBuf(p.len())
+	packetSize, err := p.encode(data.data)
+	if err != nil { // should never happen
+		panic(err)
+	}
+	b := data.data[:packetSize]
+	if l.protection != nil {
+		b = l.protection.seal(make([]byte, 0, packetSize+sealOverhead+1), b)
+	}
+	l.src.WriteToUDPAddrPort(b, addr)
+	data.free()
 }
 
 func (l *listener) tryCloseSrc() error {
@@ -141,32 +330,63 @@ func (w connWriter) Write(b []byte) (int, error) {
 func (l *listener) onConnCLose(addr netip.AddrPort) func() error {
 	return func() error {
 		l.connsMu.Lock()
-		l.conns[addr] <- reusable[[]byte]{}
-		delete(l.conns, addr)
+		if connCh, ok := l.conns[addr]; ok { // map is cleared if main connection failed
+			close(connCh)
+			delete(l.conns, addr)
+		}
 		l.connsMu.Unlock()
 		return l.tryCloseSrc()
 	}
 }
 
-func (l *listener) lockedNewConn(addr netip.AddrPort, readErr *error) chan<- reusable[[]byte] {
-	if l.newConnsClosed.Load() {
-		close(l.newConns)
-		return nil
-	}
+func (l *listener) lockedNewConn(addr netip.AddrPort, params transportParameters, cookie []byte, readErr *error) chan<- reusable[[]byte] {
+	readCh := make(chan reusable[[]byte], l.opts.connBuffer)
 
-	if len(l.newConns) == cap(l.newConns) {
-		return nil
-	} // if buffer is full, drop connection
-
-	readCh := make(chan reusable[[]byte], connCap)
-
-	conn := newConn(readCh, readErr, connWriter{addr: addr, srv: l.src}, l.onConnCLose(addr))
+	out, opener := l.opts.protect(connWriter{addr: addr, srv: l.src}, false, params.nonce, cookie)
+	conn := newConn(l.opts, readCh, readErr, out, l.onConnCLose(addr))
+	conn.opener = opener
+	conn.flight.overhead = l.opts.overhead()
+	conn.nextStreamID, conn.nextPeerStreamID = 1, 0 // streams opened by the dialer are even
+	lc := &lconn{conn: conn, addr: addr}
+	conn.addrs = lc
+	conn.setPeerParameters(params)
 
 	l.conns[addr] = readCh
-	l.newConns <- &lconn{conn: conn, addr: addr}
+	if l.opts.tls != nil {
+		conn.crypto = make(chan cryptoData, cryptoCap)
+		go l.acceptTLS(lc, params)
+		return readCh
+	}
+	if l.dontFragment {
+		conn.startPathMTUDiscovery(params)
+	}
+	l.newConns <- lc
 	return readCh
 }
 
+// acceptTLS passes the connection to Accept after the TLS handshake
+func (l *listener) acceptTLS(lc *lconn, params transportParameters) {
+	qc := tls.QUICServer(&tls.QUICConfig{TLSConfig: tlsConfig(l.opts.tls)})
+	if err := lc.tlsHandshake(qc, l.opts.transportParameters(), params); err != nil {
+		lc.close(err, false)
+		return
+	}
+	if l.dontFragment { // after the TLS handshake, so probes are sealed like other packets
+		lc.startPathMTUDiscovery(params)
+	}
+
+	select {
+	case l.newConns <- lc:
+		if l.newConnsClosed.Load() { // listener was closed while the handshake was done
+			l.closeNotAccepted()
+		}
+	default: // too many not accepted connections
+		lc.close(errConnRefused, false)
+	}
+}
+
+var _ MessageConn = (*lconn)(nil)
+
 type lconn struct {
 	*conn
 	addr netip.AddrPort
@@ -187,18 +407,3 @@ func (c *lconn) RemoteAddr() net.Addr {
 
 	return net.UDPAddrFromAddrPort(c.addr)
 }
-
-// For now SUDP doesn't support deadline
-func (c *lconn) SetDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
-
-// For now SUDP doesn't support deadline
-func (c *lconn) SetReadDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
-
-// For now SUDP doesn't support deadline
-func (c *lconn) SetWriteDeadline(t time.Time) error {
-	return fmt.Errorf("%w: temporarily not implemented", errors.ErrUnsupported)
-}
@@ -1,10 +1,14 @@
 package sudp
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -59,32 +63,142 @@ func TestListener_Accept(t *testing.T) {
 		wg.Wait()
 	})
 
-	t.Run("Should drop connections if newConns buffer is full", func(t *testing.T) {
+	t.Run("Should refuse connections if newConns buffer is full", func(t *testing.T) {
 		assert := assert.New(t)
 		l, err := Listen("udp", "127.0.0.1:0")
 		assert.NoError(err)
-		var idleClients sync.WaitGroup
+		defer func() {
+			assert.NoError(l.Close())
+		}()
 
 		for range newConnsCap {
-			idleClients.Go(func() {
-				periodicalClientMsg(assert, l.Addr().String(), []byte{1, 2, 3}, 1, 0)
-			})
+			conn, err := Dial("udp", l.Addr().String())
+			assert.NoError(err)
+			defer conn.Close()
 		}
-		idleClients.Wait()
+		assert.Eventually(func() bool {
+			return len(l.(*listener).newConns) == newConnsCap
+		}, 10*initialRTO, 10*time.Millisecond, "all connections should be confirmed")
 
-		// all clients sended messages, so buffer should be full
+		conn, err := Dial("udp", l.Addr().String())
+
+		assert.Nil(conn)
+		assert.ErrorIs(err, syscall.ECONNREFUSED)
+	})
 
+	t.Run("Should refuse connections after close", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
 		conn, err := Dial("udp", l.Addr().String())
 		assert.NoError(err)
+		defer conn.Close()
+
+		assert.NoError(l.Close())
+		conn, err = Dial("udp", l.Addr().String())
+
+		assert.Nil(conn)
+		assert.ErrorIs(err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("Should not create connections from packets without handshake", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
 		defer func() {
-			assert.NoError(conn.Close())
+			assert.NoError(l.Close())
 		}()
+		src, err := net.Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		defer src.Close()
+
+		buf := make([]byte, maxPacketSize)
+		for _, p := range []packet{
+			dataPacket(0, []byte("Hello")),
+			closeConnectionPacket(0),
+			confirmConnectionPacket(0, make([]byte, cookieSize), defaultOptions().transportParameters()),
+			initialConnectionPacket(defaultOptions().transportParameters()),
+		} {
+			n, err := p.encode(buf)
+			assert.NoError(err)
+			_, err = src.Write(buf[:n])
+			assert.NoError(err)
+		}
 
-		_, err = conn.Write([]byte{1, 2, 3})
+		// only initial packet should be answered
+		src.SetReadDeadline(time.Now().Add(initialRTO))
+		n, err := src.Read(buf)
 		assert.NoError(err)
+		p, err := decodePacket(buf[:n])
+		assert.NoError(err)
+		tp, _, err := commandPacketType(p)
+		assert.NoError(err)
+		assert.Equal(commandAcceptConn, tp)
 
-		_, err = conn.Read(make([]byte, 1024))
-		assert.ErrorIs(err, net.ErrClosed)
+		l.(*listener).connsMu.RLock()
+		assert.Empty(l.(*listener).conns)
+		l.(*listener).connsMu.RUnlock()
+		assert.Empty(l.(*listener).newConns)
+	})
+
+	t.Run("Should not create connection again from replayed confirm", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer func() {
+			assert.NoError(l.Close())
+		}()
+		src, err := net.Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		defer src.Close()
+		conns := func() int {
+			l.(*listener).connsMu.RLock()
+			defer l.(*listener).connsMu.RUnlock()
+			return len(l.(*listener).conns)
+		}
+
+		confirm := rawHandshake(assert, src)
+		c, err := l.Accept()
+		assert.NoError(err)
+		defer c.Close()
+		writeRawPacket(assert, src, closeConnectionPacket(1))
+		assert.Eventually(func() bool { return conns() == 0 }, time.Second, time.Millisecond)
+
+		writeRawPacket(assert, src, confirm)
+		time.Sleep(50 * time.Millisecond)
+		assert.Zero(conns())
+		assert.Empty(l.(*listener).newConns)
+	})
+
+	t.Run("Should answer packets of unsupported versions with supported versions", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer func() {
+			assert.NoError(l.Close())
+		}()
+		src, err := net.Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		defer src.Close()
+		params := defaultOptions().transportParameters()
+		params.version = 5
+
+		buf := make([]byte, maxPacketSize)
+		n, err := initialConnectionPacket(params).encode(buf)
+		assert.NoError(err)
+		_, err = src.Write(buf[:n])
+		assert.NoError(err)
+
+		src.SetReadDeadline(time.Now().Add(initialRTO))
+		n, err = src.Read(buf)
+		assert.NoError(err)
+		p, err := decodePacket(buf[:n])
+		assert.NoError(err)
+		assert.EqualValues(negotiationVersion, p.version)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		assert.Equal(commandVersions, tp)
+		assert.Equal(supportedVersions, payload)
 	})
 }
 
@@ -94,15 +208,14 @@ func TestListener_Close(t *testing.T) {
 		l, err := Listen("udp", "127.0.0.1:0")
 		assert.NoError(err)
 
-		go periodicalClientMsg(assert, l.Addr().String(), []byte{1, 2, 3}, 10, time.Millisecond)
-		go periodicalClientMsg(assert, l.Addr().String(), []byte{4, 5, 6}, 10, time.Millisecond)
+		var wg sync.WaitGroup
+		wg.Go(func() { periodicalClientMsg(assert, l.Addr().String(), []byte{1, 2, 3}, 10, time.Millisecond) })
+		wg.Go(func() { periodicalClientMsg(assert, l.Addr().String(), []byte{4, 5, 6}, 10, time.Millisecond) })
 		conn, err := l.Accept()
 		assert.NoError(err)
-		buf := make([]byte, 1024)
-		for range 10 {
-			_, err = conn.Read(buf)
-			assert.NoError(err)
-		}
+		_, err = io.ReadFull(conn, make([]byte, 10*3))
+		assert.NoError(err)
+		wg.Wait() // not accepted client would fail to write after close
 		assert.NoError(conn.Close())
 		err = l.Close()
 		assert.NoError(err)
@@ -258,8 +371,7 @@ func TestListenerConn_Close(t *testing.T) {
 		lstnClosedCond.Broadcast()
 		wg.Wait()
 
-		err = l.(*listener).src.Close()
-		assert.ErrorIs(err, net.ErrClosed)
+		assertSrcClosed(assert, l.(*listener))
 	})
 
 	t.Run("When all connections are closed and then listener is closed main connection should be closed", func(t *testing.T) {
@@ -284,42 +396,164 @@ func TestListenerConn_Close(t *testing.T) {
 		wg.Wait()
 		assert.NoError(l.Close())
 
-		err = l.(*listener).src.Close()
-		assert.ErrorIs(err, net.ErrClosed)
+		assertSrcClosed(assert, l.(*listener))
 	})
 }
 
 func TestListenerConn_SetDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should time out reading and writing", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := lconn{}
+		clConn, conn, closeAll := dialedPair(assert)
+		defer closeAll()
 
-		err := conn.SetDeadline(time.Now())
+		assert.NoError(conn.SetDeadline(time.Now().Add(-time.Second)))
+		_, err := conn.Read(make([]byte, 8))
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+		_, err = conn.Write([]byte{1, 2, 3})
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		assert.NoError(conn.SetDeadline(time.Time{}))
+		_, err = clConn.Write([]byte{4, 5, 6})
+		assert.NoError(err)
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{4, 5, 6}, buf[:n])
 	})
 }
 
 func TestListenerConn_SetReadDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should unblock read with timeout error", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := lconn{}
+		_, conn, closeAll := dialedPair(assert)
+		defer closeAll()
 
-		err := conn.SetReadDeadline(time.Now())
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+		n, err := conn.Read(make([]byte, 8))
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		assert.Zero(n)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
 	})
 }
 
 func TestListenerConn_SetWriteDeadline(t *testing.T) {
-	t.Run("Should be unsupported", func(t *testing.T) {
+	t.Run("Should write after deadline is cleared", func(t *testing.T) {
 		assert := assert.New(t)
-		conn := lconn{}
+		clConn, conn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		assert.NoError(conn.SetWriteDeadline(time.Now()))
+		_, err := conn.Write([]byte{1, 2, 3})
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+		assert.NoError(conn.SetWriteDeadline(time.Time{}))
+		_, err = conn.Write([]byte{4, 5, 6})
+		assert.NoError(err)
+
+		buf := make([]byte, 8)
+		n, err := clConn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{4, 5, 6}, buf[:n])
+	})
+}
 
-		err := conn.SetWriteDeadline(time.Now())
+func TestListenerConn_IdleTimeout(t *testing.T) {
+	t.Run("Silent connection should be closed on both sides", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
+		clConn, err := Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		conn, err := l.Accept()
+		assert.NoError(err)
 
-		assert.ErrorIs(err, errors.ErrUnsupported)
+		for _, c := range []net.Conn{clConn, conn} {
+			assert.NoError(c.(Conn).SetKeepAlive(false))
+			assert.NoError(c.(Conn).SetIdleTimeout(initialRTO))
+		}
+		_, err = clConn.Read(make([]byte, 8))
+		assert.ErrorIs(err, ErrIdleTimeout)
+		_, err = conn.Read(make([]byte, 8))
+		assert.ErrorIs(err, ErrIdleTimeout)
+
+		lst := l.(*listener)
+		lst.connsMu.RLock()
+		assert.Empty(lst.conns)
+		lst.connsMu.RUnlock()
 	})
+
+	t.Run("Peer that doesn't answer keepalive should be idle", func(t *testing.T) {
+		assert := assert.New(t)
+		l, err := Listen("udp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
+		src, err := net.Dial("udp", l.Addr().String())
+		assert.NoError(err)
+		defer src.Close()
+
+		rawHandshake(assert, src) // the peer is silent after the handshake
+		conn, err := l.Accept()
+		assert.NoError(err)
+		assert.NoError(conn.(Conn).SetKeepAlivePeriod(100 * time.Millisecond))
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout)))
+		_, err = conn.Read(make([]byte, 8))
+
+		assert.ErrorIs(err, ErrIdleTimeout)
+	})
+
+	t.Run("Keepalive should prevent idle timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		clConn, conn, closeAll := dialedPair(assert)
+		defer closeAll()
+
+		for _, c := range []net.Conn{clConn, conn} {
+			assert.NoError(c.(Conn).SetKeepAlivePeriod(100 * time.Millisecond))
+			assert.NoError(c.(Conn).SetIdleTimeout(time.Second))
+		}
+		time.Sleep(2 * time.Second)
+
+		_, err := clConn.Write([]byte{1, 2, 3})
+		assert.NoError(err)
+		buf := make([]byte, 8)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+	})
+}
+
+// rawHandshake opens the connection from src without [Dial],
+// it returns the sent confirm packet
+func rawHandshake(assert *assert.Assertions, src net.Conn) packet {
+	writeRawPacket(assert, src, initialConnectionPacket(defaultOptions().transportParameters()))
+	buf := make([]byte, maxPacketSize)
+	src.SetReadDeadline(time.Now().Add(initialRTO))
+	n, err := src.Read(buf)
+	assert.NoError(err)
+	p, err := decodePacket(buf[:n])
+	assert.NoError(err)
+	_, payload, err := commandPacketType(p)
+	assert.NoError(err)
+	cookie, _, err := decodeCookieAndParameters(payload)
+	assert.NoError(err)
+
+	confirm := confirmConnectionPacket(0, bytes.Clone(cookie), defaultOptions().transportParameters())
+	writeRawPacket(assert, src, confirm)
+	return confirm
+}
+
+func writeRawPacket(assert *assert.Assertions, src net.Conn, p packet) {
+	buf := make([]byte, p.len())
+	n, err := p.encode(buf)
+	assert.NoError(err)
+	_, err = src.Write(buf[:n])
+	assert.NoError(err)
+}
+
+// connections are closed with fin, so the main connection is closed after their time wait
+func assertSrcClosed(assert *assert.Assertions, l *listener) {
+	assert.Eventually(func() bool {
+		return errors.Is(l.src.SetReadDeadline(time.Time{}), net.ErrClosed)
+	}, 2*timeWaitRTOs*initialRTO, 10*time.Millisecond, "main connection should be closed")
 }
 
 func periodicalClientMsg(assert *assert.Assertions,
@@ -0,0 +1,90 @@
+package sudp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// the pacer allows the burst of this size after the idle time (like the initial window)
+	pacingBurst = 10 * congestionMSS
+	// timers are not precise, so the burst is never smaller than the data of this time
+	pacingGranularity = 2 * time.Millisecond
+)
+
+// pacer spreads packets of the connection over time at the pacing rate (RFC 9002),
+// so the whole window is not written at once and it doesn't overflow shallow buffers on the path.
+// It is the writer of groups, so first sends and retransmissions are paced,
+// while commands sent out of groups (like received packets) are not.
+// Groups wait with [pacer.wait] without holding their packets and then write with [pacer.writeNow].
+type pacer struct {
+	w    io.Writer
+	rate func() int // bytes per second, zero means without pacing
+	stop <-chan struct{}
+
+	mu     sync.Mutex
+	tokens float64 // bytes that may be written now, negative if they are reserved by waiting writes
+	last   time.Time
+}
+
+func newPacer(w io.Writer, rate func() int, stop <-chan struct{}) *pacer {
+	return &pacer{
+		w:      w,
+		rate:   rate,
+		stop:   stop,
+		tokens: pacingBurst,
+	}
+}
+
+// Write waits until the packet may be sent at the current rate
+func (p *pacer) Write(b []byte) (int, error) {
+	if err := p.wait(len(b)); err != nil {
+		return 0, err
+	}
+	return p.writeNow(b)
+}
+
+// wait reserves size bytes and waits until they may be sent
+func (p *pacer) wait(size int) error {
+	if wait := p.reserve(size, time.Now()); wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-p.stop:
+			t.Stop()
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+// writeNow writes the packet whose bytes are already reserved by [pacer.wait]
+func (p *pacer) writeNow(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+// reserve takes size bytes from the bucket and returns how long to wait for them
+func (p *pacer) reserve(size int, now time.Time) time.Duration {
+	rate := float64(p.rate())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if rate <= 0 {
+		p.tokens, p.last = pacingBurst, now
+		return 0
+	}
+	burst := max(pacingBurst, rate*pacingGranularity.Seconds())
+	if !p.last.IsZero() {
+		p.tokens = min(p.tokens+rate*now.Sub(p.last).Seconds(), burst)
+	}
+	p.last = now
+
+	p.tokens -= float64(size)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,79 @@
+package sudp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacer(t *testing.T) {
+	t.Run("Should not wait without rate", func(t *testing.T) {
+		assert := assert.New(t)
+		out := &testPacketBuffer{t: t}
+		p := newPacer(out, func() int { return 0 }, nil)
+		packet := testPacingPacket(assert)
+
+		start := time.Now()
+		for range 3 * pacingBurst / len(packet) {
+			_, err := p.Write(packet)
+			assert.NoError(err)
+		}
+
+		assert.Less(time.Since(start), testSlack)
+	})
+
+	t.Run("Should spread packets after the burst", func(t *testing.T) {
+		assert := assert.New(t)
+		out := &testPacketBuffer{t: t}
+		packet := testPacingPacket(assert)
+		rate := 100 * len(packet) // packet every 10ms
+		p := newPacer(out, func() int { return rate }, nil)
+
+		start := time.Now()
+		for range pacingBurst/len(packet) + 3 {
+			_, err := p.Write(packet)
+			assert.NoError(err)
+		}
+
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(elapsed, 20*time.Millisecond)
+		assert.Less(elapsed, 30*time.Millisecond+testSlack)
+		assert.Len(out.Packets(), pacingBurst/len(packet)+3)
+	})
+
+	t.Run("Reserve should refill the bucket with time", func(t *testing.T) {
+		assert := assert.New(t)
+		p := newPacer(nil, func() int { return 1000 }, nil)
+		now := time.Now()
+
+		assert.Zero(p.reserve(pacingBurst, now))
+		assert.Equal(100*time.Millisecond, p.reserve(100, now))
+		assert.Equal(50*time.Millisecond, p.reserve(50, now.Add(100*time.Millisecond)))
+		assert.Zero(p.reserve(pacingBurst, now.Add(time.Hour)), "bucket should be full after idle time")
+	})
+
+	t.Run("Waiting write should fail after stop", func(t *testing.T) {
+		assert := assert.New(t)
+		out := &testPacketBuffer{t: t}
+		stop := make(chan struct{})
+		p := newPacer(out, func() int { return 1 }, stop)
+		packet := testPacingPacket(assert)
+		p.reserve(pacingBurst, time.Now())
+
+		time.AfterFunc(testSlack, func() { close(stop) })
+		n, err := p.Write(packet)
+
+		assert.Zero(n)
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.Empty(out.Packets())
+	})
+}
+
+func testPacingPacket(assert *assert.Assertions) []byte {
+	buf := make([]byte, ethernetPacketSize)
+	n, err := dataPacket(0, make([]byte, ethernetPacketSize-headerSize)).encode(buf)
+	assert.NoError(err)
+	return buf[:n]
+}
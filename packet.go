@@ -1,8 +1,11 @@
 package sudp
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 )
 
 /*
@@ -19,11 +22,14 @@ import (
    +                     ....                      +
 
    * - is_command
+
+	Version 0 is reserved for version negotiation packets (see handshake.go),
+	their format doesn't depend on versions of peers.
 */
 
 type packet struct {
 	header        // 3 bytes
-	data   []byte // max 1469 bytes
+	data   []byte // max 8969 bytes
 }
 
 type header struct {
@@ -32,39 +38,175 @@ type header struct {
 	number    uint32 // uint20 (not for receivedPackets)
 }
 
-// 1500 (MTU) - 20 (IP header) - 8 (UDP header) = 1472 bytes
+// The size of packets is discovered for every path (see pmtud.go):
+// minPacketSize is carried by any path,
+// 1280 (IPv6 minimum MTU) - 40 (IPv6 header) - 8 (UDP header) = 1232 bytes,
+// maxPacketSize is the largest size that is probed,
+// 9000 (jumbo frame MTU) - 20 (IP header) - 8 (UDP header) = 8972 bytes
 const (
-	maxPacketSize = 1472
+	minPacketSize = 1232
+	maxPacketSize = 8972
 	headerSize    = 3
+	minDataSize   = minPacketSize - headerSize
 	maxDataSize   = maxPacketSize - headerSize
 
+	// 1500 (ethernet MTU) - 20 (IPv4 header) - 8 (UDP header) = 1472 bytes
+	ethernetPacketSize = 1472
+
 	maxPacketNumber = 1<<20 - 1
 
+	protocolVersion    = 1
+	negotiationVersion = 0
+
 	coloseConnFlag      = 0b10101010
+	resetFlag           = 0b10101011
 	receivedPacketsFlag = 0b11110000
+	initialConnFlag     = 0b11000011
+	acceptConnFlag      = 0b11001100
+	confirmConnFlag     = 0b11111111
+	versionsFlag        = 0b11100111
+	pingFlag            = 0b10011001
+	finFlag             = 0b10000001
+	finAckFlag          = 0b10000010
+	probeFlag           = 0b10100101
+	probeAckFlag        = 0b10100110
+	datagramFlag        = 0b10110100
+	repairFlag          = 0b10110010
+	forwardFlag         = 0b10111000
+	streamFlag          = 0b10111100
+	streamFinFlag       = 0b10111101
+	streamWindowFlag    = 0b10111110
+	cryptoFlag          = 0b10111111
+
+	// flag, ack delay (uint24 of microseconds), limit and cumulative (uint20 in 3 bytes)
+	receivedPacketsHeaderSize = 1 + 3 + 3 + 3
+	maxAckDelayField          = (1<<24 - 1) * time.Microsecond
+	// received packets always fit in one packet,
+	// the receiver chooses which blocks to send if it has more of them
+	maxAckBlocks = 32
+	_            = uint(minDataSize - receivedPacketsHeaderSize - maxAckBlocks*5) // must fit
 )
 
+// packet numbers
+
+// Since the number is only 20 bits long, it wraps around after maxPacketNumber,
+// so numbers must be compared with serial number arithmetic (RFC 1982):
+// a is considered to be before b if b is less than half of the number space ahead of a
+const packetNumberSpace = maxPacketNumber + 1
+
+func nextPacketNumber(n uint32) uint32 {
+	return (n + 1) & maxPacketNumber
+}
+
+func addPacketNumber(n uint32, d int) uint32 {
+	return uint32(int64(n)+int64(d)) & maxPacketNumber
+}
+
+// returns the shortest signed distance a - b
+func packetNumberDiff(a, b uint32) int {
+	d := int((a - b) & maxPacketNumber)
+	if d >= packetNumberSpace/2 {
+		d -= packetNumberSpace
+	}
+	return d
+}
+
 // command packets
 type command int
 
 const (
 	commandCloseConn command = iota
 	commandReceivedPackets
+	commandInitialConn
+	commandAcceptConn
+	commandConfirmConn
+	commandPing
+	commandFin
+	commandFinAck
+	commandProbe
+	commandProbeAck
+	commandDatagram
+	commandForward
+	commandStream
+	commandStreamFin
+	commandStreamWindow
+	commandCrypto
+	commandRepair
+	commandVersions
+	commandReset
 )
 
+// handshake commands are not part of the connection packet flow (except confirm),
+// so they should be handled before the connection is created
+func (c command) isHandshake() bool {
+	return c == commandInitialConn || c == commandAcceptConn || c == commandVersions
+}
+
+// unnumbered commands use the number field for their own purpose,
+// so they are not part of the connection packet flow
+func (c command) isUnnumbered() bool {
+	return c == commandReceivedPackets || c == commandFinAck ||
+		c == commandProbe || c == commandProbeAck || c == commandDatagram ||
+		c == commandForward || c == commandRepair
+}
+
 var (
 	errUnknownCommand     = errors.New("unknown command")
 	errInvalidRangeFormat = errors.New("invalid range format")
 	errTooSmallPacket     = errors.New("too small packet")
 	errTooSmallBuffer     = errors.New("too small buffer")
+	errInvalidProbeAck    = errors.New("invalid probe ack")
+	errInvalidStreamFrame = errors.New("invalid stream frame")
+	errInvalidCryptoFrame = errors.New("invalid crypto frame")
+	errInvalidRepair      = errors.New("invalid repair packet")
+	errInvalidVersions    = errors.New("invalid list of versions")
+	errInvalidReset       = errors.New("invalid reset")
 )
 
 func commandPacketType(p packet) (tp command, payload []byte, err error) {
+	if len(p.data) == 0 {
+		return 0, nil, errUnknownCommand
+	}
+
 	switch p.data[0] {
 	case coloseConnFlag:
 		return commandCloseConn, nil, nil
 	case receivedPacketsFlag:
 		return commandReceivedPackets, p.data[1:], nil
+	case initialConnFlag:
+		return commandInitialConn, p.data[1:], nil
+	case acceptConnFlag:
+		return commandAcceptConn, p.data[1:], nil
+	case confirmConnFlag:
+		return commandConfirmConn, p.data[1:], nil
+	case pingFlag:
+		return commandPing, nil, nil
+	case finFlag:
+		return commandFin, nil, nil
+	case finAckFlag:
+		return commandFinAck, nil, nil
+	case probeFlag:
+		return commandProbe, p.data[1:], nil
+	case probeAckFlag:
+		return commandProbeAck, p.data[1:], nil
+	case datagramFlag:
+		return commandDatagram, p.data[1:], nil
+	case forwardFlag:
+		return commandForward, nil, nil
+	case streamFlag:
+		return commandStream, p.data[1:], nil
+	case streamFinFlag:
+		return commandStreamFin, p.data[1:], nil
+	case streamWindowFlag:
+		return commandStreamWindow, p.data[1:], nil
+	case cryptoFlag:
+		return commandCrypto, p.data[1:], nil
+	case repairFlag:
+		return commandRepair, p.data[1:], nil
+	case versionsFlag:
+		return commandVersions, p.data[1:], nil
+	case resetFlag:
+		return commandReset, p.data[1:], nil
 	default:
 		return 0, nil, errUnknownCommand
 	}
@@ -77,7 +219,7 @@ func closeConnectionPacket(number uint32) packet {
 
 	return packet{
 		header: header{
-			version:   1,
+			version:   protocolVersion,
 			isCommand: true,
 			number:    number,
 		},
@@ -85,35 +227,314 @@ func closeConnectionPacket(number uint32) packet {
 	}
 }
 
-// received packets must be described by ranges (with inclusive bounds), for example:
+// maxResetReasonSize limits the reason of reset, so it always fits in one packet
+const maxResetReasonSize = 256
+
+// reset packet closes the connection like close command,
+// but it carries the application error code and the reason
+func resetPacket(number uint32, code uint64, reason string) packet {
+	if number > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	if len(reason) > maxResetReasonSize {
+		panic("reason size overflow")
+	}
+
+	data := binary.BigEndian.AppendUint64([]byte{resetFlag}, code)
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: append(data, reason...),
+	}
+}
+
+func decodeReset(payload []byte) (code uint64, reason string, err error) {
+	if len(payload) < 8 || len(payload) > 8+maxResetReasonSize {
+		return 0, "", errInvalidReset
+	}
+	return binary.BigEndian.Uint64(payload), string(payload[8:]), nil
+}
+
+// ping packet has no payload, it is sent reliably,
+// so the acknowledgement of it is the proof that the peer is alive
+func pingPacket(number uint32) packet {
+	if number > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: []byte{pingFlag},
+	}
+}
+
+// fin packet is the last packet of the connection packet flow,
+// so it is handled only after all previous packets are received
+func finPacket(number uint32) packet {
+	if number > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: []byte{finFlag},
+	}
+}
+
+// fin ack packet is not numbered, it contains the number of acknowledged fin
+func finAckPacket(finNumber uint32) packet {
+	if finNumber > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    finNumber,
+		},
+		data: []byte{finAckFlag},
+	}
+}
+
+// probe packet is padded to size bytes to check that the path carries packets of this size,
+// it is not numbered and not resent (see pmtud.go)
+func probePacket(size int) packet {
+	if size < headerSize+1 || size > maxPacketSize {
+		panic("invalid probe size")
+	}
+
+	data := make([]byte, size-headerSize)
+	data[0] = probeFlag
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+		},
+		data: data,
+	}
+}
+
+// probe ack packet is not numbered, it contains the size of the received probe
+func probeAckPacket(size int) packet {
+	if size > maxPacketSize {
+		panic("invalid probe size")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+		},
+		data: []byte{probeAckFlag, byte(size >> 8), byte(size)},
+	}
+}
+
+// payload is without flag
+func decodeProbeAck(payload []byte) (size int, err error) {
+	if len(payload) != 2 {
+		return 0, errInvalidProbeAck
+	}
+	return int(payload[0])<<8 | int(payload[1]), nil
+}
+
+// forward packet tells the receiver that packets before the number are abandoned by the sender
+// or already received, so it should not wait for them (like forward TSN in RFC 3758)
+func forwardPacket(to uint32) packet {
+	if to > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    to,
+		},
+		data: []byte{forwardFlag},
+	}
+}
+
+// datagram packet is not numbered, so it is not acknowledged, resent and ordered
+func datagramPacket(data []byte) packet {
+	if len(data) > maxDataSize-1 {
+		panic("data size overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+		},
+		data: append([]byte{datagramFlag}, data...),
+	}
+}
+
+// handshake packets (see handshake.go)
+
+// initial packet is sent by the client to open the connection,
+// it is not part of the connection packet flow, so it has no number
+// initial packet has the version of the parameters, which the client tries
+func initialConnectionPacket(params transportParameters) packet {
+	return packet{
+		header: header{
+			version:   params.version,
+			isCommand: true,
+		},
+		data: params.append([]byte{initialConnFlag}),
+	}
+}
+
+// versions packet is the server response to the packet of unsupported version,
+// it lists supported versions from the best one
+func versionsPacket(versions []byte) packet {
+	return packet{
+		header: header{
+			version:   negotiationVersion,
+			isCommand: true,
+		},
+		data: append([]byte{versionsFlag}, versions...),
+	}
+}
+
+func decodeVersions(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errInvalidVersions
+	}
+	for _, v := range payload {
+		if v == negotiationVersion || v > 0b111 {
+			return nil, errInvalidVersions
+		}
+	}
+	return payload, nil
+}
+
+// accept packet is the server response to the initial packet,
+// it is not part of the connection packet flow, so it has no number
+func acceptConnectionPacket(cookie []byte, params transportParameters) packet {
+	if len(cookie) != cookieSize {
+		panic("invalid cookie size")
+	}
+
+	data := append([]byte{acceptConnFlag}, cookie...)
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+		},
+		data: params.append(data),
+	}
+}
+
+// confirm packet is the first packet of the client connection
+func confirmConnectionPacket(number uint32, cookie []byte, params transportParameters) packet {
+	if number > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	if len(cookie) != cookieSize {
+		panic("invalid cookie size")
+	}
+
+	data := append([]byte{confirmConnFlag}, cookie...)
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: params.append(data),
+	}
+}
+
+// payload of accept and confirm packets
+func decodeCookieAndParameters(payload []byte) (cookie []byte, params transportParameters, err error) {
+	if len(payload) < cookieSize {
+		return nil, transportParameters{}, errInvalidTransportParameters
+	}
+
+	params, err = decodeTransportParameters(payload[cookieSize:])
+	return payload[:cookieSize], params, err
+}
+
+// receivedPackets is the payload of the received packets command:
+//
+//	| flag | ack delay (3 bytes) | limit (3 bytes) | cumulative (3 bytes) | blocks (5 bytes each) |
+//
+// all packets before cumulative are received,
+// received packets after it are described by blocks (ranges with inclusive bounds), for example:
 //
 // if received packets are 0, 1, 2, 3, 5, 7, 8, 11, 12
 //
-// ranges are 0-3, 5-5, 7-8, 11-12
-func receivedPacketsPacket(number uint32, receivedPackets []rng[uint32]) packet {
+// cumulative is 4 and blocks are 5-5, 7-8, 11-12
+type receivedPackets struct {
+	cumulative uint32
+	// ordered, up to maxAckBlocks
+	blocks []rng[uint32]
+	// time since the newest packet was received,
+	// it is sent in microseconds and saturates at maxAckDelayField
+	ackDelay time.Duration
+	// the last packet number that the receiver is ready to receive (flow control)
+	limit uint32
+}
+
+func receivedPacketsPacket(number uint32, rp receivedPackets) packet {
 	if number > maxPacketNumber {
 		panic("uint20 overflow")
 	}
 
 	return packet{
 		header: header{
-			version:   1,
+			version:   protocolVersion,
 			isCommand: true,
 			number:    number,
 		},
-		data: encodeReceivedPackets(receivedPackets),
+		data: encodeReceivedPackets(rp),
 	}
 }
-func encodeReceivedPackets(receivedPackets []rng[uint32]) []byte {
-	dataSize := 1 + len(receivedPackets)*5
-	if dataSize > maxDataSize {
-		panic("data size overflow")
+
+// ranges returns all received packets,
+// packets before cumulative are described by the range of receivedHistory length,
+// older packets cannot wait for the acknowledgment
+func (rp receivedPackets) ranges() []rng[uint32] {
+	ranges := make([]rng[uint32], 0, len(rp.blocks)+1)
+	ranges = append(ranges, rng[uint32]{addPacketNumber(rp.cumulative, -receivedHistory), addPacketNumber(rp.cumulative, -1)})
+	return append(ranges, rp.blocks...)
+}
+
+func encodeReceivedPackets(rp receivedPackets) []byte {
+	if len(rp.blocks) > maxAckBlocks {
+		panic("too many blocks")
 	}
+	if rp.limit > maxPacketNumber || rp.cumulative > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	dataSize := receivedPacketsHeaderSize + len(rp.blocks)*5
 
-	data := make([]byte, 1+len(receivedPackets)*5)
+	data := make([]byte, dataSize)
 	data[0] = receivedPacketsFlag
-	for i, rng := range receivedPackets {
-		dataI := i*5 + 1
+	delay := uint32(min(max(rp.ackDelay, 0), maxAckDelayField) / time.Microsecond)
+	data[1] = byte(delay >> 16)
+	data[2] = byte(delay >> 8)
+	data[3] = byte(delay)
+	data[4] = byte(rp.limit >> 16)
+	data[5] = byte(rp.limit >> 8)
+	data[6] = byte(rp.limit)
+	data[7] = byte(rp.cumulative >> 16)
+	data[8] = byte(rp.cumulative >> 8)
+	data[9] = byte(rp.cumulative)
+	for i, rng := range rp.blocks {
+		dataI := i*5 + receivedPacketsHeaderSize
 		n1, n2 := rng[0], rng[1]
 		if n1 > maxPacketNumber || n2 > maxPacketNumber {
 			panic("uint20 overflow")
@@ -127,41 +548,55 @@ func encodeReceivedPackets(receivedPackets []rng[uint32]) []byte {
 	return data
 }
 
-func decodeReceivedPackets(payload []byte) ([]rng[uint32], error) {
-	if len(payload)%5 != 0 {
-		return nil, errInvalidRangeFormat
+func decodeReceivedPackets(payload []byte) (receivedPackets, error) {
+	// payload is without flag
+	blocks := (len(payload) - receivedPacketsHeaderSize + 1) / 5
+	if len(payload) < receivedPacketsHeaderSize-1 || (len(payload)-receivedPacketsHeaderSize+1)%5 != 0 || blocks > maxAckBlocks {
+		return receivedPackets{}, errInvalidRangeFormat
 	}
 
-	ranges := make([]rng[uint32], 0, len(payload)/5*2)
+	var rp receivedPackets
+	delay := uint32(payload[0])<<16 | uint32(payload[1])<<8 | uint32(payload[2])
+	rp.ackDelay = time.Duration(delay) * time.Microsecond
+	rp.limit = (uint32(payload[3])<<16 | uint32(payload[4])<<8 | uint32(payload[5])) & maxPacketNumber
+	rp.cumulative = (uint32(payload[6])<<16 | uint32(payload[7])<<8 | uint32(payload[8])) & maxPacketNumber
+	payload = payload[receivedPacketsHeaderSize-1:]
+
+	rp.blocks = make([]rng[uint32], 0, blocks)
 	for i := 0; i < len(payload); i += 5 {
 		n1 := uint32(payload[i])<<12 | uint32(payload[i+1])<<4 | uint32(payload[i+2])>>4
 		n2 := uint32(payload[i+2]&0b00001111)<<16 | uint32(payload[i+3])<<8 | uint32(payload[i+4])
-		ranges = append(ranges, rng[uint32]{n1, n2})
+		rp.blocks = append(rp.blocks, rng[uint32]{n1, n2})
 	}
-	return ranges, nil
+	return rp, nil
 }
 
 // data packets
 
-func dataIntoPackets(initPacketNumber uint32, data []byte) (packets []packet, nextPacket uint32) {
-	newPackets := len(data)/maxDataSize + 1
-	if initPacketNumber+uint32(newPackets)-1 > maxPacketNumber {
+// dataIntoPackets splits data into packets with up to dataSize bytes of data
+func dataIntoPackets(initPacketNumber uint32, data []byte, dataSize int) (packets []packet, nextPacket uint32) {
+	if initPacketNumber > maxPacketNumber {
 		panic("uint20 overflow")
 	}
+	if dataSize <= 0 || dataSize > maxDataSize {
+		panic("invalid data size")
+	}
+	newPackets := len(data)/dataSize + 1
 
 	ps := make([]packet, 0, newPackets)
 	next := initPacketNumber
-	for len(data) > maxDataSize {
-		p := dataPacket(next, data[:maxDataSize])
-		next++
+	for len(data) > dataSize {
+		p := dataPacket(next, data[:dataSize])
+		next = nextPacketNumber(next)
 		ps = append(ps, p)
-		data = data[maxDataSize:]
+		data = data[dataSize:]
 	}
 	p := dataPacket(next, data)
-	next++
+	next = nextPacketNumber(next)
 	ps = append(ps, p)
 	return ps, next
 }
+
 func dataPacket(number uint32, data []byte) packet {
 	if len(data) > maxDataSize {
 		panic("data size overflow")
@@ -169,7 +604,7 @@ func dataPacket(number uint32, data []byte) packet {
 
 	return packet{
 		header: header{
-			version:   1,
+			version:   protocolVersion,
 			isCommand: false,
 			number:    number,
 		},
@@ -177,8 +612,223 @@ func dataPacket(number uint32, data []byte) packet {
 	}
 }
 
+// message mode: data of every packet starts with the fragment flags,
+// so the receiver knows where the message starts and ends
+
+const (
+	fragmentHeaderSize = 1
+	lastFragmentFlag   = 0b00000001
+	firstFragmentFlag  = 0b00000010
+	// it is never sent, the receiver puts it in place of abandoned packets (see [gapFragment])
+	gapFragmentFlag = 0b00000100
+)
+
+var errInvalidFragment = errors.New("invalid fragment")
+
+// messageIntoPackets works like [dataIntoPackets], but every packet is a fragment of the message,
+// first and last report that the message starts or ends with these packets
+func messageIntoPackets(initPacketNumber uint32, msg []byte, dataSize int, first, last bool) (packets []packet, nextPacket uint32) {
+	if dataSize <= fragmentHeaderSize || dataSize > maxDataSize {
+		panic("invalid data size")
+	}
+	fragmentSize := dataSize - fragmentHeaderSize
+
+	ps, next := dataIntoPackets(initPacketNumber, msg, fragmentSize)
+	for i := range ps {
+		data := make([]byte, fragmentHeaderSize+len(ps[i].data))
+		copy(data[fragmentHeaderSize:], ps[i].data)
+		if first && i == 0 {
+			data[0] |= firstFragmentFlag
+		}
+		if last && i == len(ps)-1 {
+			data[0] |= lastFragmentFlag
+		}
+		ps[i].data = data
+	}
+	return ps, next
+}
+
+func decodeFragment(data []byte) (fragment []byte, flags byte, err error) {
+	if len(data) < fragmentHeaderSize {
+		return nil, 0, errInvalidFragment
+	}
+	return data[fragmentHeaderSize:], data[0], nil
+}
+
+// gapFragment interrupts the message that is being reassembled,
+// because the rest of it is abandoned by the sender
+func gapFragment() reusable[[]byte] {
+	return reusable[[]byte]{
+		data: []byte{gapFragmentFlag},
+		free: func() {},
+	}
+}
+
+// streams: packets of streams are commands, so they are resent and acknowledged
+// like the rest of packets, but they are ordered by the sequence number of their stream
+// (see stream.go):
+//
+//	| flag | stream id (4 bytes) | sequence (3 bytes) | data |
+//
+// the packet without data opens the stream, the fin packet closes its write side,
+// the window packet carries the last sequence number that the receiver is ready to receive
+// in place of the sequence number
+
+const streamHeaderSize = 1 + 4 + 3
+
+type streamFrame struct {
+	id   uint32
+	seq  uint32 // uint20, the limit in window packets
+	data []byte
+}
+
+func streamPacket(number uint32, f streamFrame) packet {
+	return streamCommandPacket(number, streamFlag, f)
+}
+
+func streamFinPacket(number, id, seq uint32) packet {
+	return streamCommandPacket(number, streamFinFlag, streamFrame{id: id, seq: seq})
+}
+
+func streamWindowPacket(number, id, limit uint32) packet {
+	return streamCommandPacket(number, streamWindowFlag, streamFrame{id: id, seq: limit})
+}
+
+func streamCommandPacket(number uint32, flag byte, f streamFrame) packet {
+	if number > maxPacketNumber || f.seq > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	if len(f.data) > maxDataSize-streamHeaderSize {
+		panic("data size overflow")
+	}
+
+	data := make([]byte, streamHeaderSize+len(f.data))
+	data[0] = flag
+	data[1], data[2], data[3], data[4] = byte(f.id>>24), byte(f.id>>16), byte(f.id>>8), byte(f.id)
+	data[5], data[6], data[7] = byte(f.seq>>16), byte(f.seq>>8), byte(f.seq)
+	copy(data[streamHeaderSize:], f.data)
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: data,
+	}
+}
+
+// streamIntoPackets works like [dataIntoPackets], but packets belong to the stream
+// and take its sequence numbers starting from seq
+func streamIntoPackets(initPacketNumber, id, seq uint32, data []byte, dataSize int) (packets []packet, nextPacket, nextSeq uint32) {
+	if dataSize <= streamHeaderSize || dataSize > maxDataSize {
+		panic("invalid data size")
+	}
+
+	ps, next := dataIntoPackets(initPacketNumber, data, dataSize-streamHeaderSize)
+	for i := range ps {
+		ps[i] = streamPacket(ps[i].number, streamFrame{id: id, seq: seq, data: ps[i].data})
+		seq = nextPacketNumber(seq)
+	}
+	return ps, next, seq
+}
+
+// payload is without flag
+func decodeStreamFrame(payload []byte) (streamFrame, error) {
+	if len(payload) < streamHeaderSize-1 {
+		return streamFrame{}, errInvalidStreamFrame
+	}
+	return streamFrame{
+		id:   uint32(payload[0])<<24 | uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3]),
+		seq:  uint32(payload[4]&0b00001111)<<16 | uint32(payload[5])<<8 | uint32(payload[6]),
+		data: payload[streamHeaderSize-1:],
+	}, nil
+}
+
 // decoding
 
+// repairHeaderSize is the size of repair packet without the sum of data
+const repairHeaderSize = headerSize + 1 + 1 + 2
+
+// repair is the sum (XOR) of packets of the block (see fec.go)
+type repair struct {
+	count     int    // packets in the block, up to maxFECBlockSize
+	isCommand bool   // the sum of command bits
+	length    uint16 // the sum of lengths of data
+	sum       []byte // the sum of data, as long as the longest data of the block
+}
+
+// repair packet is not numbered, the number is the first packet of the block
+func repairPacket(first uint32, r repair) packet {
+	if first > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	if r.count > maxFECBlockSize {
+		panic("block size overflow")
+	}
+	if len(r.sum) > maxPacketSize-repairHeaderSize {
+		panic("data size overflow")
+	}
+
+	countAndCommand := byte(r.count)
+	if r.isCommand {
+		countAndCommand |= 0b10000000
+	}
+	data := append(make([]byte, 0, repairHeaderSize-headerSize+len(r.sum)), repairFlag, countAndCommand, byte(r.length>>8), byte(r.length))
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    first,
+		},
+		data: append(data, r.sum...),
+	}
+}
+
+func decodeRepair(payload []byte) (repair, error) {
+	if len(payload) < repairHeaderSize-headerSize-1 {
+		return repair{}, errInvalidRepair
+	}
+	r := repair{
+		count:     int(payload[0] &^ 0b10000000),
+		isCommand: payload[0]&0b10000000 != 0,
+		length:    uint16(payload[1])<<8 | uint16(payload[2]),
+		sum:       payload[3:],
+	}
+	if r.count < 2 || r.count > maxFECBlockSize {
+		return repair{}, errInvalidRepair
+	}
+	return r, nil
+}
+
+const cryptoHeaderSize = 1 + 1
+
+// crypto packet carries messages of the TLS handshake on their level (see tls.go),
+// they are handled in order of packets
+func cryptoPacket(number uint32, level tls.QUICEncryptionLevel, data []byte) packet {
+	if number > maxPacketNumber {
+		panic("uint20 overflow")
+	}
+	if len(data) > maxDataSize-cryptoHeaderSize {
+		panic("data size overflow")
+	}
+
+	return packet{
+		header: header{
+			version:   protocolVersion,
+			isCommand: true,
+			number:    number,
+		},
+		data: append([]byte{cryptoFlag, byte(level)}, data...),
+	}
+}
+
+func decodeCryptoFrame(payload []byte) (level tls.QUICEncryptionLevel, data []byte, err error) {
+	if len(payload) == 0 || payload[0] > byte(tls.QUICEncryptionLevelApplication) {
+		return 0, nil, errInvalidCryptoFrame
+	}
+	return tls.QUICEncryptionLevel(payload[0]), payload[1:], nil
+}
+
 func decodePacket(src []byte) (packet, error) {
 	if len(src) < headerSize {
 		return packet{}, errTooSmallPacket
@@ -237,12 +887,78 @@ func (p packet) String() string {
 	switch tp {
 	case commandCloseConn:
 		return fmt.Sprintf("{%s[CLOSE]}", p.header)
+	case commandReset:
+		code, reason, err := decodeReset(pl)
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("{%s[RESET:%d:%q]}", p.header, code, reason)
+	case commandPing:
+		return fmt.Sprintf("{%s[PING]}", p.header)
+	case commandFin:
+		return fmt.Sprintf("{%s[FIN]}", p.header)
+	case commandFinAck:
+		return fmt.Sprintf("{%s[FIN-ACK]}", p.header)
+	case commandProbe:
+		return fmt.Sprintf("{%s[PROBE:%d]}", p.header, p.len())
+	case commandDatagram:
+		return fmt.Sprintf("{%s[DATAGRAM:%v]}", p.header, pl)
+	case commandStream, commandStreamFin, commandStreamWindow:
+		f, err := decodeStreamFrame(pl)
+		if err != nil {
+			panic(err)
+		}
+		name := "STREAM"
+		if tp == commandStreamFin {
+			name = "STREAM-FIN"
+		} else if tp == commandStreamWindow {
+			name = "STREAM-WINDOW"
+		}
+		return fmt.Sprintf("{%s[%s:%d:%d]}", p.header, name, f.id, f.seq)
+	case commandCrypto:
+		level, data, err := decodeCryptoFrame(pl)
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("{%s[CRYPTO:%s:%d]}", p.header, level, len(data))
+	case commandForward:
+		return fmt.Sprintf("{%s[FORWARD]}", p.header)
+	case commandVersions:
+		return fmt.Sprintf("{%s[VERSIONS:%v]}", p.header, pl)
+	case commandRepair:
+		r, err := decodeRepair(pl)
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("{%s[REPAIR:%d:%d]}", p.header, r.count, r.length)
+	case commandProbeAck:
+		size, err := decodeProbeAck(pl)
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("{%s[PROBE-ACK:%d]}", p.header, size)
+	case commandInitialConn:
+		params, err := decodeTransportParameters(pl)
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("{%s[INITIAL:%+v]}", p.header, params)
+	case commandAcceptConn, commandConfirmConn:
+		cookie, params, err := decodeCookieAndParameters(pl)
+		if err != nil {
+			panic(err)
+		}
+		name := "ACCEPT"
+		if tp == commandConfirmConn {
+			name = "CONFIRM"
+		}
+		return fmt.Sprintf("{%s[%s:%x:%+v]}", p.header, name, cookie, params)
 	case commandReceivedPackets:
-		rngs, err := decodeReceivedPackets(pl)
+		rp, err := decodeReceivedPackets(pl)
 		if err != nil {
 			panic(err)
 		}
-		return fmt.Sprintf("{%s[RECEIVED:%v]}", p.header, rngs)
+		return fmt.Sprintf("{%s[RECEIVED:%d:%v:%s:%d]}", p.header, rp.cumulative, rp.blocks, rp.ackDelay, rp.limit)
 	default:
 		panic("unknown command")
 	}
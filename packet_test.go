@@ -2,8 +2,10 @@ package sudp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -111,26 +113,273 @@ func TestCommandPacket(t *testing.T) {
 		assert.Nil(payload)
 	})
 
+	t.Run("Fin", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := finPacket(69)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandFin, tp)
+		assert.False(tp.isUnnumbered())
+		assert.Nil(payload)
+
+		p = finAckPacket(69)
+		tp, payload, err = commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandFinAck, tp)
+		assert.True(tp.isUnnumbered())
+		assert.Nil(payload)
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := pingPacket(69)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandPing, tp)
+		assert.Nil(payload)
+	})
+
+	t.Run("Probe", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := probePacket(ethernetPacketSize)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.Equal(ethernetPacketSize, p.len(), "should be padded")
+		assert.Equal(commandProbe, tp)
+		assert.True(tp.isUnnumbered())
+		assert.Len(payload, ethernetPacketSize-headerSize-1)
+
+		p = probeAckPacket(ethernetPacketSize)
+		tp, payload, err = commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.Equal(commandProbeAck, tp)
+		assert.True(tp.isUnnumbered())
+		size, err := decodeProbeAck(payload)
+		assert.NoError(err)
+		assert.Equal(ethernetPacketSize, size)
+
+		_, err = decodeProbeAck(payload[:1])
+		assert.ErrorIs(err, errInvalidProbeAck)
+		assert.Panics(func() { _ = probePacket(maxPacketSize + 1) })
+	})
+
+	t.Run("Forward", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := forwardPacket(69)
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandForward, tp)
+		assert.True(tp.isUnnumbered())
+		assert.Nil(payload)
+		assert.Panics(func() { _ = forwardPacket(maxPacketNumber + 1) })
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := streamPacket(69, streamFrame{id: 1 << 30, seq: maxPacketNumber, data: []byte{1, 2, 3}})
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandStream, tp)
+		assert.False(tp.isUnnumbered())
+		f, err := decodeStreamFrame(payload)
+		assert.NoError(err)
+		assert.Equal(streamFrame{id: 1 << 30, seq: maxPacketNumber, data: []byte{1, 2, 3}}, f)
+
+		tp, payload, err = commandPacketType(streamWindowPacket(70, 5, 300))
+		assert.NoError(err)
+		assert.Equal(commandStreamWindow, tp)
+		f, err = decodeStreamFrame(payload)
+		assert.NoError(err)
+		assert.EqualValues(5, f.id)
+		assert.EqualValues(300, f.seq)
+		assert.Empty(f.data)
+
+		tp, _, err = commandPacketType(streamFinPacket(71, 5, 7))
+		assert.NoError(err)
+		assert.Equal(commandStreamFin, tp)
+		_, err = decodeStreamFrame(payload[:3])
+		assert.ErrorIs(err, errInvalidStreamFrame)
+	})
+
+	t.Run("Crypto", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := cryptoPacket(69, tls.QUICEncryptionLevelHandshake, []byte{1, 2, 3})
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandCrypto, tp)
+		assert.False(tp.isUnnumbered())
+		level, data, err := decodeCryptoFrame(payload)
+		assert.NoError(err)
+		assert.Equal(tls.QUICEncryptionLevelHandshake, level)
+		assert.Equal([]byte{1, 2, 3}, data)
+
+		_, _, err = decodeCryptoFrame([]byte{4})
+		assert.ErrorIs(err, errInvalidCryptoFrame)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := resetPacket(69, 1<<40, "auth failed")
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(69, p.number)
+		assert.Equal(commandReset, tp)
+		assert.False(tp.isUnnumbered())
+		code, reason, err := decodeReset(payload)
+		assert.NoError(err)
+		assert.EqualValues(1<<40, code)
+		assert.Equal("auth failed", reason)
+
+		_, _, err = decodeReset([]byte{1, 2, 3})
+		assert.ErrorIs(err, errInvalidReset)
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := versionsPacket([]byte{2, 1})
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(negotiationVersion, p.version)
+		assert.Equal(commandVersions, tp)
+		assert.True(tp.isHandshake())
+		versions, err := decodeVersions(payload)
+		assert.NoError(err)
+		assert.Equal([]byte{2, 1}, versions)
+
+		for _, invalid := range [][]byte{{}, {1, 0}, {8}} {
+			_, err = decodeVersions(invalid)
+			assert.ErrorIs(err, errInvalidVersions)
+		}
+	})
+
+	t.Run("Repair", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := repairPacket(64, repair{count: 8, isCommand: true, length: 300, sum: []byte{1, 2, 3}})
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(64, p.number)
+		assert.Equal(commandRepair, tp)
+		assert.True(tp.isUnnumbered())
+		r, err := decodeRepair(payload)
+		assert.NoError(err)
+		assert.Equal(repair{count: 8, isCommand: true, length: 300, sum: []byte{1, 2, 3}}, r)
+
+		_, err = decodeRepair([]byte{1, 0, 0})
+		assert.ErrorIs(err, errInvalidRepair)
+		_, err = decodeRepair([]byte{8})
+		assert.ErrorIs(err, errInvalidRepair)
+	})
+
+	t.Run("Stream data", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ps, nextPacket, nextSeq := streamIntoPackets(7, 3, maxPacketNumber, []byte(strings.Repeat("s", minDataSize)), minDataSize)
+
+		assert.EqualValues(9, nextPacket)
+		assert.EqualValues(1, nextSeq, "sequence numbers wrap around")
+		if assert.Len(ps, 2) {
+			assert.Equal(minPacketSize, ps[0].len())
+			_, payload, err := commandPacketType(ps[1])
+			assert.NoError(err)
+			f, err := decodeStreamFrame(payload)
+			assert.NoError(err)
+			assert.EqualValues(3, f.id)
+			assert.EqualValues(0, f.seq)
+			assert.Len(f.data, streamHeaderSize)
+		}
+	})
+
+	t.Run("Datagram", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := datagramPacket([]byte{1, 2, 3})
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.Equal(commandDatagram, tp)
+		assert.True(tp.isUnnumbered())
+		assert.Equal([]byte{1, 2, 3}, payload)
+		assert.Panics(func() { _ = datagramPacket(make([]byte, maxDataSize)) })
+	})
+
 	t.Run("Received packets", func(t *testing.T) {
 		assert := assert.New(t)
 
-		p := receivedPacketsPacket(69, []rng[uint32]{{0, 3}, {5, 5}, {7, 8}, {11, 12}})
+		p := receivedPacketsPacket(69, receivedPackets{
+			cumulative: 4,
+			blocks:     []rng[uint32]{{5, 5}, {7, 8}, {11, 12}},
+			ackDelay:   1500 * time.Microsecond,
+			limit:      4107,
+		})
 		tp, payload, err := commandPacketType(p)
 		assert.NoError(err)
-		recieved, err := decodeReceivedPackets(payload)
+		rp, err := decodeReceivedPackets(payload)
 		assert.NoError(err)
 
 		assert.True(p.isCommand)
 		assert.EqualValues(69, p.number)
 		assert.Equal(commandReceivedPackets, tp)
-		assert.Equal([]rng[uint32]{{0, 3}, {5, 5}, {7, 8}, {11, 12}}, recieved)
+		assert.Equal(1500*time.Microsecond, rp.ackDelay)
+		assert.EqualValues(4107, rp.limit)
+		assert.EqualValues(4, rp.cumulative)
+		assert.Equal([]rng[uint32]{{5, 5}, {7, 8}, {11, 12}}, rp.blocks)
+	})
+
+	t.Run("Ack delay should saturate", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := receivedPacketsPacket(69, receivedPackets{ackDelay: time.Hour})
+		_, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		rp, err := decodeReceivedPackets(payload)
+		assert.NoError(err)
+
+		assert.Equal(maxAckDelayField, rp.ackDelay)
 	})
 
 	t.Run("Invalid range format", func(t *testing.T) {
 		assert := assert.New(t)
 
 		_, err := decodeReceivedPackets([]byte{
-			245, 3, 78, 95, 33, 104,
+			245, 3, 78, 95, 33, 104, 0, 0, 0, 1,
 		})
 
 		assert.ErrorIs(err, errInvalidRangeFormat)
@@ -139,24 +388,92 @@ func TestCommandPacket(t *testing.T) {
 	t.Run("Received a lot of packets", func(t *testing.T) {
 		assert := assert.New(t)
 
-		p := receivedPacketsPacket(333, make([]rng[uint32], 293))
+		p := receivedPacketsPacket(333, receivedPackets{blocks: make([]rng[uint32], maxAckBlocks)})
 		tp, payload, err := commandPacketType(p)
 		assert.NoError(err)
-		recieved, err := decodeReceivedPackets(payload)
+		rp, err := decodeReceivedPackets(payload)
 		assert.NoError(err)
 
 		assert.True(p.isCommand)
 		assert.EqualValues(333, p.number)
 		assert.Equal(commandReceivedPackets, tp)
-		assert.Equal(make([]rng[uint32], 293), recieved)
+		assert.Equal(make([]rng[uint32], maxAckBlocks), rp.blocks)
 	})
 
 	t.Run("Should panic when too many received packets", func(t *testing.T) {
 		assert := assert.New(t)
 
 		assert.Panics(func() {
-			_ = receivedPacketsPacket(333, make([]rng[uint32], 294))
+			_ = receivedPacketsPacket(333, receivedPackets{blocks: make([]rng[uint32], maxAckBlocks+1)})
+		})
+	})
+
+	t.Run("Initial connection", func(t *testing.T) {
+		assert := assert.New(t)
+
+		p := initialConnectionPacket(defaultOptions().transportParameters())
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		params, err := decodeTransportParameters(payload)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.Equal(commandInitialConn, tp)
+		assert.True(tp.isHandshake())
+		assert.Equal(defaultOptions().transportParameters(), params)
+	})
+
+	t.Run("Accept connection", func(t *testing.T) {
+		assert := assert.New(t)
+		cookie := bytes.Repeat([]byte{69}, cookieSize)
+
+		p := acceptConnectionPacket(cookie, defaultOptions().transportParameters())
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		resCookie, params, err := decodeCookieAndParameters(payload)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.Equal(commandAcceptConn, tp)
+		assert.True(tp.isHandshake())
+		assert.Equal(cookie, resCookie)
+		assert.Equal(defaultOptions().transportParameters(), params)
+	})
+
+	t.Run("Confirm connection", func(t *testing.T) {
+		assert := assert.New(t)
+		cookie := bytes.Repeat([]byte{69}, cookieSize)
+
+		p := confirmConnectionPacket(0, cookie, defaultOptions().transportParameters())
+		tp, payload, err := commandPacketType(p)
+		assert.NoError(err)
+		resCookie, params, err := decodeCookieAndParameters(payload)
+		assert.NoError(err)
+
+		assert.True(p.isCommand)
+		assert.EqualValues(0, p.number)
+		assert.Equal(commandConfirmConn, tp)
+		assert.False(tp.isHandshake(), "confirm is part of the connection")
+		assert.Equal(cookie, resCookie)
+		assert.Equal(defaultOptions().transportParameters(), params)
+
+		_, _, err = decodeCookieAndParameters(payload[:cookieSize-1])
+		assert.ErrorIs(err, errInvalidTransportParameters)
+	})
+
+	t.Run("Empty command", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, _, err := commandPacketType(packet{
+			header{
+				version:   1,
+				isCommand: true,
+				number:    420,
+			},
+			nil,
 		})
+
+		assert.ErrorIs(err, errUnknownCommand)
 	})
 
 	t.Run("Unknown command", func(t *testing.T) {
@@ -179,7 +496,7 @@ func TestDataPacket(t *testing.T) {
 	t.Run("Simple", func(t *testing.T) {
 		assert := assert.New(t)
 
-		ps, nextPacket := dataIntoPackets(52, []byte("Hello from server!"))
+		ps, nextPacket := dataIntoPackets(52, []byte("Hello from server!"), maxDataSize)
 
 		assert.EqualValues(53, nextPacket)
 		assert.Len(ps, 1)
@@ -192,7 +509,7 @@ func TestDataPacket(t *testing.T) {
 	t.Run("Big packet", func(t *testing.T) {
 		assert := assert.New(t)
 
-		ps, nextPacket := dataIntoPackets(98, []byte(strings.Repeat("f", maxDataSize)))
+		ps, nextPacket := dataIntoPackets(98, []byte(strings.Repeat("f", maxDataSize)), maxDataSize)
 
 		assert.EqualValues(99, nextPacket)
 		assert.Len(ps, 1)
@@ -207,7 +524,7 @@ func TestDataPacket(t *testing.T) {
 
 		ps, nextPacket := dataIntoPackets(37, []byte(strings.Repeat("a", maxDataSize)+
 			strings.Repeat("b", maxDataSize)+strings.Repeat("c", maxDataSize)+
-			strings.Repeat("d", 228)))
+			strings.Repeat("d", 228)), maxDataSize)
 
 		assert.EqualValues(41, nextPacket)
 		p := ps[0]
@@ -228,6 +545,63 @@ func TestDataPacket(t *testing.T) {
 		assert.Equal([]byte(strings.Repeat("d", 228)), p.data)
 	})
 
+	t.Run("Packet number wraps around", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ps, nextPacket := dataIntoPackets(maxPacketNumber-1, []byte(strings.Repeat("a", maxDataSize)+
+			strings.Repeat("b", maxDataSize)+strings.Repeat("c", 69)), maxDataSize)
+
+		assert.EqualValues(1, nextPacket)
+		assert.Len(ps, 3)
+		assert.EqualValues(maxPacketNumber-1, ps[0].number)
+		assert.EqualValues(maxPacketNumber, ps[1].number)
+		assert.EqualValues(0, ps[2].number)
+	})
+
+	t.Run("Packets of smaller size", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ps, nextPacket := dataIntoPackets(5, []byte(strings.Repeat("a", minDataSize+1)), minDataSize)
+
+		assert.EqualValues(7, nextPacket)
+		assert.Len(ps, 2)
+		assert.Equal(minPacketSize, ps[0].len())
+		assert.Equal([]byte("a"), ps[1].data)
+		assert.Panics(func() { _, _ = dataIntoPackets(5, []byte{1}, maxDataSize+1) })
+		assert.Panics(func() { _, _ = dataIntoPackets(5, []byte{1}, 0) })
+	})
+
+	t.Run("Message fragments", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ps, nextPacket := messageIntoPackets(7, []byte(strings.Repeat("m", 2*minDataSize)), minDataSize, true, true)
+
+		assert.EqualValues(10, nextPacket)
+		if assert.Len(ps, 3) {
+			assert.Equal(minPacketSize, ps[0].len())
+			fragment, flags, err := decodeFragment(ps[0].data)
+			assert.NoError(err)
+			assert.EqualValues(firstFragmentFlag, flags)
+			assert.Len(fragment, minDataSize-fragmentHeaderSize)
+			_, flags, err = decodeFragment(ps[1].data)
+			assert.NoError(err)
+			assert.Zero(flags)
+			fragment, flags, err = decodeFragment(ps[2].data)
+			assert.NoError(err)
+			assert.EqualValues(lastFragmentFlag, flags)
+			assert.Equal([]byte("mm"), fragment)
+		}
+
+		ps, _ = messageIntoPackets(7, nil, minDataSize, false, false)
+		if assert.Len(ps, 1) {
+			_, flags, err := decodeFragment(ps[0].data)
+			assert.NoError(err)
+			assert.Zero(flags, "message continues in next packets")
+		}
+		_, _, err := decodeFragment(nil)
+		assert.ErrorIs(err, errInvalidFragment)
+	})
+
 	t.Run("Full flow", func(t *testing.T) {
 		assert := assert.New(t)
 
@@ -237,7 +611,7 @@ func TestDataPacket(t *testing.T) {
 			[]byte(strings.Repeat("a", maxDataSize) + strings.Repeat("b", maxDataSize/2)),
 			[]byte(strings.Repeat("x", maxDataSize) + strings.Repeat("y", maxDataSize) + "Hello from client!"),
 		} {
-			ps, _ := dataIntoPackets(284, data)
+			ps, _ := dataIntoPackets(284, data, maxDataSize)
 			var msgs [][]byte
 			for _, p := range ps {
 				msg := make([]byte, maxPacketSize)
@@ -260,6 +634,37 @@ func TestDataPacket(t *testing.T) {
 	})
 }
 
+func TestPacketNumber(t *testing.T) {
+	t.Run("Next", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.EqualValues(1, nextPacketNumber(0))
+		assert.EqualValues(maxPacketNumber, nextPacketNumber(maxPacketNumber-1))
+		assert.EqualValues(0, nextPacketNumber(maxPacketNumber))
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.EqualValues(420, addPacketNumber(69, 351))
+		assert.EqualValues(69, addPacketNumber(420, -351))
+		assert.EqualValues(2, addPacketNumber(maxPacketNumber-2, 5))
+		assert.EqualValues(maxPacketNumber-2, addPacketNumber(2, -5))
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.Equal(0, packetNumberDiff(69, 69))
+		assert.Equal(351, packetNumberDiff(420, 69))
+		assert.Equal(-351, packetNumberDiff(69, 420))
+		assert.Equal(5, packetNumberDiff(2, maxPacketNumber-2))
+		assert.Equal(-5, packetNumberDiff(maxPacketNumber-2, 2))
+		assert.Equal(-packetNumberSpace/2, packetNumberDiff(packetNumberSpace/2, 0))
+		assert.Equal(packetNumberSpace/2-1, packetNumberDiff(packetNumberSpace/2-1, 0))
+	})
+}
+
 func TestPacket_Len(t *testing.T) {
 	t.Run("Packet should encode its len", func(t *testing.T) {
 		assert := assert.New(t)
@@ -305,6 +710,24 @@ func TestPacket_Len(t *testing.T) {
 	})
 }
 
+func TestPacket_String(t *testing.T) {
+	t.Run("Stream packets", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.Equal("{{ver: 1, cmd: true, num: 5}[STREAM:3:7]}",
+			streamPacket(5, streamFrame{id: 3, seq: 7, data: []byte{1, 2}}).String())
+		assert.Equal("{{ver: 1, cmd: true, num: 6}[STREAM-FIN:3:8]}", streamFinPacket(6, 3, 8).String())
+		assert.Equal("{{ver: 1, cmd: true, num: 7}[STREAM-WINDOW:3:4096]}", streamWindowPacket(7, 3, 4096).String())
+	})
+
+	t.Run("Crypto packet", func(t *testing.T) {
+		assert := assert.New(t)
+
+		assert.Equal("{{ver: 1, cmd: true, num: 0}[CRYPTO:Handshake:3]}",
+			cryptoPacket(0, tls.QUICEncryptionLevelHandshake, []byte{1, 2, 3}).String())
+	})
+}
+
 func TestUint20_Overflow(t *testing.T) {
 	maxUint20 := uint32(1<<20 - 1)
 
@@ -315,27 +738,33 @@ func TestUint20_Overflow(t *testing.T) {
 	})
 
 	assert.Panics(func() {
-		_ = receivedPacketsPacket(maxUint20+1, nil)
+		_ = receivedPacketsPacket(maxUint20+1, receivedPackets{})
+	})
+	assert.Panics(func() {
+		_ = receivedPacketsPacket(1, receivedPackets{blocks: []rng[uint32]{{maxUint20 + 1, 1}}})
+	})
+	assert.Panics(func() {
+		_ = receivedPacketsPacket(1, receivedPackets{blocks: []rng[uint32]{{1, maxUint20 + 1}}})
 	})
 	assert.Panics(func() {
-		_ = receivedPacketsPacket(1, []rng[uint32]{{maxUint20 + 1, 1}})
+		_ = receivedPacketsPacket(1, receivedPackets{blocks: []rng[uint32]{{1, 2}, {2, maxUint20 + 1}, {4, 5}}})
 	})
 	assert.Panics(func() {
-		_ = receivedPacketsPacket(1, []rng[uint32]{{1, maxUint20 + 1}})
+		_ = receivedPacketsPacket(1, receivedPackets{blocks: []rng[uint32]{{1, 2}, {2, 4}, {5, maxUint20 + 1}}})
 	})
 	assert.Panics(func() {
-		_ = receivedPacketsPacket(1, []rng[uint32]{{1, 2}, {2, maxUint20 + 1}, {4, 5}})
+		_ = receivedPacketsPacket(1, receivedPackets{limit: maxUint20 + 1})
 	})
 	assert.Panics(func() {
-		_ = receivedPacketsPacket(1, []rng[uint32]{{1, 2}, {2, 4}, {5, maxUint20 + 1}})
+		_ = receivedPacketsPacket(1, receivedPackets{cumulative: maxUint20 + 1})
 	})
 
 	assert.Panics(func() {
-		_, _ = dataIntoPackets(maxUint20+1, []byte{1, 2, 3})
+		_, _ = dataIntoPackets(maxUint20+1, []byte{1, 2, 3}, maxDataSize)
 	})
 }
 
-func testDecodeReceivedPackets(t *testing.T, p packet) []rng[uint32] {
+func testDecodeReceivedPackets(t *testing.T, p packet) receivedPackets {
 	t.Helper()
 	assert := assert.New(t)
 
@@ -343,7 +772,7 @@ func testDecodeReceivedPackets(t *testing.T, p packet) []rng[uint32] {
 	tp, payload, err := commandPacketType(p)
 	assert.NoError(err)
 	assert.Equal(commandReceivedPackets, tp)
-	recieved, err := decodeReceivedPackets(payload)
+	rp, err := decodeReceivedPackets(payload)
 	assert.NoError(err)
-	return recieved
+	return rp
 }
@@ -0,0 +1,171 @@
+package sudp
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Path MTU discovery is done by the packetization layer (DPLPMTUD, RFC 8899):
+
+	The connection starts with packets of minPacketSize, which any path carries,
+	and probes bigger sizes with padded probe packets. Packets are sent with
+	the don't-fragment bit (see [setDontFragment]), so too big probe is dropped
+	instead of being fragmented. The size is confirmed when the peer acknowledges
+	the probe, and from then data is split into packets of this size.
+
+	Sizes of common links are probed first, then the rest is searched
+	with binary search up to the size that the peer is able to receive.
+	When the search is done, it is repeated after probeRaiseTimeout,
+	because the path may change.
+*/
+
+const (
+	// the size is considered too big after this number of lost probes
+	maxProbes = 3
+	// how long the size is used before bigger sizes are probed again
+	probeRaiseTimeout = 10 * time.Minute
+	// search is done when the confirmed size is closer to the too big one
+	probeSearchPrecision = 16
+)
+
+// sizes of common links that are probed before the binary search
+var commonPacketSizes = [...]int{
+	ethernetPacketSize - 20, // IPv6 header is 20 bytes longer
+	ethernetPacketSize,
+	maxPacketSize - 20,
+	maxPacketSize,
+}
+
+type pmtud struct {
+	send      func(size int) error // sends the probe of size bytes
+	rto       func() time.Duration // how long to wait for the probe acknowledgment
+	confirmed func(size int)       // is called when the bigger size is confirmed
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	maxSize   int // the size that the peer is able to receive
+	low       int // confirmed size
+	high      int // the biggest size that is not considered too big
+	probing   int // size of the sent probe, zero if none
+	probes    int // number of lost probes of that size
+	stopped   bool
+	starting  bool // the search is not started yet
+	searching bool // false between searches
+}
+
+// newPMTUD returns discovery that doesn't probe until it is started
+func newPMTUD(send func(size int) error, rto func() time.Duration, confirmed func(size int)) *pmtud {
+	d := &pmtud{
+		send:      send,
+		rto:       rto,
+		confirmed: confirmed,
+		maxSize:   minPacketSize,
+		low:       minPacketSize,
+		high:      minPacketSize,
+		starting:  true,
+	}
+	d.timer = time.AfterFunc(time.Hour, d.probe)
+	d.timer.Stop()
+	return d
+}
+
+// start begins the search of sizes up to maxSize
+func (d *pmtud) start(maxSize int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped || !d.starting {
+		return
+	}
+	d.starting, d.searching = false, true
+	d.maxSize = min(max(maxSize, minPacketSize), maxPacketSize)
+	d.high = d.maxSize
+	d.timer.Reset(0)
+}
+
+func (d *pmtud) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	d.timer.Stop()
+}
+
+// acked is called when the peer acknowledges the probe of size bytes
+func (d *pmtud) acked(size int) {
+	d.mu.Lock()
+	if d.stopped || size <= d.low || size > d.maxSize {
+		d.mu.Unlock()
+		return
+	}
+	d.low = size
+	d.high = max(d.high, size)
+	if size == d.probing {
+		d.probing, d.probes = 0, 0
+		d.timer.Reset(0) // continue the search without waiting
+	}
+	d.mu.Unlock()
+
+	d.confirmed(size)
+}
+
+func (d *pmtud) probe() {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+
+	if d.probing != 0 { // the probe is not acknowledged in time
+		d.probes++
+		if d.probes < maxProbes {
+			size := d.probing
+			d.timer.Reset(d.rto())
+			d.mu.Unlock()
+			d.sendProbe(size)
+			return
+		}
+		d.high = d.probing - 1
+		d.probing, d.probes = 0, 0
+	}
+
+	if d.high-d.low < probeSearchPrecision { // the search is done, but the path may change
+		d.high = d.maxSize
+		d.searching = false
+		d.timer.Reset(probeRaiseTimeout)
+		d.mu.Unlock()
+		return
+	}
+
+	d.searching = true
+	d.probing = d.nextSize()
+	size := d.probing
+	d.timer.Reset(d.rto())
+	d.mu.Unlock()
+	d.sendProbe(size)
+}
+
+func (d *pmtud) nextSize() int {
+	for _, size := range commonPacketSizes {
+		if size > d.low && size <= d.high {
+			return size
+		}
+	}
+	return (d.low + d.high + 1) / 2
+}
+
+// the probe that can't be sent is too big for the local interface,
+// so it is not waited for
+func (d *pmtud) sendProbe(size int) {
+	if d.send(size) == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stopped && d.probing == size {
+		d.probes = maxProbes - 1
+		d.timer.Reset(0)
+	}
+}
@@ -0,0 +1,139 @@
+package sudp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPMTUD(t *testing.T) {
+	t.Run("Should find the size that the path carries", func(t *testing.T) {
+		assert := assert.New(t)
+		path := newTestPath(4000, nil)
+		d := path.pmtud(t, time.Millisecond)
+
+		d.start(maxPacketSize)
+
+		assert.Eventually(func() bool { return path.done() }, time.Second, time.Millisecond)
+		confirmed := path.confirmedSize()
+		assert.LessOrEqual(confirmed, 4000)
+		assert.Greater(confirmed, 4000-probeSearchPrecision)
+	})
+
+	t.Run("Should not probe sizes bigger than the peer receives", func(t *testing.T) {
+		assert := assert.New(t)
+		path := newTestPath(maxPacketSize, nil)
+		d := path.pmtud(t, time.Millisecond)
+
+		d.start(ethernetPacketSize)
+
+		assert.Eventually(func() bool { return path.done() }, time.Second, time.Millisecond)
+		assert.Equal(ethernetPacketSize, path.confirmedSize())
+		for _, size := range path.sentSizes() {
+			assert.LessOrEqual(size, ethernetPacketSize)
+		}
+	})
+
+	t.Run("Should not wait for probes that can't be sent", func(t *testing.T) {
+		assert := assert.New(t)
+		path := newTestPath(ethernetPacketSize, errors.New("message too long"))
+		d := path.pmtud(t, time.Hour)
+
+		d.start(maxPacketSize)
+
+		assert.Eventually(func() bool { return path.done() }, time.Second, time.Millisecond)
+		assert.Equal(ethernetPacketSize, path.confirmedSize())
+	})
+
+	t.Run("Lost probe should be sent several times", func(t *testing.T) {
+		assert := assert.New(t)
+		path := newTestPath(minPacketSize, nil)
+		d := path.pmtud(t, 10*time.Millisecond)
+
+		d.start(maxPacketSize)
+		time.Sleep(maxProbes*10*time.Millisecond + testSlack)
+		d.stop()
+
+		sizes := path.sentSizes()
+		assert.GreaterOrEqual(len(sizes), maxProbes)
+		for _, size := range sizes[:maxProbes] {
+			assert.Equal(commonPacketSizes[0], size)
+		}
+		assert.Zero(path.confirmedSize(), "nothing bigger should be confirmed")
+	})
+
+	t.Run("Should not probe before start and after stop", func(t *testing.T) {
+		assert := assert.New(t)
+		path := newTestPath(maxPacketSize, nil)
+		d := path.pmtud(t, time.Millisecond)
+
+		time.Sleep(testSlack)
+		assert.Empty(path.sentSizes())
+
+		d.stop()
+		d.start(maxPacketSize)
+		time.Sleep(testSlack)
+		assert.Empty(path.sentSizes())
+	})
+}
+
+// testPath acknowledges probes up to size bytes,
+// bigger ones are lost or fail with sendErr if it is not nil
+type testPath struct {
+	size    int
+	sendErr error
+
+	mu        sync.Mutex
+	d         *pmtud
+	sent      []int
+	confirmed int
+}
+
+func newTestPath(size int, sendErr error) *testPath {
+	return &testPath{size: size, sendErr: sendErr}
+}
+
+func (p *testPath) pmtud(t *testing.T, rto time.Duration) *pmtud {
+	p.d = newPMTUD(p.send, func() time.Duration { return rto }, p.confirm)
+	t.Cleanup(p.d.stop)
+	return p.d
+}
+
+func (p *testPath) send(size int) error {
+	p.mu.Lock()
+	p.sent = append(p.sent, size)
+	p.mu.Unlock()
+
+	if size > p.size {
+		return p.sendErr
+	}
+	go p.d.acked(size)
+	return nil
+}
+
+func (p *testPath) confirm(size int) {
+	p.mu.Lock()
+	p.confirmed = size
+	p.mu.Unlock()
+}
+
+func (p *testPath) confirmedSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.confirmed
+}
+
+func (p *testPath) sentSizes() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.sent...)
+}
+
+func (p *testPath) done() bool {
+	p.d.mu.Lock()
+	defer p.d.mu.Unlock()
+	return !p.d.starting && !p.d.searching
+}
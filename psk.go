@@ -0,0 +1,278 @@
+package sudp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sync/atomic"
+)
+
+/*
+	Pre-shared key mode (see [DialPSK] and [ListenPSK]):
+
+	Every packet is sealed with AES-GCM:
+
+	 | header (3 bytes) | counter (8 bytes) | sealed data | tag (16 bytes) |
+
+	The header and the counter are the associated data, the counter xored with iv is the nonce,
+	it grows with every written packet, so resent packets are sealed again with new counters.
+	Then number and command bits of the header and the counter are masked with the block
+	of the header protection key encrypted from the sample of the sealed data (like in RFC 9001),
+	so packet numbers are not visible on the wire.
+
+	Handshake packets (and confirm) are sealed with the key derived from the PSK only,
+	their counters are random, because the key is shared by all clients.
+	Confirm is resent with the same key if its acknowledgment is lost,
+	so the server also tries it on packets of the size of confirm.
+	Keys of the connection are derived from the PSK, the random nonce of the client
+	and the cookie of the server, so they are different for every connection and direction.
+	The connection drops packets that are not authenticated or whose counters
+	are already received or are older than the replay window.
+*/
+
+const (
+	minPSKSize       = 16
+	pskNonceSize     = 16
+	sealCounterSize  = 8
+	sealTagSize      = 16
+	sealOverhead     = sealCounterSize + sealTagSize
+	hpSampleSize     = 16
+	replayWindowSize = 1024 // counters
+)
+
+var (
+	ErrShortPSK               = errors.New("pre-shared key is shorter than 16 bytes")
+	errPacketNotAuthenticated = errors.New("packet is not authenticated")
+	errReplayedPacket         = errors.New("replayed packet")
+)
+
+// packetKeys seal and open packets of one direction
+type packetKeys struct {
+	aead cipher.AEAD
+	iv   [12]byte
+	hp   cipher.Block // header protection
+}
+
+func newPacketKeys(psk, salt []byte, label string) *packetKeys {
+	material, err := hkdf.Key(sha256.New, psk, salt, "sudp "+label, 16+12+16)
+	if err != nil { // should never happen
+		panic(err)
+	}
+	return packetKeysOf(material[:16], material[16:28], material[28:])
+}
+
+// packetKeysOf creates keys of AES-GCM with the size of key (16 or 32 bytes)
+func packetKeysOf(key, iv, hpKey []byte) *packetKeys {
+	block, err := aes.NewCipher(key)
+	if err != nil { // should never happen
+		panic(err)
+	}
+	aead, _ := cipher.NewGCM(block)
+	hp, _ := aes.NewCipher(hpKey)
+	k := &packetKeys{aead: aead, hp: hp}
+	copy(k.iv[:], iv)
+	return k
+}
+
+func handshakeKeys(psk []byte) *packetKeys {
+	return newPacketKeys(psk, nil, "handshake")
+}
+
+// connKeys returns keys of packets sent by the client and by the server
+func connKeys(psk, clientNonce, cookie []byte) (client, server *packetKeys) {
+	salt := append(slices.Clone(clientNonce), cookie...)
+	return newPacketKeys(psk, salt, "client"), newPacketKeys(psk, salt, "server")
+}
+
+// seal appends packet p sealed with the counter to dst
+func (k *packetKeys) seal(dst, p []byte, counter uint64) []byte {
+	var aad [headerSize + sealCounterSize]byte
+	copy(aad[:], p[:headerSize])
+	binary.BigEndian.PutUint64(aad[headerSize:], counter)
+
+	start := len(dst)
+	dst = append(dst, aad[:]...)
+	nonce := k.nonce(counter)
+	dst = k.aead.Seal(dst, nonce[:], p[headerSize:], aad[:])
+	k.mask(dst[start:])
+	return dst
+}
+
+// open decrypts sealed packet b in place and returns the packet
+func (k *packetKeys) open(b []byte) (p []byte, counter uint64, err error) {
+	if len(b) < headerSize+sealOverhead {
+		return nil, 0, errPacketNotAuthenticated
+	}
+	k.mask(b)
+
+	var aad [headerSize + sealCounterSize]byte
+	copy(aad[:], b)
+	counter = binary.BigEndian.Uint64(aad[headerSize:])
+	nonce := k.nonce(counter)
+	sealed := b[len(aad):]
+	data, err := k.aead.Open(sealed[:0], nonce[:], sealed, aad[:])
+	if err != nil {
+		return nil, 0, errPacketNotAuthenticated
+	}
+	copy(b[sealCounterSize:], b[:headerSize]) // the header is moved right before the data
+	return b[sealCounterSize : len(aad)+len(data)], counter, nil
+}
+
+// mask toggles the protection of the header and the counter of the sealed packet
+func (k *packetKeys) mask(b []byte) {
+	var mask [hpSampleSize]byte
+	k.hp.Encrypt(mask[:], b[headerSize+sealCounterSize:][:hpSampleSize]) // the tag is long enough for the sample
+	b[0] ^= mask[0] & 0b00011111                                         // command bit and number, not version
+	for i := 1; i < headerSize+sealCounterSize; i++ {
+		b[i] ^= mask[i]
+	}
+}
+
+func (k *packetKeys) nonce(counter uint64) [12]byte {
+	nonce := k.iv
+	for i := range sealCounterSize {
+		nonce[len(nonce)-1-i] ^= byte(counter >> (8 * i))
+	}
+	return nonce
+}
+
+// pskHandshake protects packets of the opening handshake with the handshake keys
+type pskHandshake struct {
+	keys *packetKeys
+}
+
+// counter is random, because the key is shared by all clients
+func (h pskHandshake) seal(dst, p []byte) []byte {
+	return h.keys.seal(dst, p, randomCounter())
+}
+
+func (h pskHandshake) open(b []byte) ([]byte, error) {
+	p, _, err := h.keys.open(b)
+	return p, err
+}
+
+func randomCounter() uint64 {
+	var b [sealCounterSize]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// sealWriter seals every packet written to w,
+// confirm is sealed with the handshake keys, because the server opens it before it knows keys of the connection
+type sealWriter struct {
+	w         io.Writer
+	keys      *packetKeys
+	handshake *packetKeys
+	counter   atomic.Uint64
+}
+
+func (w *sealWriter) Write(b []byte) (int, error) {
+	buf := getBuf(len(b) + sealOverhead)
+	defer buf.free()
+
+	var sealed []byte
+	if isConfirmPacket(b) {
+		sealed = w.handshake.seal(buf.data[:0], b, randomCounter())
+	} else {
+		sealed = w.keys.seal(buf.data[:0], b, w.counter.Add(1))
+	}
+	written, err := w.w.Write(sealed)
+	if err != nil {
+		return 0, err
+	}
+	if written != len(sealed) {
+		return 0, ErrPacketCorrupted
+	}
+	return len(b), nil
+}
+
+func isConfirmPacket(b []byte) bool {
+	p, err := decodePacket(b)
+	if err != nil || !p.isCommand {
+		return false
+	}
+	command, _, err := commandPacketType(p)
+	return err == nil && command == commandConfirmConn
+}
+
+// pskOpener opens packets received by the connection and rejects replayed ones,
+// it is used only by the reading goroutine of the connection
+type pskOpener struct {
+	keys          *packetKeys
+	handshake     *packetKeys // of resent confirm, nil for the client
+	confirmOpened bool        // the first packet is confirm that is already opened by the listener
+	confirmSize   int         // of sealed confirm, resent confirm has the same size
+	replay        replayWindow
+}
+
+func (o *pskOpener) open(b []byte) ([]byte, error) {
+	if o.confirmOpened {
+		o.confirmOpened = false
+		o.confirmSize = len(b) + sealOverhead
+		return b, nil
+	}
+	if o.handshake != nil && len(b) == o.confirmSize {
+		return o.openConfirm(b)
+	}
+
+	p, counter, err := o.keys.open(b)
+	if err != nil {
+		return nil, err
+	}
+	if !o.replay.accept(counter) { // only authenticated counters move the window
+		return nil, errReplayedPacket
+	}
+	return p, nil
+}
+
+// openConfirm opens the packet of the size of confirm, which is resent by the client
+// with the handshake keys if the acknowledgment is lost, so it is acknowledged again
+func (o *pskOpener) openConfirm(b []byte) ([]byte, error) {
+	buf := getBuf(len(b))
+	defer buf.free()
+	sealed := buf.data[:copy(buf.data, b)] // failed opening overwrites the packet
+
+	p, counter, err := o.keys.open(b)
+	if err == nil {
+		if !o.replay.accept(counter) {
+			return nil, errReplayedPacket
+		}
+		return p, nil
+	}
+	p, _, err = o.handshake.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if !isConfirmPacket(p) {
+		return nil, errPacketNotAuthenticated
+	}
+	return b[:copy(b, p)], nil
+}
+
+// replayWindow remembers counters of the last replayWindowSize received packets
+type replayWindow struct {
+	highest uint64
+	seen    [replayWindowSize / 64]uint64 // bits of counters by their remainder
+}
+
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter == 0 { // counters of the connection start from 1
+		return false
+	}
+	if counter > w.highest {
+		for c := w.highest + 1; c <= counter && c-w.highest <= replayWindowSize; c++ {
+			w.seen[c%replayWindowSize/64] &^= 1 << (c % 64)
+		}
+		w.highest = counter
+	} else if w.highest-counter >= replayWindowSize || w.seen[counter%replayWindowSize/64]&(1<<(counter%64)) != 0 {
+		return false
+	}
+	w.seen[counter%replayWindowSize/64] |= 1 << (counter % 64)
+	return true
+}
@@ -0,0 +1,157 @@
+package sudp
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPSK = bytes.Repeat([]byte{69}, minPSKSize)
+
+func TestPacketKeys(t *testing.T) {
+	encode := func(assert *assert.Assertions, p packet) []byte {
+		b := make([]byte, p.len())
+		n, err := p.encode(b)
+		assert.NoError(err)
+		return b[:n]
+	}
+
+	t.Run("Should open sealed packet", func(t *testing.T) {
+		assert := assert.New(t)
+		client, _ := connKeys(testPSK, make([]byte, pskNonceSize), make([]byte, cookieSize))
+		p := encode(assert, dataPacket(42, []byte("Hello")))
+
+		sealed := client.seal(nil, p, 7)
+		assert.Len(sealed, len(p)+sealOverhead)
+		opened, counter, err := client.open(sealed)
+
+		assert.NoError(err)
+		assert.EqualValues(7, counter)
+		assert.Equal(p, opened)
+	})
+
+	t.Run("Header should be protected", func(t *testing.T) {
+		assert := assert.New(t)
+		client, _ := connKeys(testPSK, make([]byte, pskNonceSize), make([]byte, cookieSize))
+		p := encode(assert, dataPacket(42, []byte("Hello")))
+
+		first := client.seal(nil, p, 1)
+		second := client.seal(nil, p, 2)
+
+		assert.NotEqual(first[:headerSize], second[:headerSize], "number should not be visible")
+		assert.Equal(decodeHeader(p).version, decodeHeader(first).version)
+	})
+
+	t.Run("Should reject changed packet", func(t *testing.T) {
+		assert := assert.New(t)
+		client, _ := connKeys(testPSK, make([]byte, pskNonceSize), make([]byte, cookieSize))
+		p := encode(assert, dataPacket(42, []byte("Hello")))
+
+		for i := range headerSize + sealCounterSize + 1 {
+			sealed := client.seal(nil, p, 1)
+			sealed[i] ^= 1
+			_, _, err := client.open(sealed)
+			assert.ErrorIs(err, errPacketNotAuthenticated, "byte %d", i)
+		}
+		_, _, err := client.open(make([]byte, sealOverhead))
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+	})
+
+	t.Run("Keys should be different for directions and connections", func(t *testing.T) {
+		assert := assert.New(t)
+		client, server := connKeys(testPSK, make([]byte, pskNonceSize), make([]byte, cookieSize))
+		other, _ := connKeys(testPSK, bytes.Repeat([]byte{1}, pskNonceSize), make([]byte, cookieSize))
+		p := encode(assert, dataPacket(42, []byte("Hello")))
+
+		_, _, err := server.open(client.seal(nil, p, 1))
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+		_, _, err = other.open(client.seal(nil, p, 1))
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+		_, _, err = handshakeKeys(testPSK).open(client.seal(nil, p, 1))
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+	})
+}
+
+func TestPSKOpener(t *testing.T) {
+	t.Run("Should reject replayed packets", func(t *testing.T) {
+		assert := assert.New(t)
+		keys := handshakeKeys(testPSK)
+		o := &pskOpener{keys: keys}
+		p := make([]byte, 100)
+		n, err := dataPacket(1, []byte("Hello")).encode(p)
+		assert.NoError(err)
+		open := func(counter uint64) error {
+			_, err := o.open(keys.seal(nil, p[:n], counter))
+			return err
+		}
+
+		assert.NoError(open(2))
+		assert.ErrorIs(open(2), errReplayedPacket)
+		assert.NoError(open(1), "reordered packet should be accepted")
+		assert.ErrorIs(open(1), errReplayedPacket)
+		assert.NoError(open(replayWindowSize + 1))
+		assert.ErrorIs(open(1), errReplayedPacket, "packet older than the window")
+		assert.NoError(open(3))
+		assert.ErrorIs(open(3), errReplayedPacket)
+	})
+
+	t.Run("Not authenticated packets should not move the window", func(t *testing.T) {
+		assert := assert.New(t)
+		keys := handshakeKeys(testPSK)
+		o := &pskOpener{keys: keys}
+		p := make([]byte, 100)
+		n, err := dataPacket(1, []byte("Hello")).encode(p)
+		assert.NoError(err)
+
+		forged := keys.seal(nil, p[:n], 1<<40)
+		forged[len(forged)-1] ^= 1
+		_, err = o.open(forged)
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+		_, err = o.open(keys.seal(nil, p[:n], 1))
+		assert.NoError(err)
+	})
+
+	t.Run("Server should open resent confirm", func(t *testing.T) {
+		assert := assert.New(t)
+		clientKeys, _ := connKeys(testPSK, make([]byte, pskNonceSize), make([]byte, cookieSize))
+		hs := handshakeKeys(testPSK)
+		o := &pskOpener{keys: clientKeys, handshake: hs, confirmOpened: true}
+		encode := func(p packet) []byte {
+			b := make([]byte, p.len())
+			n, err := p.encode(b)
+			assert.NoError(err)
+			return b[:n]
+		}
+		confirm := encode(confirmConnectionPacket(0, make([]byte, cookieSize), defaultOptions().transportParameters()))
+		_, err := o.open(slices.Clone(confirm)) // opened by the listener
+		assert.NoError(err)
+
+		opened, err := o.open(hs.seal(nil, confirm, 42))
+		assert.NoError(err)
+		assert.Equal(confirm, opened)
+		ping := encode(pingPacket(1))
+		ping = append(ping, make([]byte, len(confirm)-len(ping))...) // of the size of confirm
+		opened, err = o.open(clientKeys.seal(nil, ping, 1))
+		assert.NoError(err, "packets of the connection should be opened")
+		assert.Equal(ping, opened)
+		_, err = o.open(hs.seal(nil, ping, 43))
+		assert.ErrorIs(err, errPacketNotAuthenticated, "only confirm is sealed with the handshake keys")
+	})
+}
+
+func TestReplayWindow(t *testing.T) {
+	assert := assert.New(t)
+	var w replayWindow
+
+	assert.False(w.accept(0))
+	for c := uint64(1); c <= 3*replayWindowSize; c += 2 {
+		assert.True(w.accept(c))
+	}
+	for c := uint64(2*replayWindowSize + 2); c <= 3*replayWindowSize; c += 2 {
+		assert.True(w.accept(c), "counter %d", c)
+		assert.False(w.accept(c), "counter %d", c)
+	}
+	assert.False(w.accept(2 * replayWindowSize))
+}
@@ -1,7 +1,11 @@
 package sudp
 
 import (
+	"io"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const defaultQueueSize = 1024
@@ -13,26 +17,63 @@ func newBufQueue(size ...int) *bufQueue {
 		s = size[0]
 	}
 	return &bufQueue{
-		ch: make(chan reusable[[]byte], s),
+		ch:       make(chan reusable[[]byte], s),
+		deadline: newDeadline(),
+		stopped:  make(chan struct{}),
 	}
 }
 
 type bufQueue struct {
-	ch  chan reusable[[]byte]
-	err atomic.Value // to stop reading error should be set and channel closed
-	buf reusable[[]byte]
+	ch       chan reusable[[]byte]
+	err      atomic.Value // to stop reading error should be set and channel closed
+	deadline *deadline
+
+	stopOnce sync.Once
+	stopped  chan struct{} // closed by [bufQueue.stop]
+	stopErr  error
+
+	readMu    sync.Mutex // protects buf and partial from concurrent reads
+	buf       reusable[[]byte]
+	partial   []byte // fragments of the message that is not received entirely
+	inMessage bool   // the first fragment of the message is received
 }
 
-// asyncronous [io.Reader] implementation, returns error from [bufQueue.close] call
+// asyncronous [io.Reader] implementation, after [bufQueue.close] call returns buffered data
+// and only then the error from it, [bufQueue.stop] interrupts reading at once,
+// returns [os.ErrDeadlineExceeded] if read deadline is exceeded
 func (r *bufQueue) read(b []byte) (int, error) {
+	return r.readData(b, true)
+}
+
+// readPacket works like [bufQueue.read], but data of different writes is not merged,
+// so every read returns data of a single write or the rest of it
+func (r *bufQueue) readPacket(b []byte) (int, error) {
+	return r.readData(b, false)
+}
+
+func (r *bufQueue) readData(b []byte, merge bool) (int, error) {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	if isClosed(r.stopped) {
+		return 0, r.stopErr
+	}
+	if r.deadline.isExceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	data := r.buf
 	if len(data.data) == 0 {
-		data = <-r.ch // block reading if no buffered data
+		var err error
+		data, err = r.lockedNext() // block reading if no buffered data
+		if err != nil {
+			return 0, err
+		}
 	}
 	copied := copy(b, data.data)
 	n := copied
 
-	for n < len(b) && len(r.ch) > 0 {
+	for merge && n < len(b) && len(r.ch) > 0 {
 		data.free()
 		data = <-r.ch
 		copied = copy(b[n:], data.data)
@@ -48,15 +89,129 @@ func (r *bufQueue) read(b []byte) (int, error) {
 		data = reusable[[]byte]{}
 	}
 	r.buf = data
-	err, _ := r.err.Load().(error)
-	return n, err
+	return n, nil
+}
+
+// readMessage works like [bufQueue.read], but every read returns a single message
+// reassembled from fragments (see [messageIntoPackets]), if b is too small,
+// the rest of the message is discarded and [io.ErrShortBuffer] is returned.
+// Fragments of messages abandoned by the sender are discarded.
+func (r *bufQueue) readMessage(b []byte) (int, error) {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	for {
+		if isClosed(r.stopped) {
+			return 0, r.stopErr
+		}
+		if r.deadline.isExceeded() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		data, err := r.lockedNext()
+		if err != nil {
+			return 0, err
+		}
+
+		fragment, flags, err := decodeFragment(data.data)
+		if err != nil { // the peer doesn't follow the protocol
+			data.free()
+			continue
+		}
+		switch {
+		case flags&gapFragmentFlag != 0:
+			r.partial, r.inMessage = r.partial[:0], false
+			data.free()
+			continue
+		case flags&firstFragmentFlag != 0:
+			r.partial, r.inMessage = r.partial[:0], true
+		case !r.inMessage: // the rest of abandoned message
+			data.free()
+			continue
+		}
+		if flags&lastFragmentFlag == 0 {
+			r.partial = append(r.partial, fragment...)
+			data.free()
+			continue
+		}
+
+		r.inMessage = false
+		size := len(r.partial) + len(fragment)
+		n := copy(b, r.partial)
+		n += copy(b[n:], fragment)
+		data.free()
+		r.partial = r.partial[:0]
+		if n < size {
+			return n, io.ErrShortBuffer
+		}
+		return n, nil
+	}
+}
+
+// readOne works like [bufQueue.read], but returns data of a single write,
+// if b is too small, the rest of data is discarded and [io.ErrShortBuffer] is returned
+func (r *bufQueue) readOne(b []byte) (int, error) {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	if isClosed(r.stopped) {
+		return 0, r.stopErr
+	}
+	if r.deadline.isExceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	data, err := r.lockedNext()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, data.data)
+	size := len(data.data)
+	data.free()
+	if n < size {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// lockedNext waits for the next write
+func (r *bufQueue) lockedNext() (reusable[[]byte], error) {
+	select {
+	case data, ok := <-r.ch:
+		if !ok { // closed and all data is readed
+			return reusable[[]byte]{}, r.err.Load().(error)
+		}
+		return data, nil
+	case <-r.deadline.wait():
+		return reusable[[]byte]{}, os.ErrDeadlineExceeded
+	case <-r.stopped:
+		return reusable[[]byte]{}, r.stopErr
+	}
+}
+
+func (r *bufQueue) setReadDeadline(t time.Time) {
+	r.deadline.set(t)
 }
 
 func (r *bufQueue) write(p reusable[[]byte]) {
 	r.ch <- p
 }
 
+// free returns how many writes can be done without blocking
+func (r *bufQueue) free() int {
+	return cap(r.ch) - len(r.ch)
+}
+
+// stop interrupts reading without closing the queue,
+// so writing is still possible, but nobody will read the data
+func (r *bufQueue) stop(err error) {
+	r.stopOnce.Do(func() {
+		r.stopErr = err
+		close(r.stopped)
+	})
+}
+
 func (r *bufQueue) close(err error) {
+	r.err.Store(err) // should be visible after channel is closed
 	close(r.ch)
-	r.err.Store(err)
 }
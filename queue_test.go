@@ -2,6 +2,8 @@ package sudp
 
 import (
 	"errors"
+	"io"
+	"os"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -118,6 +120,153 @@ func TestBufQueue_Read(t *testing.T) {
 		assert.Equal([]byte{1, 2, 3}, buf[:n])
 		assert.EqualValues(1, freeCalls.Load())
 	})
+
+	t.Run("When deadline is exceeded will stop waiting", func(t *testing.T) {
+		assert := assert.New(t)
+		q := newBufQueue()
+
+		q.setReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 1024)
+		n, err := q.read(buf)
+
+		assert.Zero(n)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("When deadline is exceeded will not read buffered data", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		q := newBufQueue()
+
+		q.write(newTestReusable([]byte{1, 2, 3}, &freeCalls))
+		q.setReadDeadline(time.Now())
+		buf := make([]byte, 1024)
+		_, err := q.read(buf)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+
+		q.setReadDeadline(time.Time{})
+		n, err := q.read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+	})
+}
+
+func TestBufQueue_ReadMessage(t *testing.T) {
+	t.Run("Should reassemble message from fragments", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		q := newBufQueue()
+
+		q.write(newTestReusable([]byte{firstFragmentFlag, 1, 2}, &freeCalls))
+		q.write(newTestReusable([]byte{lastFragmentFlag, 3}, &freeCalls))
+		q.write(newTestReusable([]byte{firstFragmentFlag | lastFragmentFlag, 4, 5}, &freeCalls))
+		buf := make([]byte, 1024)
+		n1, err := q.readMessage(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n1])
+		n2, err := q.readMessage(buf)
+		assert.NoError(err)
+
+		assert.Equal([]byte{4, 5}, buf[:n2])
+		assert.EqualValues(3, freeCalls.Load())
+	})
+
+	t.Run("Should discard the rest of message if buffer is small", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		q := newBufQueue()
+
+		q.write(newTestReusable([]byte{firstFragmentFlag, 1, 2}, &freeCalls))
+		q.write(newTestReusable([]byte{lastFragmentFlag, 3}, &freeCalls))
+		q.write(newTestReusable([]byte{firstFragmentFlag | lastFragmentFlag}, &freeCalls))
+		buf := make([]byte, 2)
+		n, err := q.readMessage(buf)
+		assert.ErrorIs(err, io.ErrShortBuffer)
+		assert.Equal([]byte{1, 2}, buf[:n])
+
+		n, err = q.readMessage(buf)
+		assert.NoError(err)
+		assert.Zero(n, "empty message")
+	})
+
+	t.Run("Should keep received fragments after deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		q := newBufQueue()
+
+		q.write(newTestReusable([]byte{firstFragmentFlag, 1, 2}, &freeCalls))
+		q.setReadDeadline(time.Now().Add(testSlack))
+		buf := make([]byte, 1024)
+		_, err := q.readMessage(buf)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+
+		q.setReadDeadline(time.Time{})
+		q.write(newTestReusable([]byte{lastFragmentFlag, 3}, &freeCalls))
+		n, err := q.readMessage(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{1, 2, 3}, buf[:n])
+	})
+	t.Run("Should discard fragments of abandoned message", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		q := newBufQueue()
+
+		q.write(newTestReusable([]byte{firstFragmentFlag, 1, 2}, &freeCalls))
+		q.write(gapFragment())
+		q.write(newTestReusable([]byte{0, 3}, &freeCalls))
+		q.write(newTestReusable([]byte{lastFragmentFlag, 4}, &freeCalls))
+		q.write(newTestReusable([]byte{firstFragmentFlag, 5}, &freeCalls))
+		q.write(newTestReusable([]byte{lastFragmentFlag, 6}, &freeCalls))
+		buf := make([]byte, 1024)
+		n, err := q.readMessage(buf)
+		assert.NoError(err)
+
+		assert.Equal([]byte{5, 6}, buf[:n])
+		assert.EqualValues(5, freeCalls.Load())
+	})
+}
+
+func TestBufQueue_ReadPacket(t *testing.T) {
+	assert := assert.New(t)
+	var freeCalls atomic.Uint64
+	q := newBufQueue()
+
+	q.write(newTestReusable([]byte{1, 2, 3}, &freeCalls))
+	q.write(newTestReusable([]byte{4, 5}, &freeCalls))
+	buf := make([]byte, 2)
+	n, err := q.readPacket(buf)
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2}, buf[:n])
+	buf = make([]byte, 1024)
+	n, err = q.readPacket(buf)
+	assert.NoError(err)
+	assert.Equal([]byte{3}, buf[:n], "the rest should not be merged with the next write")
+	n, err = q.readPacket(buf)
+	assert.NoError(err)
+	assert.Equal([]byte{4, 5}, buf[:n])
+
+	assert.EqualValues(2, freeCalls.Load())
+}
+
+func TestBufQueue_ReadOne(t *testing.T) {
+	assert := assert.New(t)
+	var freeCalls atomic.Uint64
+	q := newBufQueue()
+
+	q.write(newTestReusable([]byte{1, 2, 3}, &freeCalls))
+	q.write(newTestReusable([]byte{4, 5}, &freeCalls))
+	buf := make([]byte, 2)
+	n, err := q.readOne(buf)
+	assert.ErrorIs(err, io.ErrShortBuffer)
+	assert.Equal([]byte{1, 2}, buf[:n])
+	n, err = q.readOne(buf)
+	assert.NoError(err)
+	assert.Equal([]byte{4, 5}, buf[:n])
+
+	assert.EqualValues(2, freeCalls.Load())
+	q.setReadDeadline(time.Now())
+	_, err = q.readOne(buf)
+	assert.ErrorIs(err, os.ErrDeadlineExceeded)
 }
 
 func TestBufPacketReader_Close(t *testing.T) {
@@ -148,12 +297,16 @@ func TestBufPacketReader_Close(t *testing.T) {
 		r.write(newTestReusable([]byte{1, 2, 3}, &freeCalls))
 		r.write(newTestReusable([]byte{4, 5, 6}, &freeCalls))
 		r.close(target)
-		data1 := make([]byte, 4)
-		_, err1 := r.read(data1)
-		data2 := make([]byte, 4)
-		_, err2 := r.read(data2)
-
+		data := make([]byte, 8)
+		n, err := r.read(data)
+		assert.Equal(6, n)
+		assert.NoError(err, "error should be returned only after buffered data")
+		n1, err1 := r.read(data)
+		n2, err2 := r.read(data)
+
+		assert.Zero(n1)
 		assert.ErrorIs(err1, target)
+		assert.Zero(n2)
 		assert.ErrorIs(err2, target)
 		assert.EqualValues(2, freeCalls.Load())
 	})
@@ -17,32 +17,42 @@ type number interface {
 type rng[T number] [2]T
 
 func (r rng[T]) in(n T) bool {
-	return r[0] <= n && n <= r[1]
+	return r.inFunc(n, linearDiff)
+}
+
+func (r rng[T]) inFunc(n T, diff func(a, b T) int) bool {
+	return diff(r[0], n) <= 0 && diff(n, r[1]) <= 0
 }
 
 // if range already contains n, does nothing and returns false
 func rangesTryAppend[T number](rs []rng[T], n T) ([]rng[T], bool) {
+	return rangesTryAppendFunc(rs, n, linearDiff)
+}
+
+// [rangesTryAppendFunc] works like [rangesTryAppend], but numbers are compared with diff,
+// which should return the signed distance a - b (see [packetNumberDiff])
+func rangesTryAppendFunc[T number](rs []rng[T], n T, diff func(a, b T) int) ([]rng[T], bool) {
 	if len(rs) == 0 { // ( n )
 		return append(rs, rng[T]{n, n}), true
 	}
 
 	bsri := -1 // bsr = biggest smaller range
 	for i := len(rs) - 1; i >= 0; i-- {
-		if rs[i][1] < n {
+		if diff(rs[i][1], n) < 0 {
 			bsri = i
 			break
 		}
 	}
 	if bsri != len(rs)-1 { // ( n [next] ... ) or ( ... [bsr] n [next] ... )
 		next := rs[bsri+1]
-		if next.in(n) {
+		if next.inFunc(n, diff) {
 			return rs, false
 		}
 
-		if next[0]-1 == n { // ( n[next] ... ) or ( ... [bsr] n[next] ... )
+		if diff(next[0], n) == 1 { // ( n[next] ... ) or ( ... [bsr] n[next] ... )
 			if bsri != -1 { // ( ... [bsr] n[next] ... )
 				bsr := rs[bsri]
-				if bsr[1]+1 == n { // ( ... [bsr]n[next] ... )
+				if diff(n, bsr[1]) == 1 { // ( ... [bsr]n[next] ... )
 					return slices.Replace(rs, bsri, bsri+2, rng[T]{bsr[0], next[1]}), true
 				}
 			}
@@ -52,7 +62,7 @@ func rangesTryAppend[T number](rs []rng[T], n T) ([]rng[T], bool) {
 	}
 	if bsri != -1 { // ( ... [bsr] n ... )
 		bsr := rs[bsri]
-		if bsr[1]+1 == n { // ( ... [bsr]n ... )
+		if diff(n, bsr[1]) == 1 { // ( ... [bsr]n ... )
 			rs[bsri] = rng[T]{bsr[0], n}
 			return rs, true
 		}
@@ -60,3 +70,43 @@ func rangesTryAppend[T number](rs []rng[T], n T) ([]rng[T], bool) {
 	// ( n [next] ... ) or ( ... [bsr] n [next] ... ) or ( ... [next] n)
 	return slices.Insert(rs, bsri+1, rng[T]{n, n}), true
 }
+
+// removes all numbers that are before first from ranges
+func rangesTrimFunc[T number](rs []rng[T], first T, diff func(a, b T) int) []rng[T] {
+	i := 0
+	for i < len(rs) && diff(rs[i][1], first) < 0 {
+		i++
+	}
+	rs = slices.Delete(rs, 0, i)
+	if len(rs) != 0 && diff(rs[0][0], first) < 0 {
+		rs[0][0] = first
+	}
+	return rs
+}
+
+// rangesUnionFunc returns ranges with numbers of both a and b,
+// both must be ordered, ranges that overlap or adjoin are merged
+func rangesUnionFunc[T number](a, b []rng[T], diff func(a, b T) int) []rng[T] {
+	res := make([]rng[T], 0, len(a)+len(b))
+	for len(a) != 0 || len(b) != 0 {
+		var r rng[T]
+		if len(b) == 0 || len(a) != 0 && diff(a[0][0], b[0][0]) <= 0 {
+			r, a = a[0], a[1:]
+		} else {
+			r, b = b[0], b[1:]
+		}
+
+		if len(res) != 0 && diff(r[0], res[len(res)-1][1]) <= 1 {
+			if diff(r[1], res[len(res)-1][1]) > 0 {
+				res[len(res)-1][1] = r[1]
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func linearDiff[T number](a, b T) int {
+	return int(a) - int(b)
+}
@@ -155,3 +155,68 @@ func TestRangesTryAppend(t *testing.T) {
 		})
 	})
 }
+
+func TestRangesTryAppendFunc(t *testing.T) {
+	t.Run("Packet numbers wrap around", func(t *testing.T) {
+		assert := assert.New(t)
+		ranges := []rng[uint32]{{maxPacketNumber - 5, maxPacketNumber - 3}}
+
+		ranges, added := rangesTryAppendFunc(ranges, maxPacketNumber-4, packetNumberDiff)
+		assert.False(added)
+		ranges, added = rangesTryAppendFunc(ranges, 1, packetNumberDiff)
+		assert.True(added)
+		assert.Equal([]rng[uint32]{{maxPacketNumber - 5, maxPacketNumber - 3}, {1, 1}}, ranges)
+		ranges, added = rangesTryAppendFunc(ranges, maxPacketNumber-1, packetNumberDiff)
+		assert.True(added)
+		assert.Equal([]rng[uint32]{{maxPacketNumber - 5, maxPacketNumber - 3}, {maxPacketNumber - 1, maxPacketNumber - 1}, {1, 1}}, ranges)
+		ranges, added = rangesTryAppendFunc(ranges, maxPacketNumber, packetNumberDiff)
+		assert.True(added)
+		ranges, added = rangesTryAppendFunc(ranges, 0, packetNumberDiff)
+		assert.True(added)
+		assert.Equal([]rng[uint32]{{maxPacketNumber - 5, maxPacketNumber - 3}, {maxPacketNumber - 1, 1}}, ranges)
+		ranges, added = rangesTryAppendFunc(ranges, maxPacketNumber-2, packetNumberDiff)
+		assert.True(added)
+		assert.Equal([]rng[uint32]{{maxPacketNumber - 5, 1}}, ranges)
+
+		assert.True(ranges[0].inFunc(0, packetNumberDiff))
+		assert.False(ranges[0].inFunc(2, packetNumberDiff))
+	})
+}
+
+func TestRangesTrimFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	res := rangesTrimFunc([]rng[int]{{0, 3}, {5, 5}, {7, 8}, {12, 14}}, 6, linearDiff)
+	assert.Equal([]rng[int]{{7, 8}, {12, 14}}, res)
+
+	res = rangesTrimFunc([]rng[int]{{0, 3}, {5, 5}, {7, 8}, {12, 14}}, 8, linearDiff)
+	assert.Equal([]rng[int]{{8, 8}, {12, 14}}, res)
+
+	res = rangesTrimFunc([]rng[int]{{0, 3}, {5, 5}}, 0, linearDiff)
+	assert.Equal([]rng[int]{{0, 3}, {5, 5}}, res)
+
+	res = rangesTrimFunc([]rng[int]{{0, 3}, {5, 5}}, 6, linearDiff)
+	assert.Empty(res)
+
+	res2 := rangesTrimFunc([]rng[uint32]{{maxPacketNumber - 5, 2}, {4, 5}}, maxPacketNumber, packetNumberDiff)
+	assert.Equal([]rng[uint32]{{maxPacketNumber, 2}, {4, 5}}, res2)
+}
+
+func TestRangesUnionFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	res := rangesUnionFunc([]rng[int]{{0, 3}, {7, 8}, {12, 14}}, []rng[int]{{5, 5}, {9, 10}, {13, 20}}, linearDiff)
+	assert.Equal([]rng[int]{{0, 3}, {5, 5}, {7, 10}, {12, 20}}, res)
+
+	res = rangesUnionFunc([]rng[int]{{0, 10}}, []rng[int]{{2, 3}, {5, 6}}, linearDiff)
+	assert.Equal([]rng[int]{{0, 10}}, res)
+
+	res = rangesUnionFunc(nil, []rng[int]{{2, 3}, {5, 6}}, linearDiff)
+	assert.Equal([]rng[int]{{2, 3}, {5, 6}}, res)
+
+	res = rangesUnionFunc(nil, nil, linearDiff[int])
+	assert.Empty(res)
+
+	res2 := rangesUnionFunc([]rng[uint32]{{maxPacketNumber - 5, maxPacketNumber - 2}}, []rng[uint32]{{maxPacketNumber - 1, 2}, {4, 5}}, packetNumberDiff)
+	assert.Equal([]rng[uint32]{{maxPacketNumber - 5, 2}, {4, 5}}, res2)
+}
@@ -4,16 +4,62 @@ import (
 	"sync"
 )
 
-var packetBufPool = sync.Pool{New: func() any { return make([]byte, maxPacketSize) }}
+// Packets are read into buffers of maxPacketSize, but most of them are not bigger
+// than the ethernet packet, so buffers are pooled by sizes
+// and packets that wait for the reader don't hold big buffers (see [fitPacketBuf])
+var packetBufPools = [...]*bufPool{
+	newBufPool(ethernetPacketSize),
+	newBufPool(maxPacketSize),
+}
+
+type bufPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufPool(size int) *bufPool {
+	p := &bufPool{size: size}
+	p.pool.New = func() any { return make([]byte, size) }
+	return p
+}
+
+// returns the smallest pool with buffers of at least size bytes
+func bufPoolFor(size int) *bufPool {
+	for _, p := range packetBufPools {
+		if size <= p.size {
+			return p
+		}
+	}
+	panic("too big buffer") // should never happen
+}
 
+// getPacketBuf returns buffer for any packet
 func getPacketBuf() reusable[[]byte] {
-	v := packetBufPool.Get().([]byte)
+	return getBuf(maxPacketSize)
+}
+
+// getBuf returns buffer of at least size bytes
+func getBuf(size int) reusable[[]byte] {
+	p := bufPoolFor(size)
+	v := p.pool.Get().([]byte)
 	return reusable[[]byte]{
 		data: v,
-		free: func() { packetBufPool.Put(v) },
+		free: func() { p.pool.Put(v) },
 	}
 }
 
+// fitPacketBuf moves the data to the smallest buffer that fits it
+func fitPacketBuf(buf reusable[[]byte]) reusable[[]byte] {
+	if bufPoolFor(len(buf.data)) == bufPoolFor(cap(buf.data)) {
+		return buf
+	}
+
+	small := getBuf(len(buf.data))
+	small.data = small.data[:copy(small.data, buf.data)]
+	buf.free()
+	return small
+}
+
 type reusable[T any] struct {
 	data T
 	free func()
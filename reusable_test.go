@@ -2,8 +2,39 @@ package sudp
 
 import (
 	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+func TestFitPacketBuf(t *testing.T) {
+	t.Run("Small packet should be moved to small buffer", func(t *testing.T) {
+		assert := assert.New(t)
+		var freed atomic.Uint64
+		buf := newTestReusable(make([]byte, maxPacketSize), &freed)
+		buf.data = buf.data[:copy(buf.data, "Hello")]
+
+		small := fitPacketBuf(buf)
+		defer small.free()
+
+		assert.Equal([]byte("Hello"), small.data)
+		assert.Equal(ethernetPacketSize, cap(small.data))
+		assert.EqualValues(1, freed.Load(), "big buffer should be freed")
+	})
+
+	t.Run("Big packet should stay in its buffer", func(t *testing.T) {
+		assert := assert.New(t)
+		var freed atomic.Uint64
+		buf := newTestReusable(make([]byte, maxPacketSize), &freed)
+		buf.data = buf.data[:ethernetPacketSize+1]
+
+		big := fitPacketBuf(buf)
+
+		assert.Equal(maxPacketSize, cap(big.data))
+		assert.Zero(freed.Load())
+	})
+}
+
 func newTestReusable[T any](data T, callToFree *atomic.Uint64) reusable[T] {
 	return reusable[T]{
 		data: data,
@@ -0,0 +1,142 @@
+package sudp
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// The retransmission timeout is calculated like in RFC 6298,
+// the ack delay reported by the receiver is subtracted from samples like in RFC 9002.
+// Samples are taken only from packets that were sent once (Karn's algorithm),
+// because it is unknown which copy of the retransmitted packet was acknowledged,
+// so the timeout stays backed off until the next sample, otherwise on the path
+// with rtt longer than rto every packet is retransmitted and there are no samples.
+const (
+	// assumed before the first sample
+	initialRTT = 100 * time.Millisecond
+	// receiver acknowledges packets not later than this delay after receiving them,
+	// until it tells its own delays in the handshake
+	maxAckDelay = rLongTime
+	// timeout before the first sample
+	initialRTO = initialRTT + 4*(initialRTT/2) + maxAckDelay
+
+	// precision of timers, so that rto is not equal to srtt when rttvar becomes zero
+	rttGranularity = time.Millisecond
+	minRTO         = 100 * time.Millisecond
+	maxRTO         = 60 * time.Second
+)
+
+// rttStats is shared by all groups of the connection through [flight]
+type rttStats struct {
+	mu        sync.Mutex
+	hasSample bool
+	srtt      time.Duration
+	rttvar    time.Duration
+	minRTT    time.Duration
+	backoffs  int // how many times rto is doubled since the last sample
+	// delays of acknowledgments of the receiver (see [Config.AckDelay])
+	ackDelay    time.Duration
+	maxAckDelay time.Duration
+}
+
+func newRTTStats() *rttStats {
+	return &rttStats{
+		srtt:        initialRTT,
+		rttvar:      initialRTT / 2,
+		ackDelay:    rShortTime,
+		maxAckDelay: maxAckDelay,
+	}
+}
+
+// setPeerAckDelays sets delays that the receiver told in the handshake
+func (s *rttStats) setPeerAckDelays(ackDelay, maxAckDelay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackDelay = min(ackDelay, maxAckDelayField)
+	s.maxAckDelay = min(max(maxAckDelay, ackDelay), maxAckDelayField)
+}
+
+// addSample adds the sample, ackDelay is the time the receiver held the acknowledgment
+func (s *rttStats) addSample(latest, ackDelay time.Duration) {
+	s.mu.Lock()
+	s.sample(latest, ackDelay)
+	s.mu.Unlock()
+}
+
+func (s *rttStats) sample(latest, ackDelay time.Duration) {
+	s.backoffs = 0
+	if !s.hasSample {
+		s.hasSample = true
+		s.minRTT = latest
+		s.srtt = latest
+		s.rttvar = latest / 2
+		return
+	}
+
+	s.minRTT = min(s.minRTT, latest)
+	// delay is not subtracted if it makes the sample less than the minimum,
+	// so the wrong delay of the receiver can't break the estimation
+	adjusted := latest
+	if ackDelay = min(ackDelay, s.maxAckDelay); latest >= s.minRTT+ackDelay {
+		adjusted -= ackDelay
+	}
+	s.rttvar = (3*s.rttvar + (s.srtt - adjusted).Abs()) / 4
+	s.srtt = (7*s.srtt + adjusted) / 8
+}
+
+// smoothed returns the smoothed rtt (srtt)
+func (s *rttStats) smoothed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srtt
+}
+
+// rto returns the time after which not acknowledged packet is considered lost
+func (s *rttStats) rto() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lockedRTO()
+}
+
+func (s *rttStats) lockedRTO() time.Duration {
+	rto := s.srtt + max(4*s.rttvar, rttGranularity) + s.maxAckDelay
+	rto = max(rto, minRTO)
+	for range s.backoffs {
+		if rto >= maxRTO {
+			break
+		}
+		rto *= 2
+	}
+	return min(rto, maxRTO)
+}
+
+// timedOut backs off rto after packets were not acknowledged in waited time
+// and returns how long to wait after resending them,
+// rto is not backed off again by other groups that waited for the same rto
+func (s *rttStats) timedOut(waited time.Duration) (next time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rto := s.lockedRTO(); rto <= waited && rto < maxRTO {
+		s.backoffs++
+	}
+	return max(s.lockedRTO(), min(2*waited, maxRTO))
+}
+
+// probeTimeout returns the timeout of the tail-loss probe (RFC 8985),
+// it is enough for the receiver to acknowledge the last packet of the burst (see [Config.AckDelay]),
+// ok is false if there is no sample yet or the probe would not come before rto
+func (s *rttStats) probeTimeout() (pto time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pto = 2*s.srtt + s.ackDelay
+	return pto, s.hasSample && pto < s.lockedRTO()
+}
+
+// withJitter adds a random jitter up to a quarter of d,
+// so that the connections that lost packets together don't resend them together
+func withJitter(d time.Duration) time.Duration {
+	return d + rand.N(d/4+1)
+}
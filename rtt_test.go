@@ -0,0 +1,146 @@
+package sudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTStats_RTO(t *testing.T) {
+	t.Run("Before the first sample should be initial", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		assert.Equal(initialRTO, s.rto())
+	})
+
+	t.Run("Should be taken from the first sample", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		s.addSample(400*time.Millisecond, 0)
+
+		assert.Equal(400*time.Millisecond, s.srtt)
+		assert.Equal(200*time.Millisecond, s.rttvar)
+		assert.Equal(400*time.Millisecond+4*200*time.Millisecond+maxAckDelay, s.rto())
+	})
+
+	t.Run("Should take the max ack delay of the peer", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		s.setPeerAckDelays(5*time.Millisecond, time.Second)
+		s.addSample(400*time.Millisecond, 0)
+
+		assert.Equal(400*time.Millisecond+4*200*time.Millisecond+time.Second, s.rto())
+		pto, ok := s.probeTimeout()
+		assert.True(ok)
+		assert.Equal(2*400*time.Millisecond+5*time.Millisecond, pto)
+	})
+
+	t.Run("Should converge to stable rtt", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		for range 100 {
+			s.addSample(600*time.Millisecond, 0)
+		}
+
+		assert.InDelta(600*time.Millisecond, s.srtt, float64(time.Millisecond))
+		assert.InDelta(600*time.Millisecond+rttGranularity+maxAckDelay, s.rto(), float64(time.Millisecond))
+	})
+
+	t.Run("Should subtract ack delay unless it makes sample less than minimum", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+		s.addSample(100*time.Millisecond, 0)
+
+		s.addSample(120*time.Millisecond, 20*time.Millisecond)
+		assert.Equal(100*time.Millisecond, s.srtt)
+
+		s.addSample(100*time.Millisecond, 50*time.Millisecond)
+		assert.Equal(100*time.Millisecond, s.srtt)
+	})
+
+	t.Run("Should not be less than minimum", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		for range 100 {
+			s.addSample(100*time.Microsecond, 0)
+		}
+
+		assert.Equal(minRTO, s.rto())
+	})
+
+	t.Run("Should stay backed off until the next sample", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+		rto := s.rto()
+
+		next := s.timedOut(rto)
+		assert.Equal(2*rto, next)
+		assert.Equal(2*rto, s.rto())
+
+		next = s.timedOut(rto) // other group waited for the same rto
+		assert.Equal(2*rto, next)
+		assert.Equal(2*rto, s.rto())
+
+		next = s.timedOut(next)
+		assert.Equal(4*rto, next)
+		assert.Equal(4*rto, s.rto())
+
+		s.addSample(initialRTT, 0)
+		assert.Equal(rto, s.rto())
+	})
+
+	t.Run("Backoff should not exceed maximum", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		next := s.rto()
+		for range 100 {
+			next = s.timedOut(next)
+		}
+
+		assert.Equal(maxRTO, next)
+		assert.Equal(maxRTO, s.rto())
+		assert.LessOrEqual(withJitter(next), maxRTO+maxRTO/4)
+	})
+}
+
+func TestRTTStats_ProbeTimeout(t *testing.T) {
+	t.Run("Should not probe before the first sample", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+
+		_, ok := s.probeTimeout()
+
+		assert.False(ok)
+	})
+
+	t.Run("Should wait two rtt and acknowledgment of the last packet", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+		s.addSample(10*time.Millisecond, 0)
+
+		pto, ok := s.probeTimeout()
+
+		assert.True(ok)
+		assert.Equal(20*time.Millisecond+rShortTime, pto)
+	})
+
+	t.Run("Should not probe if rto comes earlier", func(t *testing.T) {
+		assert := assert.New(t)
+		s := newRTTStats()
+		for range 50 {
+			s.addSample(200*time.Millisecond, 0)
+		}
+
+		pto, ok := s.probeTimeout()
+
+		assert.GreaterOrEqual(pto, s.rto())
+		assert.False(ok)
+	})
+}
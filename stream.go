@@ -0,0 +1,432 @@
+package sudp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Streams are independent byte streams of the connection:
+
+	Packets of all streams share packet numbers of the connection, so they are
+	acknowledged, resent and paced like the rest of packets, but every stream
+	orders its packets by its own sequence numbers and passes them to its reader
+	as soon as they are in order, so a lost packet blocks only its stream.
+
+	Every stream has its own flow control in sequence numbers like the connection,
+	the receiver advertises the limit with window packets when the reader frees
+	the queue of the stream.
+
+	Streams opened by the dialer have even identifiers and streams opened
+	by the listener side have odd ones, so both sides may open them at once.
+*/
+
+const (
+	// number of packets of the stream that its reader may not read before the sender is blocked
+	streamCap = connCap
+	// the receiver advertises the limit of the stream again when the reader frees this number of packets
+	streamWindowUpdateThreshold = streamCap / 4
+	// fin and open packets don't wait for the reader, so they may be sent beyond the limit
+	streamLimitSlack = streamCap
+	// number of streams opened by the peer that may wait for [Conn.AcceptStream]
+	streamBacklog = connCap
+)
+
+var (
+	errStreamClosed      = fmt.Errorf("%w: stream closed", net.ErrClosed)
+	errStreamWriteClosed = fmt.Errorf("%w: stream write side closed", net.ErrClosed)
+)
+
+// Stream is an ordered byte stream of the connection opened by [Conn.OpenStream]
+// or accepted by [Conn.AcceptStream]. It has its own ordering and flow control,
+// so a lost packet or a slow reader of one stream doesn't block the others.
+// Close and deadlines don't affect the connection and its other streams.
+type Stream interface {
+	net.Conn
+
+	// StreamID returns the identifier of the stream, which is the same on both sides
+	StreamID() uint32
+	// CloseWrite sends fin after all written data, so the peer reads [io.EOF],
+	// the stream may still be read until the peer closes its write side
+	CloseWrite() error
+	// SetUnordered works like [Conn.SetUnordered] for the stream
+	SetUnordered(unordered bool) error
+}
+
+// local and remote addresses of streams are the addresses of the connection
+type addrs interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+type stream struct {
+	c  *conn
+	id uint32
+
+	// write
+	writeMu       sync.Mutex // held while writing, protects nextSeq
+	writeDeadline *deadline
+	nextSeq       uint32
+	finSent       atomic.Bool
+	limitMu       sync.Mutex
+	peerLimit     uint32        // the last sequence number that the peer is ready to receive
+	changed       chan struct{} // closed and replaced when the limit grows
+
+	// read, unreaded is used only by the reading goroutine of the connection
+	toRead      *bufQueue
+	unreaded    incompleteOrder
+	readPoint   atomic.Uint32 // the next sequence number that will be passed to the reader
+	advertised  atomic.Uint32 // the limit sent in the last window packet
+	finReceived atomic.Bool
+	readClosed  atomic.Bool // closed locally, so received data is discarded
+	unordered   atomic.Bool
+}
+
+func newStream(c *conn, id uint32) *stream {
+	s := &stream{
+		c:             c,
+		id:            id,
+		writeDeadline: newDeadline(),
+		peerLimit:     streamCap - 1, // both sides start with the same limit
+		changed:       make(chan struct{}),
+		toRead:        newBufQueue(streamCap),
+	}
+	s.advertised.Store(streamCap - 1)
+	s.unreaded.onCommand = s.handleOrderedCommand
+	return s
+}
+
+func (s *stream) StreamID() uint32 {
+	return s.id
+}
+
+// Read returns all received data before [io.EOF] after the peer closed its write side
+func (s *stream) Read(b []byte) (int, error) {
+	if s.readClosed.Load() {
+		return 0, errStreamClosed
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if s.unordered.Load() {
+		n, err = s.toRead.readPacket(b)
+	} else {
+		n, err = s.toRead.read(b)
+	}
+	if n != 0 {
+		s.updateWindow()
+	}
+	return n, err
+}
+
+// Write blocks while the window of the connection is full
+// or the peer is not ready to receive more data of the stream,
+// writes of streams are never coalesced
+func (s *stream) Write(b []byte) (int, error) {
+	if clErr := s.c.closeErr.Load(); clErr != nil {
+		return 0, clErr.(error)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.finSent.Load() {
+		return 0, errStreamWriteClosed
+	}
+	if len(b) == 0 { // nothing to send, the stream is already opened by [stream.open]
+		return 0, nil
+	}
+	return s.c.send(b, s.writeDeadline, writePart{stream: s})
+}
+
+func (s *stream) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.finSent.Load() {
+		return nil
+	}
+
+	seq := s.nextSeq
+	err := s.c.sendCommand(func(number uint32) packet {
+		return streamFinPacket(number, s.id, seq)
+	})
+	if err != nil {
+		return err
+	}
+	s.nextSeq = nextPacketNumber(seq)
+	s.finSent.Store(true)
+	s.c.forgetStreamIfDone(s)
+	return nil
+}
+
+// Close closes the write side and discards data that the peer still sends
+func (s *stream) Close() error {
+	if s.readClosed.Swap(true) {
+		return nil
+	}
+	s.toRead.stop(errStreamClosed)
+	s.updateWindow()
+
+	return s.CloseWrite()
+}
+
+func (s *stream) SetUnordered(unordered bool) error {
+	if s.readClosed.Load() {
+		return errStreamClosed
+	}
+
+	s.unordered.Store(unordered)
+	return nil
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	if s.c.addrs == nil {
+		return nil
+	}
+	return s.c.addrs.LocalAddr()
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	if s.c.addrs == nil {
+		return nil
+	}
+	return s.c.addrs.RemoteAddr()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	if s.readClosed.Load() {
+		return errStreamClosed
+	}
+
+	s.toRead.setReadDeadline(t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	if s.finSent.Load() {
+		return errStreamWriteClosed
+	}
+
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// sender side
+
+// open sends the empty packet, so the peer accepts the stream before the first write
+func (s *stream) open() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	seq := s.nextSeq
+	err := s.c.sendCommand(func(number uint32) packet {
+		return streamPacket(number, streamFrame{id: s.id, seq: seq})
+	})
+	if err != nil {
+		return err
+	}
+	s.nextSeq = nextPacketNumber(seq)
+	return nil
+}
+
+// available returns how many bytes of packets of packetSize the peer is ready to receive
+// and the channel that is closed when it may change, it is called with writeMu held
+func (s *stream) available(packetSize int) (room int, changed <-chan struct{}) {
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+	return max(packetNumberDiff(s.peerLimit, s.nextSeq)+1, 0) * packetSize, s.changed
+}
+
+// setPeerLimit updates the limit of the peer, it can only grow
+func (s *stream) setPeerLimit(limit uint32) {
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+
+	if packetNumberDiff(limit, s.peerLimit) > 0 {
+		s.peerLimit = limit
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// receiver side
+
+// acceptable reports whether the packet with seq fits into the limit of the stream,
+// packets without data don't wait for the reader, so they may be beyond it
+func (s *stream) acceptable(seq uint32, hasData bool) bool {
+	if hasData {
+		return packetNumberDiff(seq, s.receiveLimit()) <= 0
+	}
+	return packetNumberDiff(seq, s.receiveLimit()) <= streamLimitSlack
+}
+
+// receive is called by the reading goroutine of the connection
+// with packets numbered by sequence numbers of the stream
+func (s *stream) receive(p reusable[packet]) {
+	if s.finReceived.Load() { // the connection is closed, so the stream is closed too
+		p.free()
+		return
+	}
+
+	if !p.data.isCommand && s.unordered.Load() { // fin is still handled after all previous packets
+		s.pass(reusable[[]byte]{data: p.data.data, free: p.free})
+		p = orderPlaceholder(p.data.number)
+	}
+	for toRead := range s.unreaded.append(p) {
+		s.pass(toRead)
+	}
+	s.readPoint.Store(s.unreaded.nextToRead)
+	if s.readClosed.Load() {
+		s.updateWindow()
+	}
+}
+
+func (s *stream) pass(toRead reusable[[]byte]) {
+	if s.readClosed.Load() || s.c.closeErr.Load() != nil { // nobody will read it
+		toRead.free()
+		return
+	}
+	s.toRead.write(toRead)
+}
+
+// handles open and fin packets after all previous packets of the stream are received
+func (s *stream) handleOrderedCommand(p packet) {
+	if len(p.data) == 0 || p.data[0] != streamFinFlag {
+		return
+	}
+
+	s.closeRead(io.EOF)
+	s.c.forgetStreamIfDone(s)
+}
+
+// closeRead is called by the reading goroutine of the connection
+// after the last packet of the stream is received or when the connection is closed
+func (s *stream) closeRead(err error) {
+	if !s.finReceived.Swap(true) {
+		s.toRead.close(err)
+	}
+}
+
+// receiveLimit returns the last sequence number that the stream is ready to receive
+func (s *stream) receiveLimit() uint32 {
+	return addPacketNumber(s.readPoint.Load(), s.toRead.free()-1)
+}
+
+func (s *stream) updateWindow() {
+	limit := s.receiveLimit()
+	if packetNumberDiff(limit, s.advertised.Load()) < streamWindowUpdateThreshold {
+		return
+	}
+
+	s.advertised.Store(limit)
+	s.c.sendCommand(func(number uint32) packet {
+		return streamWindowPacket(number, s.id, limit)
+	})
+}
+
+// connection side
+
+// OpenStream opens a new stream, the peer accepts it with AcceptStream
+func (c *conn) OpenStream() (Stream, error) {
+	if clErr := c.closeErr.Load(); clErr != nil {
+		return nil, clErr.(error)
+	}
+
+	c.streamsMu.Lock()
+	s := newStream(c, c.nextStreamID)
+	c.nextStreamID += 2
+	c.streams[s.id] = s
+	c.streamsMu.Unlock()
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream blocks until the peer opens a stream or the connection is closed
+func (c *conn) AcceptStream() (Stream, error) {
+	select {
+	case s := <-c.accept:
+		return s, nil
+	case <-c.stopGroups:
+		return nil, c.closeErr.Load().(error)
+	}
+}
+
+// streamOf returns the stream of the packet and creates streams opened by the peer,
+// nil stream means that the stream is already closed and its packets are discarded.
+// ok is false if the packet can't be taken now, so it is not acknowledged and the peer resends it.
+func (c *conn) streamOf(f streamFrame, hasData bool) (s *stream, ok bool) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	if s, found := c.streams[f.id]; found {
+		return s, s.acceptable(f.seq, hasData)
+	}
+	if f.id%2 == c.nextStreamID%2 || f.id < c.nextPeerStreamID { // closed or never opened by us
+		return nil, true
+	}
+
+	// streams opened before it are created too, because their packets may be lost
+	opened := int((f.id-c.nextPeerStreamID)/2) + 1
+	if opened > cap(c.accept)-len(c.accept) {
+		return nil, false
+	}
+	for id := c.nextPeerStreamID; id <= f.id; id += 2 {
+		s = newStream(c, id)
+		c.streams[id] = s
+		c.accept <- s
+	}
+	c.nextPeerStreamID = f.id + 2
+	return s, s.acceptable(f.seq, hasData)
+}
+
+// forgetStreamIfDone removes the stream after both sides closed their write sides,
+// so later packets of it are discarded
+func (c *conn) forgetStreamIfDone(s *stream) {
+	if !s.finSent.Load() || !s.finReceived.Load() {
+		return
+	}
+
+	c.streamsMu.Lock()
+	delete(c.streams, s.id)
+	c.streamsMu.Unlock()
+}
+
+func (c *conn) setStreamLimit(payload []byte) error {
+	f, err := decodeStreamFrame(payload)
+	if err != nil {
+		return err
+	}
+
+	c.streamsMu.Lock()
+	s := c.streams[f.id]
+	c.streamsMu.Unlock()
+	if s != nil {
+		s.setPeerLimit(f.seq)
+	}
+	return nil
+}
+
+// closeStreams closes read sides of streams that are not closed by the peer
+func (c *conn) closeStreams(err error) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	for _, s := range c.streams {
+		s.closeRead(err)
+	}
+}
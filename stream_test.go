@@ -0,0 +1,192 @@
+package sudp
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream_Read(t *testing.T) {
+	t.Run("Lost packet of one stream should not block others", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 8)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		send := func(p packet) {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+
+		send(streamPacket(0, streamFrame{id: 1, seq: 0}))
+		// packet 1 with data of the stream 1 is lost
+		send(streamPacket(2, streamFrame{id: 3, seq: 0}))
+		send(streamPacket(3, streamFrame{id: 3, seq: 1, data: []byte("second")}))
+		first, err := conn.AcceptStream()
+		assert.NoError(err)
+		second, err := conn.AcceptStream()
+		assert.NoError(err)
+		assert.EqualValues(1, first.StreamID())
+		assert.EqualValues(3, second.StreamID())
+
+		buf := make([]byte, 16)
+		n, err := second.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), buf[:n])
+
+		send(streamPacket(1, streamFrame{id: 1, seq: 1, data: []byte("first")}))
+		n, err = first.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("first"), buf[:n])
+	})
+
+	t.Run("Should read EOF after fin of the stream", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 8)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		send := func(p packet) {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+
+		send(streamFinPacket(1, 1, 1)) // fin before data
+		send(streamPacket(0, streamFrame{id: 1, seq: 0, data: []byte("data")}))
+		s, err := conn.AcceptStream()
+		assert.NoError(err)
+
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("data"), buf[:n])
+		_, err = s.Read(buf)
+		assert.ErrorIs(err, io.EOF)
+		assert.False(conn.isTornDown(), "connection should stay open")
+	})
+
+	t.Run("Unordered stream should read packets as they arrive", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 8)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		send := func(p packet) {
+			msg := make([]byte, 1024)
+			n, err := p.encode(msg)
+			assert.NoError(err)
+			in <- newTestReusable(msg[:n], &freeCalls)
+		}
+
+		send(streamPacket(0, streamFrame{id: 1, seq: 0}))
+		s, err := conn.AcceptStream()
+		assert.NoError(err)
+		assert.NoError(s.SetUnordered(true))
+		send(streamPacket(2, streamFrame{id: 1, seq: 2, data: []byte("second")}))
+		send(streamFinPacket(3, 1, 3))
+
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("second"), buf[:n])
+
+		send(streamPacket(1, streamFrame{id: 1, seq: 1, data: []byte("first")}))
+		n, err = s.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("first"), buf[:n])
+		_, err = s.Read(buf)
+		assert.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("Should not accept more streams than backlog", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		_ = newConn(defaultOptions(), in, inerr, out, nil)
+
+		msg := make([]byte, 1024)
+		n, err := streamPacket(0, streamFrame{id: 2*streamBacklog + 1, seq: 0}).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+		time.Sleep(rShortTime + testSlack)
+
+		assert.EqualValues(1, freeCalls.Load())
+		assert.Empty(out.Packets(), "dropped packet should not be acknowledged")
+	})
+}
+
+func TestStream_Write(t *testing.T) {
+	t.Run("Write should wait until receiver raises limit of the stream", func(t *testing.T) {
+		assert := assert.New(t)
+		var freeCalls atomic.Uint64
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		assert.NoError(conn.SetCongestionController(&testCongestionController{window: 2 * streamCap * minPacketSize}))
+		s, err := conn.OpenStream()
+		assert.NoError(err)
+		assert.EqualValues(0, s.StreamID())
+
+		dataSize := minDataSize - streamHeaderSize
+		var written atomic.Bool
+		go func() {
+			n, err := s.Write(make([]byte, streamCap*dataSize)) // the open packet took one sequence number
+			assert.NoError(err)
+			assert.Equal(streamCap*dataSize, n)
+			written.Store(true)
+		}()
+		time.Sleep(testSlack)
+		assert.Len(out.Packets(), streamCap)
+		assert.False(written.Load())
+
+		msg := make([]byte, 1024)
+		n, err := streamWindowPacket(0, 0, streamCap).encode(msg)
+		assert.NoError(err)
+		in <- newTestReusable(msg[:n], &freeCalls)
+
+		assert.Eventually(written.Load, time.Second, 10*time.Millisecond)
+		ps := out.Packets()
+		if assert.Len(ps, streamCap+1) {
+			tp, payload, err := commandPacketType(ps[streamCap])
+			assert.NoError(err)
+			assert.Equal(commandStream, tp)
+			f, err := decodeStreamFrame(payload)
+			assert.NoError(err)
+			assert.EqualValues(streamCap, f.seq)
+		}
+	})
+
+	t.Run("Should not write after CloseWrite", func(t *testing.T) {
+		assert := assert.New(t)
+		in := make(chan reusable[[]byte], 2)
+		inerr := new(error)
+		out := &testPacketBuffer{t: t}
+		conn := newConn(defaultOptions(), in, inerr, out, nil)
+		s, err := conn.OpenStream()
+		assert.NoError(err)
+
+		assert.NoError(s.CloseWrite())
+		_, err = s.Write([]byte{1})
+
+		assert.ErrorIs(err, errStreamWriteClosed)
+		ps := out.Packets()
+		if assert.Len(ps, 2) {
+			tp, _, err := commandPacketType(ps[1])
+			assert.NoError(err)
+			assert.Equal(commandStreamFin, tp)
+		}
+	})
+}
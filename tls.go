@@ -0,0 +1,341 @@
+package sudp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+	TLS mode (see [DialTLS] and [ListenTLS]):
+
+	After the opening handshake (see handshake.go) the connection does the TLS 1.3 handshake
+	with [tls.QUICConn], its messages are carried in numbered crypto commands,
+	so they are resent and ordered like other packets.
+	Packets are protected like in pre-shared key mode (see psk.go), but keys are derived
+	from the traffic secrets of TLS (like in RFC 9001), so the secrets logged
+	by KeyLogWriter of the config decrypt captured packets.
+	Every packet starts with the epoch of its keys (see [tls.QUICEncryptionLevel]):
+
+	 | epoch (1 byte) | packet |         epoch 0: packets before the TLS handshake, they are not protected
+	 | epoch (1 byte) | sealed packet |  epoch 2 and 3: handshake and application keys
+
+	Crypto commands are sent with keys of their level, other packets with the newest keys.
+	After the handshake is done packets of epoch 0 are dropped, so a forged packet can't close the connection.
+	Transport parameters of the opening handshake are sent again in the TLS handshake,
+	so they are authenticated.
+*/
+
+const (
+	epochs = int(tls.QUICEncryptionLevelApplication) + 1
+	// number of messages of the TLS handshake that may wait for the handshake
+	cryptoCap = 64
+	// how long the TLS handshake may take after the connection is opened
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	errNoTLSConfig                 = errors.New("tls config is nil")
+	errUnsupportedCipherSuite      = errors.New("unsupported cipher suite")
+	errNoKeys                      = errors.New("no keys for the level of packet")
+	errTransportParametersMismatch = errors.New("transport parameters of tls handshake don't match")
+	errTLSHandshakeTimeout         = errors.New("tls handshake timeout")
+)
+
+// TLSConn is a connection returned by [DialTLS] and by Accept of the [ListenTLS] listener
+type TLSConn interface {
+	Conn
+
+	// ConnectionState returns the state of the TLS handshake with the peer,
+	// it is empty if the connection is not in TLS mode
+	ConnectionState() tls.ConnectionState
+}
+
+var (
+	_ TLSConn = (*dconn)(nil)
+	_ TLSConn = (*lconn)(nil)
+)
+
+func (c *conn) ConnectionState() tls.ConnectionState {
+	return c.tlsState
+}
+
+// tlsConfig returns the copy of config that allows only TLS 1.3, which is required by [tls.QUICConn]
+func tlsConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	return config
+}
+
+type cryptoData struct {
+	level tls.QUICEncryptionLevel
+	data  []byte
+}
+
+// tlsHandshake does the TLS handshake over the opened connection,
+// local and peer are transport parameters of the opening handshake
+func (c *conn) tlsHandshake(qc *tls.QUICConn, local, peer transportParameters) error {
+	p := c.opener.(*tlsProtection) // see [options.protect]
+	timeout := time.NewTimer(tlsHandshakeTimeout)
+	defer timeout.Stop()
+
+	qc.SetTransportParameters(local.append(nil))
+	if err := qc.Start(context.Background()); err != nil {
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+	done := false
+	for {
+		e := qc.NextEvent()
+		var err error
+		switch e.Kind {
+		case tls.QUICNoEvent: // waits for messages of the peer
+			if done {
+				c.tlsState = qc.ConnectionState()
+				p.handshakeDone()
+				return nil
+			}
+			select {
+			case d := <-c.crypto:
+				err = qc.HandleData(d.level, d.data)
+			case <-timeout.C:
+				err = errTLSHandshakeTimeout
+			case <-c.stopGroups:
+				qc.Close()
+				return c.closeErr.Load().(error)
+			}
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			var keys *packetKeys
+			keys, err = tlsPacketKeys(e.Suite, e.Data)
+			if err == nil {
+				p.setKeys(e.Level, keys, e.Kind == tls.QUICSetWriteSecret)
+			}
+		case tls.QUICWriteData:
+			err = c.sendCrypto(e.Level, e.Data)
+		case tls.QUICTransportParameters:
+			var params transportParameters
+			params, err = decodeTransportParameters(e.Data)
+			if err == nil && !bytes.Equal(params.append(nil), peer.append(nil)) {
+				err = errTransportParametersMismatch
+			}
+		case tls.QUICHandshakeDone: // the read secret of application keys follows it
+			done = true
+		}
+		if err != nil {
+			qc.Close()
+			return fmt.Errorf("tls handshake failed: %w", err)
+		}
+	}
+}
+
+// sendCrypto sends messages of the TLS handshake in crypto commands,
+// so they are resent until they are received
+func (c *conn) sendCrypto(level tls.QUICEncryptionLevel, data []byte) error {
+	for chunk := range slices.Chunk(data, c.flight.packetSize()-headerSize-cryptoHeaderSize) {
+		err := c.sendCommand(func(number uint32) packet {
+			return cryptoPacket(number, level, chunk)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveCrypto passes messages of the TLS handshake to [conn.tlsHandshake],
+// they are dropped if the connection doesn't do it
+func (c *conn) receiveCrypto(payload []byte) {
+	level, data, err := decodeCryptoFrame(payload)
+	if err != nil || c.crypto == nil {
+		return
+	}
+	select {
+	case c.crypto <- cryptoData{level: level, data: bytes.Clone(data)}: // the packet buffer is reused
+	default:
+	}
+}
+
+// tlsPacketKeys derives keys of packets from the traffic secret like in RFC 9001,
+// only AES-GCM suites are supported
+func tlsPacketKeys(suite uint16, secret []byte) (*packetKeys, error) {
+	var (
+		h       func() hash.Hash
+		keySize int
+	)
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keySize = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keySize = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedCipherSuite, tls.CipherSuiteName(suite))
+	}
+	return packetKeysOf(
+		expandLabel(h, secret, "quic key", keySize),
+		expandLabel(h, secret, "quic iv", 12),
+		expandLabel(h, secret, "quic hp", keySize),
+	), nil
+}
+
+// expandLabel is HKDF-Expand-Label of TLS 1.3 (RFC 8446) with empty context
+func expandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	key, err := hkdf.Expand(h, secret, string(info), length)
+	if err != nil { // should never happen
+		panic(err)
+	}
+	return key
+}
+
+// tlsCleartext adds epoch 0 to packets of the opening handshake, they are not protected
+type tlsCleartext struct{}
+
+func (tlsCleartext) seal(dst, p []byte) []byte {
+	return append(append(dst, byte(tls.QUICEncryptionLevelInitial)), p...)
+}
+
+func (tlsCleartext) open(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != byte(tls.QUICEncryptionLevelInitial) {
+		return nil, errPacketNotAuthenticated
+	}
+	return b[1:], nil
+}
+
+// tlsProtection writes packets of the connection with the epoch of their keys
+// and opens received ones, keys are set by [conn.tlsHandshake]
+type tlsProtection struct {
+	w             io.Writer
+	confirmOpened bool // see [pskOpener], it is used only by the reading goroutine
+
+	writeMu   sync.Mutex
+	writeKeys [epochs]*packetKeys
+	counters  [epochs]uint64
+	epoch     tls.QUICEncryptionLevel // of packets except crypto commands and confirm
+
+	readMu   sync.Mutex
+	readKeys [epochs]*packetKeys
+	replay   [epochs]replayWindow
+	done     bool // the handshake is done, packets of epoch 0 are dropped
+}
+
+func (p *tlsProtection) setKeys(level tls.QUICEncryptionLevel, keys *packetKeys, write bool) {
+	if write {
+		p.writeMu.Lock()
+		p.writeKeys[level] = keys
+		if level == tls.QUICEncryptionLevelHandshake {
+			p.epoch = level
+		}
+		p.writeMu.Unlock()
+		return
+	}
+	p.readMu.Lock()
+	p.readKeys[level] = keys
+	p.readMu.Unlock()
+}
+
+// handshakeDone switches packets to application keys,
+// they are not used before, so the peer that didn't finish the handshake can read acknowledgments
+func (p *tlsProtection) handshakeDone() {
+	p.writeMu.Lock()
+	p.epoch = tls.QUICEncryptionLevelApplication
+	p.writeMu.Unlock()
+	p.readMu.Lock()
+	p.done = true
+	p.readMu.Unlock()
+}
+
+func (p *tlsProtection) Write(b []byte) (int, error) {
+	epoch, keys, counter := p.writeEpoch(b)
+	if keys == nil && epoch != tls.QUICEncryptionLevelInitial { // should never happen
+		return 0, errNoKeys
+	}
+
+	buf := getBuf(len(b) + 1 + sealOverhead)
+	defer buf.free()
+	out := append(buf.data[:0], byte(epoch))
+	if keys == nil {
+		out = append(out, b...)
+	} else {
+		out = keys.seal(out, b, counter)
+	}
+	written, err := p.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	if written != len(out) {
+		return 0, ErrPacketCorrupted
+	}
+	return len(b), nil
+}
+
+// writeEpoch chooses keys of the packet and its counter, nil keys mean that it is not protected
+func (p *tlsProtection) writeEpoch(b []byte) (tls.QUICEncryptionLevel, *packetKeys, uint64) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	epoch := p.epoch
+	if pv, err := decodePacket(b); err == nil && pv.isCommand {
+		command, payload, err := commandPacketType(pv)
+		switch {
+		case err != nil:
+		case command == commandConfirmConn: // the listener opens it as the handshake packet
+			epoch = tls.QUICEncryptionLevelInitial
+		case command == commandCrypto:
+			if level, _, err := decodeCryptoFrame(payload); err == nil {
+				epoch = level
+			}
+		}
+	}
+	if p.writeKeys[epoch] == nil {
+		return epoch, nil, 0
+	}
+	p.counters[epoch]++
+	return epoch, p.writeKeys[epoch], p.counters[epoch]
+}
+
+func (p *tlsProtection) open(b []byte) ([]byte, error) {
+	if p.confirmOpened {
+		p.confirmOpened = false
+		return b, nil
+	}
+	if len(b) == 0 || int(b[0]) >= epochs {
+		return nil, errPacketNotAuthenticated
+	}
+
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	epoch := b[0]
+	if epoch == byte(tls.QUICEncryptionLevelInitial) {
+		if p.done {
+			return nil, errPacketNotAuthenticated
+		}
+		return b[1:], nil
+	}
+	keys := p.readKeys[epoch]
+	if keys == nil {
+		return nil, errNoKeys
+	}
+	opened, counter, err := keys.open(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	if !p.replay[epoch].accept(counter) {
+		return nil, errReplayedPacket
+	}
+	return opened, nil
+}
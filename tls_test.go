@@ -0,0 +1,212 @@
+package sudp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialTLS(t *testing.T) {
+	t.Run("Should exchange data after the handshake", func(t *testing.T) {
+		assert := assert.New(t)
+		server, client := testTLSConfigs(assert)
+		var keyLog bytes.Buffer
+		client.KeyLogWriter = &keyLog
+		l, err := ListenTLS("udp", "127.0.0.1:0", server)
+		assert.NoError(err)
+		defer l.Close()
+
+		conn, err := DialTLS("udp", l.Addr().String(), client)
+		assert.NoError(err)
+		defer conn.Close()
+		srvConn, err := l.Accept()
+		assert.NoError(err)
+		defer srvConn.Close()
+
+		assert.True(conn.ConnectionState().HandshakeComplete)
+		assert.EqualValues(tls.VersionTLS13, conn.ConnectionState().Version)
+		assert.Len(conn.ConnectionState().PeerCertificates, 1)
+		assert.True(srvConn.(TLSConn).ConnectionState().HandshakeComplete)
+		assert.Contains(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0")
+		assert.Contains(keyLog.String(), "SERVER_HANDSHAKE_TRAFFIC_SECRET")
+
+		data := bytes.Repeat([]byte{1, 2, 3}, 3*maxDataSize)
+		go func() {
+			_, err := conn.Write(data)
+			assert.NoError(err)
+		}()
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(srvConn, buf)
+		assert.NoError(err)
+		assert.Equal(data, buf)
+
+		_, err = srvConn.Write([]byte("Hello"))
+		assert.NoError(err)
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte("Hello"), buf[:n])
+	})
+
+	t.Run("Should fail if certificate is not trusted", func(t *testing.T) {
+		assert := assert.New(t)
+		server, _ := testTLSConfigs(assert)
+		_, client := testTLSConfigs(assert)
+		l, err := ListenTLS("udp", "127.0.0.1:0", server)
+		assert.NoError(err)
+		defer l.Close()
+
+		conn, err := DialTLS("udp", l.Addr().String(), client)
+
+		assert.Nil(conn)
+		var certErr x509.UnknownAuthorityError
+		assert.ErrorAs(err, &certErr)
+	})
+
+	t.Run("Should not accept nil config", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := DialTLS("udp", "127.0.0.1:8090", nil)
+		assert.ErrorIs(err, errNoTLSConfig)
+		_, err = ListenTLS("udp", "127.0.0.1:0", nil)
+		assert.ErrorIs(err, errNoTLSConfig)
+	})
+}
+
+func TestTLSPacketKeys(t *testing.T) {
+	t.Run("Keys should be derived like in RFC 9001", func(t *testing.T) {
+		assert := assert.New(t)
+		// client initial secret from Appendix A.1 of RFC 9001
+		secret, _ := hex.DecodeString("c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea")
+
+		assert.Equal("1f369613dd76d5467730efcbe3b1a22d", hex.EncodeToString(expandLabel(sha256.New, secret, "quic key", 16)))
+		assert.Equal("fa044b2f42a3fd3b46fb255c", hex.EncodeToString(expandLabel(sha256.New, secret, "quic iv", 12)))
+		assert.Equal("9f50449e04a0e810283a1e9933adedd2", hex.EncodeToString(expandLabel(sha256.New, secret, "quic hp", 16)))
+	})
+
+	t.Run("Should not support ChaCha20-Poly1305", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := tlsPacketKeys(tls.TLS_CHACHA20_POLY1305_SHA256, make([]byte, 32))
+
+		assert.ErrorIs(err, errUnsupportedCipherSuite)
+	})
+}
+
+func TestTLSProtection(t *testing.T) {
+	newPair := func() (w *testWireBuffer, sender, receiver *tlsProtection) {
+		w = &testWireBuffer{}
+		sender, receiver = &tlsProtection{w: w}, &tlsProtection{}
+		keys := handshakeKeys(testPSK)
+		for _, level := range []tls.QUICEncryptionLevel{tls.QUICEncryptionLevelHandshake, tls.QUICEncryptionLevelApplication} {
+			sender.setKeys(level, keys, true)
+			receiver.setKeys(level, keys, false)
+		}
+		return w, sender, receiver
+	}
+	write := func(assert *assert.Assertions, p *tlsProtection, pv packet) {
+		b := make([]byte, pv.len())
+		n, err := pv.encode(b)
+		assert.NoError(err)
+		_, err = p.Write(b[:n])
+		assert.NoError(err)
+	}
+
+	t.Run("Packets should be sent with keys of their level", func(t *testing.T) {
+		assert := assert.New(t)
+		w, sender, receiver := newPair()
+
+		write(assert, sender, cryptoPacket(0, tls.QUICEncryptionLevelInitial, []byte{1}))
+		write(assert, sender, confirmConnectionPacket(1, make([]byte, cookieSize), defaultOptions().transportParameters()))
+		write(assert, sender, pingPacket(2))
+		sender.handshakeDone()
+		write(assert, sender, pingPacket(3))
+
+		ps := w.packets
+		if assert.Len(ps, 4) {
+			for i, epoch := range []byte{0, 0, 2, 3} {
+				assert.Equal(epoch, ps[i][0], "packet %d", i)
+				p, err := receiver.open(ps[i])
+				assert.NoError(err, "packet %d", i)
+				pv, err := decodePacket(p)
+				assert.NoError(err)
+				assert.EqualValues(i, pv.number)
+			}
+		}
+	})
+
+	t.Run("Should drop not protected packets after the handshake", func(t *testing.T) {
+		assert := assert.New(t)
+		_, _, receiver := newPair()
+		b := make([]byte, headerSize+1)
+		n, err := closeConnectionPacket(0).encode(b)
+		assert.NoError(err)
+		forged := tlsCleartext{}.seal(nil, b[:n])
+
+		_, err = receiver.open(bytes.Clone(forged))
+		assert.NoError(err)
+		receiver.handshakeDone()
+		_, err = receiver.open(forged)
+		assert.ErrorIs(err, errPacketNotAuthenticated)
+	})
+
+	t.Run("Should reject replayed packets", func(t *testing.T) {
+		assert := assert.New(t)
+		w, sender, receiver := newPair()
+		sender.handshakeDone()
+
+		write(assert, sender, pingPacket(0))
+		ps := w.packets
+		if assert.Len(ps, 1) {
+			_, err := receiver.open(bytes.Clone(ps[0]))
+			assert.NoError(err)
+			_, err = receiver.open(ps[0])
+			assert.ErrorIs(err, errReplayedPacket)
+		}
+	})
+}
+
+// testWireBuffer keeps packets as they are written on the wire
+type testWireBuffer struct {
+	packets [][]byte
+}
+
+func (buf *testWireBuffer) Write(b []byte) (int, error) {
+	buf.packets = append(buf.packets, bytes.Clone(b)) // writer must not retain b
+	return len(b), nil
+}
+
+// testTLSConfigs returns configs of the server with the self-signed certificate
+// and of the client that trusts it
+func testTLSConfigs(assert *assert.Assertions) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	return server, client
+}